@@ -0,0 +1,123 @@
+// Package config loads configuration for the super-peer and peer binaries.
+//
+// Values are layered with the following precedence, highest first:
+// command-line flags, environment variables, the config file, and the
+// defaults the caller puts in the destination struct. Config files may be
+// YAML or JSON (chosen by extension) and hold one section per binary, e.g.
+// "super_peer:" and "peer:" as documented in the README.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is loaded when no config file is given explicitly and it exists.
+const DefaultFile = "config.yaml"
+
+// Apply fills dst from a config file, environment variables and args.
+//
+// fs must bind its flags to fields of dst and define a string flag named
+// "config" for the config file path. env maps environment variable names to
+// flag names; values from the environment are applied as if the flag had been
+// set. The config file is looked up from the -config flag, then an
+// environment variable mapped to "config", then DefaultFile. Only the given
+// section of the file is used; a file without that section is decoded whole.
+// Returns the path of the loaded config file, or "" if none was used.
+func Apply(fs *flag.FlagSet, args []string, section string, env map[string]string, dst interface{}) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+
+	// Remember the flags given explicitly so they can be re-applied last
+	visited := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = f.Value.String()
+	})
+
+	path := visited["config"]
+	if path == "" {
+		for envName, flagName := range env {
+			if flagName == "config" && os.Getenv(envName) != "" {
+				path = os.Getenv(envName)
+			}
+		}
+	}
+	explicit := path != ""
+	if !explicit {
+		path = DefaultFile
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		if err := LoadFile(path, section, dst); err != nil {
+			return "", fmt.Errorf("config file %s: %w", path, err)
+		}
+	} else if explicit {
+		return "", fmt.Errorf("config file %s: %w", path, err)
+	} else {
+		path = ""
+	}
+
+	for envName, flagName := range env {
+		value, set := os.LookupEnv(envName)
+		if !set || flagName == "config" {
+			continue
+		}
+		if err := fs.Set(flagName, strings.TrimSpace(value)); err != nil {
+			return "", fmt.Errorf("environment variable %s: %w", envName, err)
+		}
+	}
+
+	for name, value := range visited {
+		if err := fs.Set(name, value); err != nil {
+			return "", fmt.Errorf("flag -%s: %w", name, err)
+		}
+	}
+
+	return path, nil
+}
+
+// LoadFile decodes a section of a YAML or JSON config file into dst. Keys
+// missing from the file leave the corresponding fields of dst untouched.
+func LoadFile(path, section string, dst interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Decode generically first to pick out the section
+	var document map[string]interface{}
+	if isJSON(path) {
+		err = json.Unmarshal(data, &document)
+	} else {
+		err = yaml.Unmarshal(data, &document)
+	}
+	if err != nil {
+		return err
+	}
+	if sub, ok := document[section]; ok {
+		if isJSON(path) {
+			data, err = json.Marshal(sub)
+		} else {
+			data, err = yaml.Marshal(sub)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if isJSON(path) {
+		return json.Unmarshal(data, dst)
+	}
+	return yaml.Unmarshal(data, dst)
+}
+
+func isJSON(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
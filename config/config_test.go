@@ -0,0 +1,294 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Name     string   `yaml:"name" json:"name"`
+	Port     int      `yaml:"port" json:"port"`
+	Debug    bool     `yaml:"debug" json:"debug"`
+	MaxSize  Size     `yaml:"max_size" json:"max_size"`
+	Interval Duration `yaml:"interval" json:"interval"`
+	Peers    List     `yaml:"peers" json:"peers"`
+}
+
+var testEnv = map[string]string{
+	"TEST_CONFIG":   "config",
+	"TEST_NAME":     "name",
+	"TEST_PORT":     "port",
+	"TEST_DEBUG":    "debug",
+	"TEST_MAX_SIZE": "max-size",
+	"TEST_INTERVAL": "interval",
+	"TEST_PEERS":    "peers",
+}
+
+func defaultTestConfig() *testConfig {
+	return &testConfig{Name: "default", Port: 1, MaxSize: 1024, Interval: Duration(time.Second), Peers: List{"default:1"}}
+}
+
+// Bind flags to the fields of cfg the way the binaries do
+func testFlags(cfg *testConfig) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.StringVar(&cfg.Name, "name", cfg.Name, "")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "")
+	fs.BoolVar(&cfg.Debug, "debug", cfg.Debug, "")
+	fs.Var(&cfg.MaxSize, "max-size", "")
+	fs.Var(&cfg.Interval, "interval", "")
+	fs.Var(&cfg.Peers, "peers", "")
+	return fs
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const yamlFile = `
+test:
+  name: file
+  port: 2
+  debug: true
+  max_size: 2MB
+  interval: 2m
+  peers: [a:1, b:2]
+other:
+  name: other
+`
+
+func TestApplyPrecedence(t *testing.T) {
+	fileValues := testConfig{Name: "file", Port: 2, Debug: true, MaxSize: 2 << 20, Interval: Duration(2 * time.Minute), Peers: List{"a:1", "b:2"}}
+	envValues := testConfig{Name: "env", Port: 3, Debug: false, MaxSize: 3 << 10, Interval: Duration(3 * time.Second), Peers: List{"c:3", "d:4"}}
+	flagValues := testConfig{Name: "flag", Port: 4, Debug: true, MaxSize: 4, Interval: Duration(4 * time.Hour), Peers: List{"e:5"}}
+
+	env := map[string]string{
+		"TEST_NAME":     "env",
+		"TEST_PORT":     "3",
+		"TEST_DEBUG":    "false",
+		"TEST_MAX_SIZE": "3KB",
+		"TEST_INTERVAL": "3",
+		"TEST_PEERS":    "c:3, d:4",
+	}
+	args := []string{"-name", "flag", "-port", "4", "-debug", "-max-size", "4", "-interval", "4h", "-peers", "e:5"}
+
+	tests := []struct {
+		name  string
+		file  bool
+		env   bool
+		flags bool
+		want  testConfig
+	}{
+		{"defaults", false, false, false, *defaultTestConfig()},
+		{"file over defaults", true, false, false, fileValues},
+		{"environment over file", true, true, false, envValues},
+		{"flags over environment", true, true, true, flagValues},
+		{"flags over file", true, false, true, flagValues},
+		{"flags over defaults", false, false, true, flagValues},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var argv []string
+			if tt.file {
+				argv = append(argv, "-config", writeFile(t, "config.yaml", yamlFile))
+			}
+			if tt.env {
+				for name, value := range env {
+					t.Setenv(name, value)
+				}
+			}
+			if tt.flags {
+				argv = append(argv, args...)
+			}
+
+			cfg := defaultTestConfig()
+			if _, err := Apply(testFlags(cfg), argv, "test", testEnv, cfg); err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if !reflect.DeepEqual(*cfg, tt.want) {
+				t.Fatalf("got %+v, want %+v", *cfg, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyMixedLayers(t *testing.T) {
+	// Each field is set by a different layer; the others are left alone
+	path := writeFile(t, "config.json", `{"test": {"debug": true, "port": 2, "name": "file", "peers": "x:1,y:2"}}`)
+	t.Setenv("TEST_CONFIG", path)
+	t.Setenv("TEST_PORT", "3")
+	t.Setenv("TEST_NAME", "env")
+
+	cfg := defaultTestConfig()
+	loaded, err := Apply(testFlags(cfg), []string{"-name", "flag"}, "test", testEnv, cfg)
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if loaded != path {
+		t.Fatalf("loaded %q, want %q", loaded, path)
+	}
+	want := testConfig{Name: "flag", Port: 3, Debug: true, MaxSize: 1024, Interval: Duration(time.Second), Peers: List{"x:1", "y:2"}}
+	if !reflect.DeepEqual(*cfg, want) {
+		t.Fatalf("got %+v, want %+v", *cfg, want)
+	}
+}
+
+func TestApplyFileWithoutSection(t *testing.T) {
+	path := writeFile(t, "config.yaml", "name: flat\nport: 7\n")
+	cfg := defaultTestConfig()
+	if _, err := Apply(testFlags(cfg), []string{"-config", path}, "test", testEnv, cfg); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if cfg.Name != "flat" || cfg.Port != 7 {
+		t.Fatalf("got %+v", *cfg)
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	cfg := defaultTestConfig()
+	if _, err := Apply(testFlags(cfg), []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, "test", testEnv, cfg); err == nil {
+		t.Error("accepted a missing config file given explicitly")
+	}
+
+	cfg = defaultTestConfig()
+	if _, err := Apply(testFlags(cfg), []string{"-config", writeFile(t, "config.yaml", "test:\n  max_size: lots\n")}, "test", testEnv, cfg); err == nil {
+		t.Error("accepted an invalid size in the config file")
+	}
+
+	t.Setenv("TEST_INTERVAL", "soon")
+	cfg = defaultTestConfig()
+	if _, err := Apply(testFlags(cfg), nil, "test", testEnv, cfg); err == nil {
+		t.Error("accepted an invalid duration in the environment")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"0", 0},
+		{"64KB", 64 << 10},
+		{"64kb", 64 << 10},
+		{"10MiB", 10 << 20},
+		{"1.5GB", 3 << 29},
+		{" 2 TB ", 2 << 40},
+		{"7B", 7},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "-1", "MB", "ten", "1XB"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) accepted", in)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"5m", 5 * time.Minute},
+		{"90", 90 * time.Second},
+		{"1.5", 1500 * time.Millisecond},
+		{"1h30m", 90 * time.Minute},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "soon", "5 minutes"} {
+		if _, err := ParseDuration(in); err == nil {
+			t.Errorf("ParseDuration(%q) accepted", in)
+		}
+	}
+}
+
+// Flags print their default with String, so it must parse back with Set
+func TestValuesRoundTrip(t *testing.T) {
+	for _, size := range []Size{0, 1, 1536, 100 << 20} {
+		var parsed Size
+		if err := parsed.Set(size.String()); err != nil || parsed != size {
+			t.Errorf("Size %d: String %q parsed to %d, %v", size, size.String(), parsed, err)
+		}
+	}
+	for _, d := range []Duration{0, Duration(1500 * time.Millisecond), Duration(30 * time.Second), Duration(26 * time.Hour)} {
+		var parsed Duration
+		if err := parsed.Set(d.String()); err != nil || parsed != d {
+			t.Errorf("Duration %v: String %q parsed to %v, %v", d, d.String(), parsed, err)
+		}
+	}
+
+	for _, l := range []List{nil, {"a:1"}, {"a:1", "b:2"}} {
+		var parsed List
+		if err := parsed.Set(l.String()); err != nil || !reflect.DeepEqual(parsed, l) {
+			t.Errorf("List %v: String %q parsed to %v, %v", l, l.String(), parsed, err)
+		}
+	}
+
+	// Through a FlagSet as well
+	cfg := defaultTestConfig()
+	fs := testFlags(cfg)
+	for _, name := range []string{"max-size", "interval", "peers"} {
+		f := fs.Lookup(name)
+		if err := fs.Set(name, f.Value.String()); err != nil {
+			t.Errorf("flag -%s does not accept its own value %q: %v", name, f.Value.String(), err)
+		}
+	}
+	if cfg.MaxSize != 1024 || cfg.Interval != Duration(time.Second) || !reflect.DeepEqual(cfg.Peers, List{"default:1"}) {
+		t.Fatalf("round trip changed the values: %+v", *cfg)
+	}
+}
+
+func TestListForms(t *testing.T) {
+	tests := []struct {
+		name, file string
+		want       List
+	}{
+		{"yaml sequence", "test:\n  peers:\n    - a:1\n    - b:2\n", List{"a:1", "b:2"}},
+		{"yaml string", "test:\n  peers: a:1, b:2\n", List{"a:1", "b:2"}},
+		{"json array", `{"test": {"peers": ["a:1", "b:2"]}}`, List{"a:1", "b:2"}},
+		{"json string", `{"test": {"peers": "a:1,,b:2,"}}`, List{"a:1", "b:2"}},
+	}
+	for _, tt := range tests {
+		name := "config.yaml"
+		if tt.file[0] == '{' {
+			name = "config.json"
+		}
+		cfg := defaultTestConfig()
+		if _, err := Apply(testFlags(cfg), []string{"-config", writeFile(t, name, tt.file)}, "test", testEnv, cfg); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(cfg.Peers, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, cfg.Peers, tt.want)
+		}
+	}
+
+	// An empty value clears the list
+	t.Setenv("TEST_PEERS", "")
+	cfg := defaultTestConfig()
+	if _, err := Apply(testFlags(cfg), nil, "test", testEnv, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Peers) != 0 {
+		t.Errorf("got %v, want an empty list", cfg.Peers)
+	}
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size is a byte count written as a plain number or with a unit, e.g. "100MB".
+// Units are powers of 1024.
+type Size int64
+
+// Duration is written as a Go duration ("30s", "5m") or a number of seconds.
+type Duration time.Duration
+
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// ParseSize parses a byte count such as "512", "64KB" or "1.5GB".
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.Replace(value, "IB", "B", 1) // Accept KiB, MiB, ...
+
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.multiplier
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// ParseDuration parses a Go duration or a plain number of seconds.
+func ParseDuration(s string) (time.Duration, error) {
+	value := strings.TrimSpace(s)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+func (s Size) String() string { return strconv.FormatInt(int64(s), 10) }
+
+func (s *Size) Set(value string) error {
+	n, err := ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = Size(n)
+	return nil
+}
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) error { return s.Set(node.Value) }
+
+func (s *Size) UnmarshalJSON(data []byte) error { return s.Set(strings.Trim(string(data), `"`)) }
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d *Duration) Set(value string) error {
+	parsed, err := ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error { return d.Set(node.Value) }
+
+func (d *Duration) UnmarshalJSON(data []byte) error { return d.Set(strings.Trim(string(data), `"`)) }
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(d.String()) }
+
+func (d Duration) MarshalYAML() (interface{}, error) { return d.String(), nil }
+
+// List is a list of strings, written as a sequence in config files or as a
+// comma-separated string ("a:1,b:2") there and in flags and env vars.
+type List []string
+
+func (l List) String() string { return strings.Join(l, ",") }
+
+func (l *List) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l *List) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return l.Set(node.Value)
+	}
+	var items []string
+	if err := node.Decode(&items); err != nil {
+		return err
+	}
+	*l = items
+	return nil
+}
+
+func (l *List) UnmarshalJSON(data []byte) error {
+	var items []string
+	if err := json.Unmarshal(data, &items); err == nil {
+		*l = items
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid list %s", data)
+	}
+	return l.Set(value)
+}
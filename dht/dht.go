@@ -0,0 +1,564 @@
+// Package dht implements a Kademlia distributed hash table mapping content
+// hashes to the peers that hold the content.
+//
+// Node IDs and keys are 256 bits; a key is a SHA-256 content hash and the
+// distance between two IDs is their XOR. Every node keeps a routing table of
+// k-buckets, one per bit of distance, each holding up to K contacts with the
+// least recently seen first. Lookups query the Alpha closest known contacts
+// in parallel and move on to the closer contacts they return until the K
+// closest nodes have all answered. A provider announces a key by storing a
+// record of itself on the K nodes closest to the key. Records expire after
+// RecordTTL unless the provider republishes them.
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Defaults
+const (
+	DefaultK                 = 8
+	DefaultAlpha             = 3
+	DefaultRecordTTL         = time.Hour
+	DefaultRepublishInterval = 20 * time.Minute
+	DefaultRefreshInterval   = time.Minute
+	DefaultTimeout           = 2 * time.Second
+)
+
+// Limits on stored records
+const (
+	maxProvidersPerKey = 64
+	maxMetadataSize    = 4096
+)
+
+// ID is a node ID or key.
+type ID [32]byte
+
+// NewID derives a node ID from a stable name, such as a peer ID.
+func NewID(name string) ID {
+	return sha256.Sum256([]byte(name))
+}
+
+// ParseID parses a hex ID, such as a SHA-256 content hash.
+func ParseID(s string) (ID, error) {
+	var id ID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid DHT key %q", s)
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *ID) UnmarshalText(text []byte) error {
+	parsed, err := ParseID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+// Whether a is closer to target than b
+func closer(target, a, b ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// Index of the bucket other belongs in: the number of leading bits it shares
+// with self. -1 for self.
+func bucketIndex(self, other ID) int {
+	for i := range self {
+		if x := self[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return -1
+}
+
+// Contact is a node of the DHT.
+type Contact struct {
+	ID      ID     `json:"id"`
+	Address string `json:"address"` // host:port
+}
+
+// Provider is a record of a peer holding the content of a key.
+type Provider struct {
+	PeerID   string          `json:"peer_id,omitempty"`
+	Address  string          `json:"address"`
+	Metadata json.RawMessage `json:"metadata,omitempty"` // set by the provider, e.g. the filename
+	Expires  time.Time       `json:"expires"`
+}
+
+// Config configures a node.
+type Config struct {
+	ID      ID
+	Address string // host:port the other nodes reach this node at
+	PeerID  string // stored in the records this node announces
+	// Bootstrap nodes contacted to join the DHT, and again whenever the
+	// routing table runs empty.
+	Bootstrap []string
+
+	K                 int // bucket size and number of nodes a record is stored on
+	Alpha             int // parallel requests per lookup
+	RecordTTL         time.Duration
+	RepublishInterval time.Duration
+	RefreshInterval   time.Duration
+	Timeout           time.Duration // per request
+}
+
+// Status describes a node, as served by the status endpoints.
+type Status struct {
+	ID        ID       `json:"id"`
+	Address   string   `json:"address"`
+	Contacts  int      `json:"contacts"`
+	Buckets   int      `json:"buckets"` // non-empty buckets
+	Keys      int      `json:"keys"`    // keys with records stored here
+	Records   int      `json:"records"`
+	Announced []string `json:"announced"` // keys this node provides
+	Bootstrap []string `json:"bootstrap"`
+}
+
+// Node is a member of the DHT. It is safe for concurrent use.
+type Node struct {
+	config Config
+	rpc    *rpcClient
+
+	mutex     sync.Mutex
+	buckets   [256][]Contact
+	pending   map[int]Contact            // bucket index -> contact waiting on a ping of the bucket's oldest
+	records   map[ID]map[string]Provider // key -> provider address -> record
+	announced map[ID]json.RawMessage     // keys we provide, with their metadata
+}
+
+// NewNode creates a node, filling in defaults for unset settings.
+func NewNode(config Config) *Node {
+	if config.K <= 0 {
+		config.K = DefaultK
+	}
+	if config.Alpha <= 0 {
+		config.Alpha = DefaultAlpha
+	}
+	if config.RecordTTL <= 0 {
+		config.RecordTTL = DefaultRecordTTL
+	}
+	if config.RepublishInterval <= 0 {
+		config.RepublishInterval = DefaultRepublishInterval
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	n := &Node{
+		config:    config,
+		pending:   make(map[int]Contact),
+		records:   make(map[ID]map[string]Provider),
+		announced: make(map[ID]json.RawMessage),
+	}
+	n.rpc = newRPCClient(n.self(), config.Timeout)
+	return n
+}
+
+func (n *Node) self() Contact {
+	return Contact{ID: n.config.ID, Address: n.config.Address}
+}
+
+// Run joins the DHT through the bootstrap nodes, then keeps the routing
+// table fresh, republishes announced keys and drops expired records until
+// ctx is done.
+func (n *Node) Run(ctx context.Context) {
+	n.bootstrap()
+	n.republish()
+
+	refresh := time.NewTicker(n.config.RefreshInterval)
+	defer refresh.Stop()
+	republish := time.NewTicker(n.config.RepublishInterval)
+	defer republish.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			if n.size() == 0 {
+				if n.bootstrap() {
+					n.republish()
+				}
+			} else {
+				n.lookup(n.config.ID, false)
+			}
+			n.expire()
+		case <-republish.C:
+			n.republish()
+		}
+	}
+}
+
+// Contact the bootstrap nodes and look ourselves up, which fills the buckets
+// with the nodes around us. Returns false if no bootstrap node answered.
+func (n *Node) bootstrap() bool {
+	joined := false
+	for _, address := range n.config.Bootstrap {
+		if address == n.config.Address {
+			continue
+		}
+		if contact, err := n.rpc.ping(address); err == nil {
+			n.observe(contact)
+			joined = true
+		}
+	}
+	if !joined {
+		if len(n.config.Bootstrap) > 0 {
+			log.Printf("⚠️ No DHT bootstrap node reachable, retrying later")
+		}
+		return false
+	}
+
+	n.lookup(n.config.ID, false)
+	log.Printf("🧭 Joined the DHT with %d contacts", n.size())
+	return true
+}
+
+// Announce stores a record of this node as a provider of key on the nodes
+// closest to it, and keeps republishing it until Withdraw. Announcing a key
+// again with the same metadata is left to the republishing.
+func (n *Node) Announce(key ID, metadata json.RawMessage) error {
+	if len(metadata) > maxMetadataSize {
+		return fmt.Errorf("metadata larger than %d bytes", maxMetadataSize)
+	}
+	n.mutex.Lock()
+	previous, exists := n.announced[key]
+	n.announced[key] = metadata
+	n.mutex.Unlock()
+	if exists && bytes.Equal(previous, metadata) {
+		return nil
+	}
+
+	n.store(key, metadata)
+	return nil
+}
+
+// Withdraw stops republishing key. Records already stored elsewhere expire
+// after RecordTTL.
+func (n *Node) Withdraw(key ID) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.announced, key)
+	delete(n.records[key], n.config.Address)
+}
+
+// FindProviders looks up the peers holding the content of key.
+func (n *Node) FindProviders(key ID) []Provider {
+	_, found := n.lookup(key, true)
+
+	n.mutex.Lock()
+	for address, provider := range n.records[key] {
+		if _, exists := found[address]; !exists && time.Now().Before(provider.Expires) {
+			found[address] = provider
+		}
+	}
+	n.mutex.Unlock()
+
+	providers := make([]Provider, 0, len(found))
+	for _, provider := range found {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Address < providers[j].Address })
+	return providers
+}
+
+// Status returns a summary of the routing table and stored records.
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	status := Status{
+		ID:        n.config.ID,
+		Address:   n.config.Address,
+		Keys:      len(n.records),
+		Announced: []string{},
+		Bootstrap: n.config.Bootstrap,
+	}
+	for _, bucket := range n.buckets {
+		status.Contacts += len(bucket)
+		if len(bucket) > 0 {
+			status.Buckets++
+		}
+	}
+	for _, providers := range n.records {
+		status.Records += len(providers)
+	}
+	for key := range n.announced {
+		status.Announced = append(status.Announced, key.String())
+	}
+	sort.Strings(status.Announced)
+	return status
+}
+
+// Store our record for key on the K closest nodes, and locally
+func (n *Node) store(key ID, metadata json.RawMessage) {
+	record := Provider{PeerID: n.config.PeerID, Address: n.config.Address, Metadata: metadata}
+	n.putRecord(key, record)
+
+	closest, _ := n.lookup(key, false)
+	for _, contact := range closest {
+		if err := n.rpc.store(contact.Address, key, record); err != nil {
+			n.remove(contact)
+		}
+	}
+}
+
+func (n *Node) republish() {
+	n.mutex.Lock()
+	announced := make(map[ID]json.RawMessage, len(n.announced))
+	for key, metadata := range n.announced {
+		announced[key] = metadata
+	}
+	n.mutex.Unlock()
+
+	for key, metadata := range announced {
+		n.store(key, metadata)
+	}
+}
+
+// Keep a record, with an expiry set by us rather than the sender
+func (n *Node) putRecord(key ID, record Provider) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	providers := n.records[key]
+	if providers == nil {
+		providers = make(map[string]Provider)
+		n.records[key] = providers
+	}
+	if _, exists := providers[record.Address]; !exists && len(providers) >= maxProvidersPerKey {
+		return false
+	}
+	record.Expires = time.Now().Add(n.config.RecordTTL)
+	providers[record.Address] = record
+	return true
+}
+
+func (n *Node) expire() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	for key, providers := range n.records {
+		for address, provider := range providers {
+			if now.After(provider.Expires) {
+				delete(providers, address)
+			}
+		}
+		if len(providers) == 0 {
+			delete(n.records, key)
+		}
+	}
+}
+
+// Lookups
+
+// Find the K closest live nodes to target and, with findValue, the
+// providers of target they hold
+func (n *Node) lookup(target ID, findValue bool) ([]Contact, map[string]Provider) {
+	providers := make(map[string]Provider)
+	shortlist := n.closest(target, n.config.K)
+	queried := make(map[string]bool)
+	failed := make(map[string]bool)
+
+	for {
+		var batch []Contact
+		for _, contact := range shortlist {
+			if !queried[contact.Address] && len(batch) < n.config.Alpha {
+				batch = append(batch, contact)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		type answer struct {
+			from      Contact
+			contacts  []Contact
+			providers []Provider
+			err       error
+		}
+		answers := make(chan answer, len(batch))
+		for _, contact := range batch {
+			queried[contact.Address] = true
+			go func(contact Contact) {
+				var a answer
+				a.from = contact
+				if findValue {
+					a.contacts, a.providers, a.err = n.rpc.findValue(contact.Address, target)
+				} else {
+					a.contacts, a.err = n.rpc.findNode(contact.Address, target)
+				}
+				answers <- a
+			}(contact)
+		}
+
+		for range batch {
+			a := <-answers
+			if a.err != nil {
+				failed[a.from.Address] = true
+				n.remove(a.from)
+				continue
+			}
+			n.observe(a.from)
+			for _, provider := range a.providers {
+				providers[provider.Address] = provider
+			}
+			for _, contact := range a.contacts {
+				if contact.ID != n.config.ID && contact.Address != n.config.Address && !contains(shortlist, contact.Address) {
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+
+		// Keep the K closest nodes that have not failed
+		live := shortlist[:0]
+		for _, contact := range shortlist {
+			if !failed[contact.Address] {
+				live = append(live, contact)
+			}
+		}
+		shortlist = live
+		sort.Slice(shortlist, func(i, j int) bool { return closer(target, shortlist[i].ID, shortlist[j].ID) })
+		if len(shortlist) > n.config.K {
+			shortlist = shortlist[:n.config.K]
+		}
+	}
+	return shortlist, providers
+}
+
+func contains(contacts []Contact, address string) bool {
+	for _, contact := range contacts {
+		if contact.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Routing table
+
+// The count closest contacts to target in the routing table
+func (n *Node) closest(target ID, count int) []Contact {
+	n.mutex.Lock()
+	var contacts []Contact
+	for _, bucket := range n.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	n.mutex.Unlock()
+
+	sort.Slice(contacts, func(i, j int) bool { return closer(target, contacts[i].ID, contacts[j].ID) })
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+func (n *Node) size() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	count := 0
+	for _, bucket := range n.buckets {
+		count += len(bucket)
+	}
+	return count
+}
+
+// Record that a node answered or contacted us. Known contacts move to the
+// tail of their bucket. A new contact joins its bucket if there is room;
+// otherwise the least recently seen contact is pinged and only replaced if
+// it does not answer, since nodes that stayed up long tend to stay up. A
+// bucket has at most one ping in flight; new contacts seen meanwhile replace
+// the one waiting on it.
+func (n *Node) observe(contact Contact) {
+	index := bucketIndex(n.config.ID, contact.ID)
+	if index < 0 || contact.Address == n.config.Address || contact.Address == "" {
+		return
+	}
+
+	n.mutex.Lock()
+	bucket := n.buckets[index]
+	for i, existing := range bucket {
+		if existing.Address == contact.Address || existing.ID == contact.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			n.buckets[index] = append(bucket, contact)
+			n.mutex.Unlock()
+			return
+		}
+	}
+	if len(bucket) < n.config.K {
+		n.buckets[index] = append(bucket, contact)
+		n.mutex.Unlock()
+		return
+	}
+	_, pinging := n.pending[index]
+	n.pending[index] = contact
+	oldest := bucket[0]
+	n.mutex.Unlock()
+	if pinging {
+		return
+	}
+
+	go func() {
+		_, err := n.rpc.ping(oldest.Address)
+		n.mutex.Lock()
+		waiting := n.pending[index]
+		delete(n.pending, index)
+		n.mutex.Unlock()
+
+		if err == nil {
+			n.observe(oldest)
+			return
+		}
+		n.remove(oldest)
+		n.observe(waiting)
+	}()
+}
+
+func (n *Node) remove(contact Contact) {
+	index := bucketIndex(n.config.ID, contact.ID)
+	if index < 0 {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	bucket := n.buckets[index]
+	for i, existing := range bucket {
+		if existing.Address == contact.Address {
+			n.buckets[index] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
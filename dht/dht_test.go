@@ -0,0 +1,172 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Start count nodes on localhost, each joined through the first
+func startNodes(t *testing.T, count int) []*Node {
+	t.Helper()
+	var nodes []*Node
+	for i := 0; i < count; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bootstrap []string
+		if i > 0 {
+			bootstrap = []string{nodes[0].config.Address}
+		}
+		node := NewNode(Config{
+			ID:        NewID(fmt.Sprintf("node-%d", i)),
+			Address:   listener.Addr().String(),
+			PeerID:    fmt.Sprintf("peer-%d", i),
+			Bootstrap: bootstrap,
+			K:         4,
+			Timeout:   time.Second,
+		})
+		mux := http.NewServeMux()
+		mux.HandleFunc(PathPrefix+"ping", node.HandlePing)
+		mux.HandleFunc(PathPrefix+"find_node", node.HandleFindNode)
+		mux.HandleFunc(PathPrefix+"find_value", node.HandleFindValue)
+		mux.HandleFunc(PathPrefix+"store", node.HandleStore)
+		server := &http.Server{Handler: mux}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes[1:] {
+		if !node.bootstrap() {
+			t.Fatalf("%s could not join", node.config.Address)
+		}
+	}
+	return nodes
+}
+
+func TestLookup(t *testing.T) {
+	nodes := startNodes(t, 12)
+
+	// Every node finds the nodes closest to any target, not only the
+	// bootstrap node
+	target := NewID("somewhere")
+	want, _ := nodes[len(nodes)-1].lookup(target, false)
+	if len(want) != 4 {
+		t.Fatalf("lookup found %d contacts, want 4", len(want))
+	}
+	for _, node := range nodes[1:4] {
+		got, _ := node.lookup(target, false)
+		if len(got) == 0 || got[0].ID != want[0].ID {
+			t.Fatalf("%s found %v as closest, want %v", node.config.Address, got, want[0])
+		}
+	}
+}
+
+func TestStoreAndFindProviders(t *testing.T) {
+	nodes := startNodes(t, 12)
+
+	key := NewID("content")
+	provider := nodes[5]
+	if err := provider.Announce(key, json.RawMessage(`{"filename":"a.txt"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range []*Node{nodes[0], nodes[3], nodes[11]} {
+		providers := node.FindProviders(key)
+		if len(providers) != 1 {
+			t.Fatalf("%s found %d providers, want 1", node.config.Address, len(providers))
+		}
+		if providers[0].Address != provider.config.Address || providers[0].PeerID != "peer-5" {
+			t.Fatalf("unexpected provider %+v", providers[0])
+		}
+	}
+
+	provider.Withdraw(key)
+	if len(nodes[11].FindProviders(NewID("other content"))) != 0 {
+		t.Fatal("found providers of a key nobody announced")
+	}
+}
+
+func TestSpoofedSenderRejected(t *testing.T) {
+	nodes := startNodes(t, 2)
+
+	// A store claiming to come from another host must not plant its record
+	key := NewID("content")
+	spoofed := Contact{ID: NewID("spoofed"), Address: "10.1.2.3:9001"}
+	body, _ := json.Marshal(rpcRequest{
+		Sender:   spoofed,
+		Target:   &key,
+		Provider: &Provider{Address: spoofed.Address},
+	})
+	resp, err := http.Post("http://"+nodes[0].config.Address+PathPrefix+"store", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("spoofed store returned %s", resp.Status)
+	}
+	if status := nodes[0].Status(); status.Records != 0 || status.Contacts != 1 {
+		t.Fatalf("spoofed sender was recorded: %+v", status)
+	}
+}
+
+func TestSenderAddress(t *testing.T) {
+	tests := []struct {
+		declared, remote, want string
+		ok                     bool
+	}{
+		{"127.0.0.1:9001", "127.0.0.1:53211", "127.0.0.1:9001", true},
+		{"localhost:9001", "127.0.0.1:53211", "127.0.0.1:9001", true},
+		{"10.0.0.1:9001", "127.0.0.1:53211", "", false},
+		{"[::1]:9001", "[::1]:53211", "[::1]:9001", true},
+		{"9001", "127.0.0.1:53211", "", false},
+	}
+	for _, test := range tests {
+		got, ok := senderAddress(test.declared, test.remote)
+		if got != test.want || ok != test.ok {
+			t.Errorf("senderAddress(%q, %q) = %q, %v, want %q, %v", test.declared, test.remote, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestObserveFullBucketPingsOnce(t *testing.T) {
+	// A node whose contacts do not answer, with a full bucket
+	node := NewNode(Config{ID: ID{}, Address: "127.0.0.1:1", K: 2, Timeout: 100 * time.Millisecond})
+	contact := func(i byte) Contact {
+		id := ID{0x80, i}
+		return Contact{ID: id, Address: fmt.Sprintf("127.0.0.1:%d", 2+int(i))}
+	}
+	node.observe(contact(1))
+	node.observe(contact(2))
+
+	// Many new contacts for the same bucket wait on a single ping
+	for i := byte(3); i < 100; i++ {
+		node.observe(contact(i))
+	}
+	node.mutex.Lock()
+	pending := len(node.pending)
+	node.mutex.Unlock()
+	if pending != 1 {
+		t.Fatalf("%d pings pending, want 1", pending)
+	}
+
+	// The unreachable oldest contact is replaced by the latest one seen
+	var bucket []Contact
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		node.mutex.Lock()
+		bucket = append([]Contact{}, node.buckets[0]...)
+		node.mutex.Unlock()
+		if len(bucket) == 2 && bucket[0] == contact(2) && bucket[1] == contact(99) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("bucket is %v", bucket)
+}
@@ -0,0 +1,210 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// PathPrefix is where the RPC handlers are mounted on every node.
+const PathPrefix = "/api/v1/dht/"
+
+// Every request and response names its sender, so both sides learn about
+// each other
+type rpcRequest struct {
+	Sender   Contact   `json:"sender"`
+	Target   *ID       `json:"target,omitempty"` // find_node, find_value and store
+	Provider *Provider `json:"provider,omitempty"`
+}
+
+type rpcResponse struct {
+	Sender    Contact    `json:"sender"`
+	Contacts  []Contact  `json:"contacts,omitempty"`
+	Providers []Provider `json:"providers,omitempty"`
+}
+
+type rpcClient struct {
+	self   Contact
+	client *http.Client
+}
+
+func newRPCClient(self Contact, timeout time.Duration) *rpcClient {
+	return &rpcClient{self: self, client: &http.Client{Timeout: timeout}}
+}
+
+func (c *rpcClient) call(address, method string, req rpcRequest) (rpcResponse, error) {
+	req.Sender = c.self
+	body, err := json.Marshal(req)
+	if err != nil {
+		return rpcResponse{}, err
+	}
+	r, err := c.client.Post(fmt.Sprintf("http://%s%s%s", address, PathPrefix, method), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return rpcResponse{}, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return rpcResponse{}, fmt.Errorf("%s returned %s", address, r.Status)
+	}
+
+	var resp rpcResponse
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		return rpcResponse{}, err
+	}
+	// Nodes are known by the address we reached them at
+	resp.Sender.Address = address
+	return resp, nil
+}
+
+func (c *rpcClient) ping(address string) (Contact, error) {
+	resp, err := c.call(address, "ping", rpcRequest{})
+	return resp.Sender, err
+}
+
+func (c *rpcClient) findNode(address string, target ID) ([]Contact, error) {
+	resp, err := c.call(address, "find_node", rpcRequest{Target: &target})
+	return resp.Contacts, err
+}
+
+func (c *rpcClient) findValue(address string, key ID) ([]Contact, []Provider, error) {
+	resp, err := c.call(address, "find_value", rpcRequest{Target: &key})
+	return resp.Contacts, resp.Providers, err
+}
+
+func (c *rpcClient) store(address string, key ID, provider Provider) error {
+	_, err := c.call(address, "store", rpcRequest{Target: &key, Provider: &provider})
+	return err
+}
+
+// HTTP handlers
+
+// HandlePing answers pings. Mount it at PathPrefix + "ping".
+func (n *Node) HandlePing(w http.ResponseWriter, r *http.Request) {
+	if _, ok := n.decode(w, r, false); ok {
+		n.reply(w, rpcResponse{})
+	}
+}
+
+// HandleFindNode returns the K closest contacts to a target. Mount it at
+// PathPrefix + "find_node".
+func (n *Node) HandleFindNode(w http.ResponseWriter, r *http.Request) {
+	if req, ok := n.decode(w, r, true); ok {
+		n.reply(w, rpcResponse{Contacts: n.closestExcept(*req.Target, req.Sender.Address)})
+	}
+}
+
+// HandleFindValue returns the unexpired providers of a key held by this node
+// along with the K closest contacts to it. Mount it at PathPrefix +
+// "find_value".
+func (n *Node) HandleFindValue(w http.ResponseWriter, r *http.Request) {
+	req, ok := n.decode(w, r, true)
+	if !ok {
+		return
+	}
+
+	resp := rpcResponse{Contacts: n.closestExcept(*req.Target, req.Sender.Address)}
+	n.mutex.Lock()
+	now := time.Now()
+	for _, provider := range n.records[*req.Target] {
+		if now.Before(provider.Expires) {
+			resp.Providers = append(resp.Providers, provider)
+		}
+	}
+	n.mutex.Unlock()
+	n.reply(w, resp)
+}
+
+// HandleStore keeps a provider record. Nodes may only store records of
+// themselves. Mount it at PathPrefix + "store".
+func (n *Node) HandleStore(w http.ResponseWriter, r *http.Request) {
+	req, ok := n.decode(w, r, true)
+	if !ok {
+		return
+	}
+	if req.Provider == nil || req.Provider.Address != req.Sender.Address {
+		http.Error(w, "Provider must be the sender", http.StatusBadRequest)
+		return
+	}
+	if len(req.Provider.Metadata) > maxMetadataSize {
+		http.Error(w, "Metadata too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !n.putRecord(*req.Target, *req.Provider) {
+		http.Error(w, "Too many providers for key", http.StatusInsufficientStorage)
+		return
+	}
+	n.reply(w, rpcResponse{})
+}
+
+func (n *Node) decode(w http.ResponseWriter, r *http.Request, needTarget bool) (rpcRequest, bool) {
+	var req rpcRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil || req.Sender.Address == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return req, false
+	}
+	if needTarget && req.Target == nil {
+		http.Error(w, "Target required", http.StatusBadRequest)
+		return req, false
+	}
+
+	// Senders are known by the host they connected from and the port they
+	// say they listen on, so a node cannot plant another node's address
+	declared := req.Sender.Address
+	address, ok := senderAddress(declared, r.RemoteAddr)
+	if !ok {
+		http.Error(w, "Sender address does not match connection", http.StatusForbidden)
+		return req, false
+	}
+	req.Sender.Address = address
+	if req.Provider != nil && req.Provider.Address == declared {
+		req.Provider.Address = address
+	}
+	n.observe(req.Sender)
+	return req, true
+}
+
+// The address of a sender declaring declared and connected from remote. A
+// declared IP must be the one the sender connected from; a host name is
+// replaced by it.
+func senderAddress(declared, remote string) (string, bool) {
+	host, port, err := net.SplitHostPort(declared)
+	if err != nil || port == "" {
+		return "", false
+	}
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", false
+	}
+	remoteIP := net.ParseIP(remoteHost)
+	if remoteIP == nil {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.Equal(remoteIP) {
+		return "", false
+	}
+	return net.JoinHostPort(remoteIP.String(), port), true
+}
+
+func (n *Node) reply(w http.ResponseWriter, resp rpcResponse) {
+	resp.Sender = n.self()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// The K closest contacts to target, leaving out the node asking
+func (n *Node) closestExcept(target ID, address string) []Contact {
+	contacts := n.closest(target, n.config.K+1)
+	kept := contacts[:0]
+	for _, contact := range contacts {
+		if contact.Address != address {
+			kept = append(kept, contact)
+		}
+	}
+	if len(kept) > n.config.K {
+		kept = kept[:n.config.K]
+	}
+	return kept
+}
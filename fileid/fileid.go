@@ -0,0 +1,17 @@
+// Package fileid derives the IDs of shared files, which peers and
+// super-peers must compute the same way.
+package fileid
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Derive returns the ID of a shared file from its content hash, the peer ID
+// of its owner and its path relative to the owner's shared directory. The
+// same content shared under two paths has two IDs, and an ID stays the same
+// across restarts as long as the file neither changes nor moves.
+func Derive(hash, owner, path string) string {
+	sum := sha256.Sum256([]byte(hash + ":" + owner + ":" + path))
+	return hex.EncodeToString(sum[:8])
+}
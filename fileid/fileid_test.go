@@ -0,0 +1,22 @@
+package fileid
+
+import "testing"
+
+func TestDerive(t *testing.T) {
+	id := Derive("abc", "peer_1", "music/a.mp3")
+	if len(id) != 16 {
+		t.Fatalf("Derive returned %q, want 16 hex digits", id)
+	}
+	if Derive("abc", "peer_1", "music/a.mp3") != id {
+		t.Fatal("Derive is not deterministic")
+	}
+	for _, other := range []string{
+		Derive("abd", "peer_1", "music/a.mp3"),
+		Derive("abc", "peer_2", "music/a.mp3"),
+		Derive("abc", "peer_1", "music/b.mp3"),
+	} {
+		if other == id {
+			t.Fatal("Derive ignores one of its inputs")
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Package identity implements peer identities and signed requests.
+//
+// Every peer owns an Ed25519 keypair and its peer ID is derived from the
+// public key, so the super-peer can check that a request really comes from
+// the peer it claims to. Requests are signed over the method, request URI,
+// a timestamp, a random nonce and the SHA-256 of the body; a verifier that
+// remembers the nonces it saw rejects a signed request sent a second time.
+// Identities are saved to disk so a
+// peer keeps its ID across restarts. A peer that replaces its key carries a
+// succession proof, signed by the old key, so its earlier records can be
+// handed to the new ID.
+//
+// Super-peers federating or clustering with each other sign their requests
+// with an HMAC under a key shared by the group instead.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request headers carrying the signature
+const (
+	HeaderPeerID    = "X-Peer-ID"
+	HeaderTimestamp = "X-Peer-Timestamp"
+	HeaderNonce     = "X-Peer-Nonce"
+	HeaderSignature = "X-Peer-Signature"
+)
+
+// MaxClockSkew is how far a request timestamp may be from the verifier's clock.
+const MaxClockSkew = 5 * time.Minute
+
+// maxNonceLength bounds the nonces a verifier keeps.
+const maxNonceLength = 64
+
+// Identity is a peer's keypair and the ID derived from it.
+type Identity struct {
+	ID         string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	Previous   *Succession // set if the identity replaced an earlier one
+}
+
+// Succession proves that an identity replaced an earlier one: the earlier
+// key signed the new peer ID.
+type Succession struct {
+	PeerID    string `json:"peer_id"`    // the earlier peer ID
+	PublicKey string `json:"public_key"` // the earlier public key, base64
+	Signature string `json:"signature"`  // by the earlier key, base64
+}
+
+// Generate creates a new random identity.
+func Generate() (*Identity, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ID: PeerID(pub), PublicKey: pub, PrivateKey: priv}, nil
+}
+
+// identityFile is the on-disk form of an identity.
+type identityFile struct {
+	PeerID     string      `json:"peer_id"`
+	PrivateKey string      `json:"private_key"` // base64 Ed25519 seed
+	Previous   *Succession `json:"previous,omitempty"`
+}
+
+// Load reads an identity saved with Save. The error wraps os.ErrNotExist if
+// there is none.
+func Load(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file identityFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid identity file: %w", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(file.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid private key in identity file")
+	}
+
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	id := &Identity{ID: PeerID(pub), PublicKey: pub, PrivateKey: priv}
+	if file.PeerID != "" && file.PeerID != id.ID {
+		return nil, errors.New("peer ID in identity file does not match its key")
+	}
+	if file.Previous != nil {
+		if err := VerifySuccession(*file.Previous, id.ID); err != nil {
+			return nil, fmt.Errorf("identity file: %w", err)
+		}
+		id.Previous = file.Previous
+	}
+	return id, nil
+}
+
+// Rotate creates a new identity replacing id, with a succession proof
+// signed by id.
+func (id *Identity) Rotate() (*Identity, error) {
+	next, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	next.Previous = &Succession{
+		PeerID:    id.ID,
+		PublicKey: EncodePublicKey(id.PublicKey),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(id.PrivateKey, successionMessage(id.ID, next.ID))),
+	}
+	return next, nil
+}
+
+// VerifySuccession checks that s was signed by the key of the earlier peer
+// ID it names, for peerID.
+func VerifySuccession(s Succession, peerID string) error {
+	pub, err := DecodePublicKey(s.PublicKey)
+	if err != nil {
+		return fmt.Errorf("succession: %w", err)
+	}
+	if PeerID(pub) != s.PeerID {
+		return errors.New("succession: earlier peer ID does not match its key")
+	}
+	if s.PeerID == peerID {
+		return errors.New("succession: an identity cannot succeed itself")
+	}
+	signature, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil || !ed25519.Verify(pub, successionMessage(s.PeerID, peerID), signature) {
+		return errors.New("succession: invalid signature")
+	}
+	return nil
+}
+
+// successionMessage builds the byte string covered by a succession proof.
+func successionMessage(previous, next string) []byte {
+	return []byte("succession\n" + previous + "\n" + next)
+}
+
+// Save writes the identity to path, readable by the owner only.
+func (id *Identity) Save(path string) error {
+	data, err := json.MarshalIndent(identityFile{
+		PeerID:     id.ID,
+		PrivateKey: base64.StdEncoding.EncodeToString(id.PrivateKey.Seed()),
+		Previous:   id.Previous,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// PeerID derives the peer ID of a public key.
+func PeerID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "peer_" + hex.EncodeToString(sum[:16])
+}
+
+// EncodePublicKey returns the base64 form of a public key used on the wire.
+func EncodePublicKey(pub ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// DecodePublicKey parses a base64-encoded public key.
+func DecodePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign adds the identity headers and signature to req. body must be the exact
+// request body (nil for requests without one).
+func (id *Identity) Sign(req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	signature := ed25519.Sign(id.PrivateKey, message(req.Method, req.URL.RequestURI(), timestamp, nonce, body))
+
+	req.Header.Set(HeaderPeerID, id.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(signature))
+}
+
+// Verify checks that r was signed by the owner of pub within the allowed
+// clock skew and was not seen before. body must be the request body as read
+// by the server.
+func Verify(r *http.Request, body []byte, pub ed25519.PublicKey, seen *Nonces) error {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	encoded := r.Header.Get(HeaderSignature)
+	if timestamp == "" || nonce == "" || encoded == "" {
+		return errors.New("request is not signed")
+	}
+
+	signedAt, err := checkTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	if !ed25519.Verify(pub, message(r.Method, r.URL.RequestURI(), timestamp, nonce, body), signature) {
+		return errors.New("invalid signature")
+	}
+	return seen.check(PeerID(pub), nonce, signedAt)
+}
+
+// message builds the byte string covered by a request signature.
+func message(method, requestURI, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	return []byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:]))
+}
+
+// checkTimestamp parses a signature timestamp and checks it is within the
+// allowed clock skew.
+func checkTimestamp(timestamp string) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("invalid signature timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := time.Since(signedAt); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return time.Time{}, fmt.Errorf("signature timestamp outside allowed skew")
+	}
+	return signedAt, nil
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Nonces remembers the nonces of the signed requests a verifier accepted,
+// for as long as their timestamps are within the allowed clock skew, so a
+// request cannot be replayed.
+type Nonces struct {
+	mutex     sync.Mutex
+	seen      map[string]time.Time // signer and nonce to when they expire
+	lastSweep time.Time
+}
+
+// NewNonces creates an empty nonce cache.
+func NewNonces() *Nonces {
+	return &Nonces{seen: make(map[string]time.Time)}
+}
+
+// check records the nonce of a request signed by signer at signedAt, and
+// fails if the signer already used it.
+func (n *Nonces) check(signer, nonce string, signedAt time.Time) error {
+	if len(nonce) > maxNonceLength {
+		return errors.New("invalid signature nonce")
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(n.lastSweep) >= time.Minute {
+		for key, expires := range n.seen {
+			if now.After(expires) {
+				delete(n.seen, key)
+			}
+		}
+		n.lastSweep = now
+	}
+
+	key := signer + "\n" + nonce
+	if expires, seen := n.seen[key]; seen && !now.After(expires) {
+		return errors.New("request already seen")
+	}
+	n.seen[key] = signedAt.Add(MaxClockSkew)
+	return nil
+}
+
+// Headers of requests between super-peers, which authenticate each other
+// with a key shared by the group instead of a keypair
+const (
+	HeaderNodeID        = "X-Node-ID"
+	HeaderNodeTimestamp = "X-Node-Timestamp"
+	HeaderNodeNonce     = "X-Node-Nonce"
+	HeaderNodeSignature = "X-Node-Signature"
+)
+
+// SignShared adds the node headers and an HMAC-SHA256 of the request under
+// key to req, on behalf of node. body must be the exact request body.
+func SignShared(req *http.Request, body []byte, node string, key []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	mac := hmac.New(sha256.New, key)
+	mac.Write(sharedMessage(req.Method, req.URL.RequestURI(), node, timestamp, nonce, body))
+
+	req.Header.Set(HeaderNodeID, node)
+	req.Header.Set(HeaderNodeTimestamp, timestamp)
+	req.Header.Set(HeaderNodeNonce, nonce)
+	req.Header.Set(HeaderNodeSignature, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyShared checks that r was signed with key within the allowed clock
+// skew and was not seen before, and returns the node that signed it.
+func VerifyShared(r *http.Request, body []byte, key []byte, seen *Nonces) (string, error) {
+	node := r.Header.Get(HeaderNodeID)
+	timestamp := r.Header.Get(HeaderNodeTimestamp)
+	nonce := r.Header.Get(HeaderNodeNonce)
+	encoded := r.Header.Get(HeaderNodeSignature)
+	if node == "" || timestamp == "" || nonce == "" || encoded == "" {
+		return "", errors.New("request is not signed")
+	}
+
+	signedAt, err := checkTimestamp(timestamp)
+	if err != nil {
+		return "", err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errors.New("invalid signature encoding")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(sharedMessage(r.Method, r.URL.RequestURI(), node, timestamp, nonce, body))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return "", errors.New("invalid signature")
+	}
+	if err := seen.check(node, nonce, signedAt); err != nil {
+		return "", err
+	}
+	return node, nil
+}
+
+// sharedMessage builds the byte string covered by a shared-key signature.
+func sharedMessage(method, requestURI, node, timestamp, nonce string, body []byte) []byte {
+	return append([]byte(node+"\n"), message(method, requestURI, timestamp, nonce, body)...)
+}
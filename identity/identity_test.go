@@ -0,0 +1,146 @@
+package identity
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSharedSignature(t *testing.T) {
+	key := []byte("secret")
+	body := []byte(`{"super_peer":"sp1:8080"}`)
+
+	req := httptest.NewRequest("POST", "/api/v1/federation/gossip", bytes.NewReader(body))
+	SignShared(req, body, "sp1:8080", key)
+
+	if _, err := VerifyShared(req, body, []byte("other"), NewNonces()); err == nil {
+		t.Fatal("accepted a signature under another key")
+	}
+	if _, err := VerifyShared(req, []byte(`{"super_peer":"sp2:8080"}`), key, NewNonces()); err == nil {
+		t.Fatal("accepted a tampered body")
+	}
+
+	seen := NewNonces()
+	node, err := VerifyShared(req, body, key, seen)
+	if err != nil || node != "sp1:8080" {
+		t.Fatalf("VerifyShared = %q, %v", node, err)
+	}
+	if _, err := VerifyShared(req, body, key, seen); err == nil {
+		t.Fatal("accepted a replayed request")
+	}
+
+	req.Header.Set(HeaderNodeID, "sp2:8080")
+	if _, err := VerifyShared(req, body, key, NewNonces()); err == nil {
+		t.Fatal("accepted a signature for another node")
+	}
+}
+
+func TestSignedRequest(t *testing.T) {
+	id, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := Generate()
+	body := []byte(`{"hash":"abc"}`)
+
+	req := httptest.NewRequest("POST", "/api/v1/files/register", bytes.NewReader(body))
+	id.Sign(req, body)
+
+	if err := Verify(req, body, other.PublicKey, NewNonces()); err == nil {
+		t.Fatal("accepted a signature by another key")
+	}
+
+	seen := NewNonces()
+	if err := Verify(req, body, id.PublicKey, seen); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := Verify(req, body, id.PublicKey, seen); err == nil {
+		t.Fatal("accepted a replayed request")
+	}
+
+	// The nonce is covered by the signature
+	replayed := req.Clone(req.Context())
+	replayed.Header.Set(HeaderNonce, "fresh")
+	if err := Verify(replayed, body, id.PublicKey, seen); err == nil {
+		t.Fatal("accepted a replayed request with a new nonce")
+	}
+
+	// A new signature of the same request is accepted
+	again := httptest.NewRequest("POST", "/api/v1/files/register", bytes.NewReader(body))
+	id.Sign(again, body)
+	if err := Verify(again, body, id.PublicKey, seen); err != nil {
+		t.Fatalf("Verify of a second request: %v", err)
+	}
+}
+
+func TestNoncesExpire(t *testing.T) {
+	seen := NewNonces()
+	signedAt := time.Now().Add(-MaxClockSkew - time.Second)
+	if err := seen.check("peer_1", "n", signedAt); err != nil {
+		t.Fatal(err)
+	}
+	// The signature itself is too old by now, so the nonce may be dropped
+	seen.lastSweep = time.Time{}
+	if err := seen.check("peer_1", "other", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, kept := seen.seen["peer_1\nn"]; kept {
+		t.Fatal("expired nonce was kept")
+	}
+
+	// Nonces are per signer
+	if err := seen.check("peer_2", "other", time.Now()); err != nil {
+		t.Fatalf("nonce of another signer rejected: %v", err)
+	}
+	if err := seen.check("peer_2", strings.Repeat("n", maxNonceLength+1), time.Now()); err == nil {
+		t.Fatal("accepted an oversized nonce")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	old, _ := Generate()
+	next, err := old.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID == old.ID || next.Previous == nil || next.Previous.PeerID != old.ID {
+		t.Fatalf("unexpected rotated identity %+v", next)
+	}
+	if err := VerifySuccession(*next.Previous, next.ID); err != nil {
+		t.Fatalf("VerifySuccession: %v", err)
+	}
+
+	// The proof only holds for the identity it was made for
+	other, _ := Generate()
+	if err := VerifySuccession(*next.Previous, other.ID); err == nil {
+		t.Fatal("accepted a succession proof for another peer")
+	}
+	// and only names the peer whose key signed it
+	forged := *next.Previous
+	forged.PeerID = other.ID
+	if err := VerifySuccession(forged, next.ID); err == nil {
+		t.Fatal("accepted a succession proof naming another earlier peer")
+	}
+	forged = *next.Previous
+	forged.PublicKey = EncodePublicKey(other.PublicKey)
+	forged.PeerID = other.ID
+	if err := VerifySuccession(forged, next.ID); err == nil {
+		t.Fatal("accepted a succession proof signed by another key")
+	}
+
+	// The proof is kept with the saved identity
+	path := filepath.Join(t.TempDir(), "identity.json")
+	if err := next.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID != next.ID || loaded.Previous == nil || *loaded.Previous != *next.Previous {
+		t.Fatalf("loaded %+v, want %+v", loaded, next)
+	}
+}
@@ -1,38 +1,69 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
+
+	"sp/config"
+	"sp/dht"
+	"sp/fileid"
+	"sp/identity"
+	"sp/merkle"
+	"sp/pagination"
+	"sp/raft"
+	"sp/reputation"
+	"sp/search"
+	"sp/storage"
 )
 
 // Data structures
 type Peer struct {
-	ID          string    `json:"id"`
-	Address     string    `json:"address"`
-	Port        int       `json:"port"`
-	LastSeen    time.Time `json:"last_seen"`
-	IsOnline    bool      `json:"is_online"`
-	Reputation  int       `json:"reputation"`
-	SharedFiles int       `json:"shared_files"`
-	Region      string    `json:"region"`
+	ID          string        `json:"id"`
+	Address     string        `json:"address"`
+	Port        int           `json:"port"`
+	LastSeen    time.Time     `json:"last_seen"`
+	IsOnline    bool          `json:"is_online"`
+	Reputation  int           `json:"reputation"`
+	SharedFiles int           `json:"shared_files"`
+	Region      string        `json:"region"`
+	PublicKey   string        `json:"public_key"`
+	Transfers   TransferStats `json:"transfers"`
+}
+
+// TransferStats count the downloads from a peer that other peers reported
+type TransferStats struct {
+	UploadsCompleted int     `json:"uploads_completed"`
+	UploadsFailed    int     `json:"uploads_failed"`
+	BytesServed      int64   `json:"bytes_served"`
+	SuccessRate      float64 `json:"success_rate"` // percentage of completed uploads
 }
 
 type FileInfo struct {
 	ID          string    `json:"id"`
 	Filename    string    `json:"filename"`
+	Path        string    `json:"path,omitempty"` // relative to the owner's shared directory
 	Size        int64     `json:"size"`
 	Hash        string    `json:"hash"`
 	Category    string    `json:"category"`
@@ -42,14 +73,72 @@ type FileInfo struct {
 	UploadTime  time.Time `json:"upload_time"`
 	Downloads   int       `json:"downloads"`
 	Rating      float64   `json:"rating"`
+	RatingCount int       `json:"rating_count"`
+	Reviews     []Review  `json:"reviews,omitempty"` // most recent first
+	MerkleRoot  string    `json:"merkle_root"`
+	PieceSize   int64     `json:"piece_size"`
+	PieceHashes []string  `json:"piece_hashes,omitempty"`
+	Available   bool      `json:"available"`
+	SuperPeer   string    `json:"super_peer,omitempty"` // federated super-peer the file is registered with
+}
+
+// FileAlias maps a file ID given out before IDs were derived from content
+// hash and owner to the file's current ID, until it expires
+type FileAlias struct {
+	ID      string    `json:"id"`
+	FileID  string    `json:"file_id"`
+	Expires time.Time `json:"expires"`
+}
+
+// Review is a peer's rating of some content, one per peer and content hash
+type Review struct {
+	Hash      string    `json:"hash"`
+	PeerID    string    `json:"peer_id"`
+	Rating    int       `json:"rating"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DownloadReport is a downloading peer's account of a finished download
+type DownloadReport struct {
+	Hash       string         `json:"hash"`
+	FileID     string         `json:"file_id,omitempty"`
+	Status     string         `json:"status"` // completed or failed
+	Bytes      int64          `json:"bytes"`
+	DurationMs int64          `json:"duration_ms"`
+	Verified   bool           `json:"verified"` // the file matched its content hash
+	Sources    []SourceReport `json:"sources"`
+	Downloader string         `json:"downloader"`
+	ReportedAt time.Time      `json:"reported_at"`
+}
+
+// SourceReport is what one source contributed to a download
+type SourceReport struct {
+	PeerID     string `json:"peer_id"`
+	Bytes      int64  `json:"bytes"`
+	Pieces     int    `json:"pieces"`
+	Failures   int    `json:"failures"`   // failed piece requests
+	Mismatches int    `json:"mismatches"` // pieces that failed verification
 }
 
 type SearchQuery struct {
-	Query    string   `json:"query"`
-	Category string   `json:"category"`
-	Tags     []string `json:"tags"`
-	SortBy   string   `json:"sort_by"`
-	Limit    int      `json:"limit"`
+	Query          string   `json:"query"`
+	Category       string   `json:"category"`
+	Tags           []string `json:"tags"`
+	SortBy         string   `json:"sort_by"`
+	Limit          int      `json:"limit"`
+	IncludeOffline bool     `json:"include_offline"`
+	Fuzzy          bool     `json:"fuzzy"`
+	PageSize       int      `json:"page_size"`
+	Cursor         string   `json:"cursor"`
+}
+
+// SearchResult is a file matching a search, with its relevance score and the
+// spans of its filename that matched
+type SearchResult struct {
+	*FileInfo
+	Score      float64       `json:"score"`
+	Highlights []search.Span `json:"highlights,omitempty"`
 }
 
 type NetworkStats struct {
@@ -61,8 +150,41 @@ type NetworkStats struct {
 	LastUpdated    time.Time `json:"last_updated"`
 }
 
+// FederationSummary is what a super-peer gossips to the others about the
+// peers and files registered with it
+type FederationSummary struct {
+	SuperPeer  string     `json:"super_peer"` // address of the sender
+	Peers      []Peer     `json:"peers"`      // online peers
+	Files      []FileInfo `json:"files"`      // available files, without piece hashes
+	SentAt     time.Time  `json:"sent_at"`
+	ReceivedAt time.Time  `json:"received_at"`
+}
+
+// SuperPeerConfig is the "super_peer:" section of the config file
+type SuperPeerConfig struct {
+	Port              int             `yaml:"port" json:"port"`
+	Address           string          `yaml:"address" json:"address"`
+	DataDirectory     string          `yaml:"data_directory" json:"data_directory"`
+	Storage           string          `yaml:"storage" json:"storage"`
+	MaxPeers          int             `yaml:"max_peers" json:"max_peers"`
+	HeartbeatInterval config.Duration `yaml:"heartbeat_interval" json:"heartbeat_interval"`
+	CleanupInterval   config.Duration `yaml:"cleanup_interval" json:"cleanup_interval"`
+	SnapshotInterval  config.Duration `yaml:"snapshot_interval" json:"snapshot_interval"`
+	ShutdownTimeout   config.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	ReputationDecay   config.Duration `yaml:"reputation_half_life" json:"reputation_half_life"`
+	Federation        config.List     `yaml:"federation" json:"federation"`
+	FederationKey     string          `yaml:"federation_key" json:"-"`
+	GossipInterval    config.Duration `yaml:"gossip_interval" json:"gossip_interval"`
+	Cluster           config.List     `yaml:"cluster" json:"cluster"`
+	ClusterKey        string          `yaml:"cluster_key" json:"-"`
+	DHT               bool            `yaml:"dht" json:"dht"`
+	IDMigration       config.Duration `yaml:"id_migration_window" json:"id_migration_window"`
+	ConfigFile        string          `yaml:"-" json:"config_file,omitempty"`
+}
+
 // Global state
 type SuperPeer struct {
+	config        SuperPeerConfig
 	peers         map[string]*Peer
 	files         map[string]*FileInfo
 	peersMutex    sync.RWMutex
@@ -70,13 +192,82 @@ type SuperPeer struct {
 	wsConnections map[*websocket.Conn]bool
 	wsMutex       sync.RWMutex
 	stats         NetworkStats
+	statsHistory  []NetworkStats
+	statsMutex    sync.RWMutex
+	store         storage.Store
+	services      sync.WaitGroup
+	index         *search.Index // full-text index of files, by file ID
+
+	ratings      map[string]map[string]*Review // content hash -> peer ID -> review
+	ratingsMutex sync.RWMutex
+	reputation   *reputation.Engine
+	completions  map[string]bool // hash + "/" + downloader of counted downloads
+
+	federation      map[string]*FederationSummary // super-peer address -> latest summary
+	unreachable     map[string]bool               // federated super-peers the last gossip failed for
+	federationMutex sync.RWMutex
+
+	raft *raft.Node // nil unless clustered
+	dht  *dht.Node  // nil unless serving as a DHT bootstrap node
+
+	aliases      map[string]*FileAlias      // old file ID -> alias, guarded by filesMutex
+	replicas     map[string]map[string]bool // content hash -> file IDs
+	peerLoad     map[string][]time.Time     // recent redirects per peer
+	peerFailures map[string][]time.Time     // recent failed probes per peer
+	peerReports  map[string]time.Time       // reporter/peer/hash -> last report
+	routingMutex sync.Mutex
+
+	seenPersisted map[string]time.Time // when each peer's LastSeen was last stored, guarded by peersMutex
+	uptimeStored  map[string]time.Time // when each peer's uptime stats were last stored, guarded by peersMutex
+
+	nonces *identity.Nonces // of the signed requests accepted, so none is accepted twice
 }
 
+// Storage buckets
+const (
+	peersBucket      = "peers"
+	filesBucket      = "files"
+	statsBucket      = "stats"
+	ratingsBucket    = "ratings"
+	reputationBucket = "reputation"
+	downloadsBucket  = "downloads"
+	aliasesBucket    = "aliases"
+)
+
+// Every bucket, in the order the state is reloaded
+var storeBuckets = []string{peersBucket, filesBucket, aliasesBucket, ratingsBucket, downloadsBucket, reputationBucket, statsBucket}
+
+// Number of NetworkStats samples kept in the history (1 hour at 10s interval)
+const maxStatsHistory = 360
+
+// Replica selection settings
+const (
+	loadWindow     = time.Minute
+	failureWindow  = 10 * time.Minute
+	probeTimeout   = 2 * time.Second
+	regionBonus    = 20.0
+	loadPenalty    = 5.0
+	failurePenalty = 25.0
+)
+
 var (
 	superPeer = &SuperPeer{
 		peers:         make(map[string]*Peer),
 		files:         make(map[string]*FileInfo),
 		wsConnections: make(map[*websocket.Conn]bool),
+		index:         search.NewIndex(),
+		ratings:       make(map[string]map[string]*Review),
+		completions:   make(map[string]bool),
+		federation:    make(map[string]*FederationSummary),
+		unreachable:   make(map[string]bool),
+		aliases:       make(map[string]*FileAlias),
+		replicas:      make(map[string]map[string]bool),
+		peerLoad:      make(map[string][]time.Time),
+		peerFailures:  make(map[string][]time.Time),
+		peerReports:   make(map[string]time.Time),
+		seenPersisted: make(map[string]time.Time),
+		uptimeStored:  make(map[string]time.Time),
+		nonces:        identity.NewNonces(),
 	}
 	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -89,28 +280,130 @@ func main() {
 	// Initialize logging
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
+	// Load configuration from the config file, environment and flags
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.ConfigFile != "" {
+		log.Printf("⚙️ Loaded configuration from %s", cfg.ConfigFile)
+	}
+	superPeer.config = cfg
+	superPeer.reputation = reputation.NewEngine(time.Duration(cfg.ReputationDecay))
+
 	// Create directories
 	os.MkdirAll("web/static", 0755)
 	os.MkdirAll("shared_files", 0755)
 	os.MkdirAll("logs", 0755)
 
+	// Open the index store and reload the previous state
+	store, err := openStore(cfg)
+	if err != nil {
+		log.Fatalf("❌ Failed to open index store: %v", err)
+	}
+	superPeer.store = store
+	if err := superPeer.loadState(); err != nil {
+		log.Fatalf("❌ Failed to load index: %v", err)
+	}
+
+	// Join the cluster sharing this index. A clustered super-peer only
+	// writes through the leader, which migrates and checks peers itself.
+	if len(cfg.Cluster) > 0 {
+		node, err := raft.NewNode(raft.Config{
+			ID:        cfg.Address,
+			Peers:     cfg.Cluster,
+			Key:       []byte(cfg.ClusterKey),
+			StatePath: filepath.Join(cfg.DataDirectory, "raft.json"),
+			LogPath:   filepath.Join(cfg.DataDirectory, "raft.log"),
+			Apply:     superPeer.applyMutation,
+			Snapshot:  superPeer.snapshotState,
+			Restore:   superPeer.restoreState,
+			Discard:   superPeer.reloadState,
+		})
+		if err != nil {
+			log.Fatalf("❌ Failed to join cluster: %v", err)
+		}
+		superPeer.raft = node
+		log.Printf("🗳️ Clustered with %s", strings.Join(cfg.Cluster, ", "))
+	} else {
+		superPeer.migrateFileIDs()
+		superPeer.checkPeerHealth()
+	}
+
+	// Serve as a bootstrap node of the DHT, joined through the other
+	// super-peers
+	if cfg.DHT {
+		superPeer.dht = dht.NewNode(dht.Config{
+			ID:        dht.NewID(cfg.Address),
+			Address:   cfg.Address,
+			Bootstrap: append(append([]string{}, cfg.Cluster...), cfg.Federation...),
+		})
+		log.Printf("🧭 Serving as a DHT bootstrap node")
+	}
+
+	// Stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Start background services
-	go superPeer.healthCheckService()
-	go superPeer.statisticsService()
+	superPeer.services.Add(3)
+	go superPeer.healthCheckService(ctx)
+	go superPeer.statisticsService(ctx)
+	go superPeer.snapshotService(ctx)
+	if len(cfg.Federation) > 0 {
+		if cfg.FederationKey == "" {
+			log.Println("⚠️ No federation key set, gossip is only checked against the sender's address")
+		}
+		superPeer.services.Add(1)
+		go superPeer.gossipService(ctx)
+	}
+	if superPeer.raft != nil {
+		superPeer.services.Add(1)
+		go superPeer.clusterService(ctx)
+	}
+	if superPeer.dht != nil {
+		superPeer.services.Add(1)
+		go superPeer.dhtService(ctx)
+	}
 
 	// Setup routes
 	router := mux.NewRouter()
 
 	// API routes
 	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Use(superPeer.leaderWrites)
 	api.HandleFunc("/peers/register", superPeer.registerPeerHandler).Methods("POST")
 	api.HandleFunc("/peers/heartbeat", superPeer.heartbeatHandler).Methods("POST")
+	api.HandleFunc("/peers/deregister", superPeer.deregisterPeerHandler).Methods("POST")
+	api.HandleFunc("/peers/reports", superPeer.reportPeerHandler).Methods("POST")
 	api.HandleFunc("/peers", superPeer.getPeersHandler).Methods("GET")
 	api.HandleFunc("/files/register", superPeer.registerFileHandler).Methods("POST")
-	api.HandleFunc("/files/search", superPeer.searchFilesHandler).Methods("GET")
+	api.HandleFunc("/files/unregister", superPeer.unregisterFileHandler).Methods("POST")
+	api.HandleFunc("/files/search", superPeer.searchFilesHandler).Methods("GET", "POST")
+	api.HandleFunc("/files/sources/{hash}", superPeer.getFileSourcesHandler).Methods("GET")
+	api.HandleFunc("/files/ratings/{hash}", superPeer.rateFileHandler).Methods("POST")
+	api.HandleFunc("/files/ratings/{hash}", superPeer.getFileRatingsHandler).Methods("GET")
 	api.HandleFunc("/files", superPeer.getFilesHandler).Methods("GET")
 	api.HandleFunc("/stats", superPeer.getStatsHandler).Methods("GET")
+	api.HandleFunc("/stats/history", superPeer.getStatsHistoryHandler).Methods("GET")
 	api.HandleFunc("/download/{fileId}", superPeer.downloadHandler).Methods("GET")
+	api.HandleFunc("/downloads/report", superPeer.reportDownloadHandler).Methods("POST")
+	api.HandleFunc("/config", superPeer.getConfigHandler).Methods("GET")
+	api.HandleFunc("/federation", superPeer.getFederationHandler).Methods("GET")
+	api.HandleFunc("/federation/gossip", superPeer.gossipHandler).Methods("POST")
+	api.HandleFunc("/cluster", superPeer.getClusterHandler).Methods("GET")
+	if superPeer.raft != nil {
+		api.HandleFunc("/raft/vote", superPeer.raft.HandleVote).Methods("POST")
+		api.HandleFunc("/raft/append", superPeer.raft.HandleAppend).Methods("POST")
+		api.HandleFunc("/raft/snapshot", superPeer.raft.HandleSnapshot).Methods("POST")
+	}
+	api.HandleFunc("/dht", superPeer.getDHTHandler).Methods("GET")
+	if superPeer.dht != nil {
+		api.HandleFunc("/dht/ping", superPeer.dht.HandlePing).Methods("POST")
+		api.HandleFunc("/dht/find_node", superPeer.dht.HandleFindNode).Methods("POST")
+		api.HandleFunc("/dht/find_value", superPeer.dht.HandleFindValue).Methods("POST")
+		api.HandleFunc("/dht/store", superPeer.dht.HandleStore).Methods("POST")
+	}
 
 	// WebSocket endpoint
 	router.HandleFunc("/ws", superPeer.websocketHandler)
@@ -128,34 +421,119 @@ func main() {
 
 	handler := c.Handler(router)
 
-	fmt.Println("🚀 Professional P2P Super-Peer Server starting on :8080")
-	fmt.Println("📊 Dashboard: http://localhost:8080")
-	fmt.Println("🔌 WebSocket: ws://localhost:8080/ws")
-	fmt.Println("📡 API Base: http://localhost:8080/api/v1")
+	fmt.Printf("🚀 Professional P2P Super-Peer Server starting on :%d\n", cfg.Port)
+	fmt.Printf("📊 Dashboard: http://localhost:%d\n", cfg.Port)
+	fmt.Printf("🔌 WebSocket: ws://localhost:%d/ws\n", cfg.Port)
+	fmt.Printf("📡 API Base: http://localhost:%d/api/v1\n", cfg.Port)
 
+	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port), Handler: handler}
 	go func() {
-		log.Fatal(http.ListenAndServe(":8080", handler))
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
-	// Block main goroutine to keep servers running
-	select {}
+	<-ctx.Done()
+	superPeer.shutdown(server)
 }
 
-// Peer registration handler
+// Drain in-flight requests, disconnect WebSocket clients, wait for the
+// background services to stop and flush the index store
+func (sp *SuperPeer) shutdown(server *http.Server) {
+	log.Println("🛑 Shutting down super-peer...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(sp.config.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ Requests still in flight at shutdown: %v", err)
+	}
+
+	sp.closeWebSockets()
+	sp.services.Wait()
+
+	if err := sp.store.Snapshot(); err != nil {
+		log.Printf("❌ Failed to snapshot index: %v", err)
+	}
+	if err := sp.store.Close(); err != nil {
+		log.Printf("❌ Failed to close index store: %v", err)
+	}
+	log.Println("👋 Super-peer stopped")
+}
+
+// Peer registration handler. The peer ID must be derived from the submitted
+// public key and the request signed with the matching private key.
 func (sp *SuperPeer) registerPeerHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid peer data", http.StatusBadRequest)
+		return
+	}
+
 	var peer Peer
-	if err := json.NewDecoder(r.Body).Decode(&peer); err != nil {
+	if err := json.Unmarshal(body, &peer); err != nil {
 		http.Error(w, "Invalid peer data", http.StatusBadRequest)
 		return
 	}
 
+	publicKey, err := identity.DecodePublicKey(peer.PublicKey)
+	if err != nil {
+		http.Error(w, "Valid public key required", http.StatusBadRequest)
+		return
+	}
+	if peer.ID != identity.PeerID(publicKey) || r.Header.Get(identity.HeaderPeerID) != peer.ID {
+		http.Error(w, "Peer ID does not match public key", http.StatusForbidden)
+		return
+	}
+	if err := identity.Verify(r, body, publicKey, sp.nonces); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// A peer that replaced its key proves it with a signature by the old one
+	var succession struct {
+		Previous *identity.Succession `json:"previous"`
+	}
+	json.Unmarshal(body, &succession)
+	if succession.Previous != nil {
+		if err := identity.VerifySuccession(*succession.Previous, peer.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
 	peer.LastSeen = time.Now()
 	peer.IsOnline = true
-	peer.ID = generatePeerID(peer.Address, peer.Port)
+	peer.Reputation = sp.reputation.Score(peer.ID, 0, 0, peer.LastSeen)
 
 	sp.peersMutex.Lock()
-	sp.peers[peer.ID] = &peer
+	existing, known := sp.peers[peer.ID]
+	if !known && sp.config.MaxPeers > 0 && len(sp.peers) >= sp.config.MaxPeers {
+		sp.peersMutex.Unlock()
+		http.Error(w, "Peer limit reached", http.StatusServiceUnavailable)
+		return
+	}
+	// Transfer stats are reported by other peers, not by the peer itself
+	peer.Transfers = TransferStats{}
+	if known {
+		peer.Transfers = existing.Transfers
+	}
+	// The handler keeps its own copy; the stored record may change as soon
+	// as the lock is released
+	stored := peer
+	sp.peers[peer.ID] = &stored
+	var b batch
+	b.put(peersBucket, peer.ID, &stored)
 	sp.peersMutex.Unlock()
+	if err := sp.save(b); err != nil {
+		writeFailed(w)
+		return
+	}
+
+	if succession.Previous != nil {
+		sp.mergePreviousRecords(peer.ID, succession.Previous.PeerID)
+	}
+	sp.setFilesAvailable(peer.ID, true)
+	sp.updateReputations(peer.ID)
 
 	sp.broadcastUpdate("peer_registered", peer)
 
@@ -171,56 +549,177 @@ func (sp *SuperPeer) registerPeerHandler(w http.ResponseWriter, r *http.Request)
 
 // Heartbeat handler to keep peers alive
 func (sp *SuperPeer) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
-	peerID := r.Header.Get("X-Peer-ID")
-	if peerID == "" {
-		http.Error(w, "Peer ID required", http.StatusBadRequest)
+	peerID, status, err := sp.authenticatePeer(r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), status)
 		return
 	}
 
+	// LastSeen only needs to survive a restart well enough for the health
+	// check, so heartbeats write it at most every half cleanup interval
+	now := time.Now()
+	var b batch
 	sp.peersMutex.Lock()
+	wasOffline := false
 	if peer, exists := sp.peers[peerID]; exists {
-		peer.LastSeen = time.Now()
+		wasOffline = !peer.IsOnline
+		peer.LastSeen = now
 		peer.IsOnline = true
+		if wasOffline || now.Sub(sp.seenPersisted[peerID]) >= time.Duration(sp.config.CleanupInterval)/2 {
+			sp.seenPersisted[peerID] = now
+			b.put(peersBucket, peerID, peer)
+		}
 	}
 	sp.peersMutex.Unlock()
+	sp.save(b)
+
+	if wasOffline {
+		sp.setFilesAvailable(peerID, true)
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// Deregistration handler for peers shutting down. The peer is marked offline
+// right away instead of after the heartbeat cutoff, and its files become
+// unavailable.
+func (sp *SuperPeer) deregisterPeerHandler(w http.ResponseWriter, r *http.Request) {
+	peerID, status, err := sp.authenticatePeer(r, nil)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	// The peer may have been removed since it was authenticated
+	sp.peersMutex.Lock()
+	peer, exists := sp.peers[peerID]
+	if !exists {
+		sp.peersMutex.Unlock()
+		http.Error(w, "Peer not registered", http.StatusNotFound)
+		return
+	}
+	peer.IsOnline = false
+	var b batch
+	b.put(peersBucket, peerID, peer)
+	deregistered := *peer
+	sp.peersMutex.Unlock()
+	if err := sp.save(b); err != nil {
+		writeFailed(w)
+		return
+	}
+
+	unavailable := sp.setFilesAvailable(peerID, false)
+	sp.updateStats()
+	sp.broadcastUpdate("peer_deregistered", deregistered)
+
+	log.Printf("👋 Peer deregistered: %s (%d files unavailable)", peerID, unavailable)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Peer deregistered successfully",
+	})
+}
+
+// Mark every file owned by a peer as available or not. Returns the number of
+// files that changed.
+func (sp *SuperPeer) setFilesAvailable(peerID string, available bool) int {
+	var b batch
+	sp.filesMutex.Lock()
+	for id, file := range sp.files {
+		if file.Owner == peerID && file.Available != available {
+			file.Available = available
+			b.put(filesBucket, id, file)
+		}
+	}
+	sp.filesMutex.Unlock()
+
+	sp.save(b)
+	return len(b)
+}
+
 // File registration handler
 func (sp *SuperPeer) registerFileHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid file data", http.StatusBadRequest)
+		return
+	}
+
+	peerID, status, err := sp.authenticatePeer(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
 	var fileInfo FileInfo
-	if err := json.NewDecoder(r.Body).Decode(&fileInfo); err != nil {
+	if err := json.Unmarshal(body, &fileInfo); err != nil {
 		http.Error(w, "Invalid file data", http.StatusBadRequest)
 		return
 	}
 
-	fileInfo.ID = generateFileID(fileInfo.Filename, fileInfo.Owner)
-	fileInfo.UploadTime = time.Now()
+	// Peers may only register files they own
+	if fileInfo.Owner == "" {
+		fileInfo.Owner = peerID
+	}
+	if fileInfo.Owner != peerID {
+		http.Error(w, "File owner does not match signing peer", http.StatusForbidden)
+		return
+	}
 
-	sp.filesMutex.Lock()
-	found := false
-	for _, existingFile := range sp.files {
-		if existingFile.Hash == fileInfo.Hash && existingFile.Owner == fileInfo.Owner {
-			// Update existing file info
-			existingFile.PeerAddress = fileInfo.PeerAddress
-			existingFile.UploadTime = time.Now()
-			existingFile.Filename = fileInfo.Filename // Update filename in case it changed
-			existingFile.Size = fileInfo.Size         // Update size in case it changed
-			existingFile.Category = fileInfo.Category // Update category
-			existingFile.Tags = fileInfo.Tags         // Update tags
-			fileInfo = *existingFile                  // Use the updated existing fileInfo for broadcast
-			found = true
-			log.Printf("🔄 File updated: %s by %s", fileInfo.Filename, fileInfo.Owner)
-			break
-		}
+	if err := validatePieceHashes(&fileInfo); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid piece hashes: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if fileInfo.Path != "" && !validFilePath(fileInfo.Path) {
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
 	}
+	if fileInfo.Path == "" {
+		fileInfo.Path = fileInfo.Filename // Legacy peers share a flat directory
+	}
+
+	fileInfo.ID = fileid.Derive(fileInfo.Hash, fileInfo.Owner, fileInfo.Path)
+	fileInfo.UploadTime = time.Now()
+	fileInfo.Available = true
+
+	// Ratings are kept by the super-peer, not taken from the peer
+	fileInfo.Rating, fileInfo.RatingCount, fileInfo.Reviews = sp.ratingSummary(fileInfo.Hash)
 
-	if !found {
-		sp.files[fileInfo.ID] = &fileInfo
+	// Each path the owner shares the content under has its own record
+	sp.filesMutex.Lock()
+	var b batch
+	existingFile, found := sp.files[fileInfo.ID]
+	if found {
+		// Update existing file info
+		existingFile.PeerAddress = fileInfo.PeerAddress
+		existingFile.UploadTime = time.Now()
+		existingFile.Filename = fileInfo.Filename // Update filename in case it changed
+		existingFile.Size = fileInfo.Size         // Update size in case it changed
+		existingFile.Category = fileInfo.Category // Update category
+		existingFile.Tags = fileInfo.Tags         // Update tags
+		existingFile.MerkleRoot = fileInfo.MerkleRoot
+		existingFile.PieceSize = fileInfo.PieceSize
+		existingFile.PieceHashes = fileInfo.PieceHashes
+		existingFile.Available = true
+		b.put(filesBucket, existingFile.ID, existingFile)
+		sp.indexFile(existingFile)
+		fileInfo = *existingFile // Use the updated existing fileInfo for broadcast
+		log.Printf("🔄 File updated: %s by %s", fileInfo.Filename, fileInfo.Owner)
+	} else {
+		stored := fileInfo
+		sp.files[stored.ID] = &stored
+		sp.addReplica(&stored)
+		sp.indexFile(&stored)
+		b.put(filesBucket, stored.ID, &stored)
 		log.Printf("📁 File registered: %s by %s", fileInfo.Filename, fileInfo.Owner)
 	}
 	sp.filesMutex.Unlock()
+	if err := sp.save(b); err != nil {
+		writeFailed(w)
+		return
+	}
 
 	sp.broadcastUpdate("file_registered", fileInfo)
 
@@ -232,272 +731,2525 @@ func (sp *SuperPeer) registerFileHandler(w http.ResponseWriter, r *http.Request)
 	})
 }
 
-// Advanced search handler
-func (sp *SuperPeer) searchFilesHandler(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	category := r.URL.Query().Get("category")
-	sortBy := r.URL.Query().Get("sort")
-	limitStr := r.URL.Query().Get("limit")
+// File unregistration handler. Peers call it when they stop sharing some
+// content, at one path or, without "path", at all of them; with
+// "unavailable" set the records are kept but hidden instead.
+func (sp *SuperPeer) unregisterFileHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid file data", http.StatusBadRequest)
+		return
+	}
 
-	limit := 50
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil {
-			limit = l
-		}
+	peerID, status, err := sp.authenticatePeer(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
 	}
 
-	sp.filesMutex.RLock()
-	var results []*FileInfo
+	var req struct {
+		Hash        string `json:"hash"`
+		Path        string `json:"path"`
+		Unavailable bool   `json:"unavailable"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Hash == "" {
+		http.Error(w, "Hash required", http.StatusBadRequest)
+		return
+	}
 
-	for _, file := range sp.files {
-		if matchesSearch(file, query, category) {
-			results = append(results, file)
+	// Peers may only unregister their own copies. The records are only
+	// changed in memory once the change is saved.
+	var affected []FileInfo
+	var b batch
+	sp.filesMutex.RLock()
+	for id, file := range sp.files {
+		if file.Hash != req.Hash || file.Owner != peerID || (req.Path != "" && file.Path != req.Path) {
+			continue
+		}
+		record := *file
+		if req.Unavailable {
+			record.Available = false
+			b.put(filesBucket, id, &record)
+		} else {
+			b.delete(filesBucket, id)
 		}
+		affected = append(affected, record)
 	}
 	sp.filesMutex.RUnlock()
 
-	// Sort results
-	sortResults(results, sortBy)
+	if len(affected) == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err := sp.save(b); err != nil {
+		writeFailed(w)
+		return
+	}
+
+	sp.filesMutex.Lock()
+	for _, record := range affected {
+		file, exists := sp.files[record.ID]
+		switch {
+		case !exists:
+		case req.Unavailable:
+			file.Available = false
+		default:
+			delete(sp.files, record.ID)
+			sp.removeReplica(file)
+			sp.index.Remove(record.ID)
+		}
+	}
+	sp.filesMutex.Unlock()
 
-	// Apply limit
-	if len(results) > limit {
-		results = results[:limit]
+	eventType := "file_unregistered"
+	if req.Unavailable {
+		eventType = "file_unavailable"
+	}
+	for _, file := range affected {
+		sp.broadcastUpdate(eventType, file)
+		log.Printf("🗑️ File %s: %s by %s", strings.TrimPrefix(eventType, "file_"), file.Filename, file.Owner)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"results": results,
-		"count":   len(results),
-		"query":   query,
+		"status":  "success",
+		"count":   len(affected),
+		"message": "File unregistered successfully",
 	})
 }
 
-// WebSocket handler for real-time updates
-func (sp *SuperPeer) websocketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Download reports
+
+// Report handler. The downloading peer reports a finished download: whether
+// it completed and matched its content hash, how long it took, and what each
+// source contributed. Completed, verified downloads count towards the file's
+// downloads, once per downloader; every report updates the transfer stats
+// and reputation of the sources.
+func (sp *SuperPeer) reportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		http.Error(w, "Invalid report", http.StatusBadRequest)
 		return
 	}
-	defer conn.Close()
 
-	sp.wsMutex.Lock()
-	sp.wsConnections[conn] = true
-	sp.wsMutex.Unlock()
+	downloaderID, status, err := sp.authenticatePeer(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
 
-	defer func() {
-		sp.wsMutex.Lock()
-		delete(sp.wsConnections, conn)
-		sp.wsMutex.Unlock()
-	}()
+	var report DownloadReport
+	if err := json.Unmarshal(body, &report); err != nil || report.Hash == "" {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	if report.Status != "completed" && report.Status != "failed" {
+		http.Error(w, "Status must be completed or failed", http.StatusBadRequest)
+		return
+	}
+	if report.Bytes < 0 || report.DurationMs < 0 {
+		http.Error(w, "Bytes and duration must not be negative", http.StatusBadRequest)
+		return
+	}
+	report.Downloader = downloaderID
+	report.ReportedAt = time.Now()
 
-	// Send initial data
-	sp.sendNetworkStats(conn)
+	// Sources are credited only for content they hold, and no more than it
+	// could have given: mismatches are capped at the number of pieces
+	sp.filesMutex.RLock()
+	holders := make(map[string]bool)
+	var size, pieces int64
+	for fileID := range sp.replicas[report.Hash] {
+		if file, exists := sp.files[fileID]; exists {
+			holders[file.Owner] = true
+			size = max(size, file.Size)
+			pieces = max(pieces, int64(len(file.PieceHashes)))
+		}
+	}
+	sp.filesMutex.RUnlock()
+	pieces = max(pieces, 1)
+
+	// A peer listed more than once is merged into one source, and sources
+	// registered with federated super-peers are scored there, not here
+	merged := make(map[string]*SourceReport)
+	var order []string
+	for _, source := range report.Sources {
+		if source.PeerID == downloaderID {
+			http.Error(w, "Peers cannot report themselves", http.StatusBadRequest)
+			return
+		}
+		if source.Bytes < 0 || source.Pieces < 0 || source.Failures < 0 || source.Mismatches < 0 {
+			http.Error(w, "Source counts must not be negative", http.StatusBadRequest)
+			return
+		}
+		if !holders[source.PeerID] {
+			continue
+		}
+		m, seen := merged[source.PeerID]
+		if !seen {
+			m = &SourceReport{PeerID: source.PeerID}
+			merged[source.PeerID] = m
+			order = append(order, source.PeerID)
+		}
+		m.Bytes = min(m.Bytes+source.Bytes, size)
+		m.Pieces = int(min(int64(m.Pieces)+int64(source.Pieces), pieces))
+		m.Failures = int(min(int64(m.Failures)+int64(source.Failures), pieces))
+		m.Mismatches = int(min(int64(m.Mismatches)+int64(source.Mismatches), pieces))
+	}
 
-	// Keep connection alive
-	for {
-		_, _, err := conn.ReadMessage()
-		if err != nil {
-			break
+	sp.peersMutex.RLock()
+	var sources []SourceReport
+	for _, id := range order {
+		if _, known := sp.peers[id]; known {
+			sources = append(sources, *merged[id])
 		}
 	}
-}
+	sp.peersMutex.RUnlock()
+	report.Sources = sources
 
-// Broadcast updates to all WebSocket connections
-func (sp *SuperPeer) broadcastUpdate(eventType string, data interface{}) {
-	message := map[string]interface{}{
-		"type":      eventType,
-		"data":      data,
-		"timestamp": time.Now(),
+	completed := report.Status == "completed" && report.Verified
+	counted := false
+	if completed {
+		counted = sp.countDownload(&report)
+	}
+	sp.recordSources(&report, completed)
+	if counted {
+		sp.updateStats()
 	}
 
-	sp.wsMutex.Lock() // Acquire write lock
-	for conn := range sp.wsConnections {
-		if err := conn.WriteJSON(message); err != nil {
-			log.Printf("Error broadcasting to WebSocket: %v", err)
-			// Optionally, remove broken connection
-			// delete(sp.wsConnections, conn)
-		}
+	sp.broadcastUpdate("download_reported", report)
+
+	if completed {
+		log.Printf("📥 %s downloaded %s (%d bytes in %dms from %d peers)",
+			downloaderID, report.Hash, report.Bytes, report.DurationMs, len(report.Sources))
+	} else {
+		log.Printf("⚠️ %s failed to download %s", downloaderID, report.Hash)
 	}
-	sp.wsMutex.Unlock() // Release write lock
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"counted": counted,
+		"message": "Download report recorded successfully",
+	})
 }
 
-// Health check service
-func (sp *SuperPeer) healthCheckService() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+// Count a completed download towards the file it came from: the reported
+// file ID, or else the replica of the source that sent the most data.
+// Returns false if the downloader already had this content counted.
+func (sp *SuperPeer) countDownload(report *DownloadReport) bool {
+	key := report.Hash + "/" + report.Downloader
 
-	for range ticker.C {
-		cutoff := time.Now().Add(-5 * time.Minute)
+	var b batch
+	defer func() { sp.save(b) }()
+	sp.filesMutex.Lock()
+	defer sp.filesMutex.Unlock()
 
-		sp.peersMutex.Lock()
-		for id, peer := range sp.peers {
-			if peer.LastSeen.Before(cutoff) {
-				peer.IsOnline = false
-				log.Printf("⚠️ Peer %s marked offline", id)
+	if sp.completions[key] {
+		return false
+	}
+
+	file, exists := sp.files[report.FileID]
+	if !exists || file.Hash != report.Hash {
+		file = nil
+		var best int64 = -1
+		for fileID := range sp.replicas[report.Hash] {
+			replica := sp.files[fileID]
+			for _, source := range report.Sources {
+				if source.PeerID == replica.Owner && source.Bytes > best {
+					file, best = replica, source.Bytes
+				}
+			}
+			if file == nil {
+				file = replica
 			}
 		}
-		sp.peersMutex.Unlock()
-
-		sp.updateStats()
 	}
+	if file == nil {
+		return false
+	}
+
+	file.Downloads++
+	b.put(filesBucket, file.ID, file)
+	sp.completions[key] = true
+	b.put(downloadsBucket, key, report)
+	return true
 }
 
-// Statistics service
-func (sp *SuperPeer) statisticsService() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+// Update the transfer stats and reputation of the sources of a download
+func (sp *SuperPeer) recordSources(report *DownloadReport, completed bool) {
+	now := time.Now()
+	var reported []string
+	var b batch
 
-	for range ticker.C {
-		sp.updateStats()
-		sp.broadcastUpdate("stats_update", sp.stats)
-	}
-}
+	sp.peersMutex.Lock()
+	for _, source := range report.Sources {
+		// The peer may have been removed since the sources were checked
+		peer, exists := sp.peers[source.PeerID]
+		if !exists {
+			continue
+		}
+		if source.Mismatches > 0 {
+			b.put(reputationBucket, source.PeerID, sp.reputation.RecordMismatch(source.PeerID, float64(source.Mismatches), now))
+		}
 
-// Update network statistics
+		switch {
+		case completed && source.Bytes > 0:
+			peer.Transfers.UploadsCompleted++
+			b.put(reputationBucket, source.PeerID, sp.reputation.RecordDownload(source.PeerID, true, 1, now))
+		case source.Bytes == 0 && source.Failures > 0:
+			peer.Transfers.UploadsFailed++
+			b.put(reputationBucket, source.PeerID, sp.reputation.RecordDownload(source.PeerID, false, 1, now))
+		}
+		peer.Transfers.BytesServed += source.Bytes
+
+		if total := peer.Transfers.UploadsCompleted + peer.Transfers.UploadsFailed; total > 0 {
+			peer.Transfers.SuccessRate = float64(peer.Transfers.UploadsCompleted) / float64(total) * 100
+		}
+		b.put(peersBucket, source.PeerID, peer)
+		reported = append(reported, source.PeerID)
+	}
+	sp.peersMutex.Unlock()
+	sp.save(b)
+
+	if len(reported) > 0 {
+		sp.updateReputations(reported...)
+	}
+}
+
+// Reputation
+
+// Outcomes peers can report about each other
+const (
+	reportSuccess      = "success"
+	reportFailure      = "failure"
+	reportHashMismatch = "hash_mismatch"
+)
+
+// How often a peer may report another peer about the same content
+const reportWindow = time.Hour
+
+// How stale the persisted uptime of a peer may get. A restart credits at
+// most this much of the gap anyway, see reputation.RecordUptime.
+const uptimePersistInterval = 10 * time.Minute
+
+// Report handler. A signed peer reports how a transfer from another peer
+// went: a successful or failed download, or data that failed hash
+// verification. Reports feed the reputation of the reported peer, weighted
+// by the reputation of the reporter. The reported peer must hold the content,
+// and each reporter gets one report per peer and content hash per
+// reportWindow.
+func (sp *SuperPeer) reportPeerHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+
+	reporterID, status, err := sp.authenticatePeer(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var report struct {
+		PeerID  string `json:"peer_id"`
+		Hash    string `json:"hash"`
+		Outcome string `json:"outcome"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	if report.PeerID == reporterID {
+		http.Error(w, "Peers cannot report themselves", http.StatusBadRequest)
+		return
+	}
+	if report.Outcome != reportSuccess && report.Outcome != reportFailure && report.Outcome != reportHashMismatch {
+		http.Error(w, "Outcome must be success, failure or hash_mismatch", http.StatusBadRequest)
+		return
+	}
+	if report.Hash == "" {
+		http.Error(w, "Hash required", http.StatusBadRequest)
+		return
+	}
+
+	sp.peersMutex.RLock()
+	_, known := sp.peers[report.PeerID]
+	reporter, registered := sp.peers[reporterID]
+	weight := 0.0
+	if registered {
+		weight = float64(reporter.Reputation) / 100
+	}
+	sp.peersMutex.RUnlock()
+	if !known {
+		http.Error(w, "Peer not found", http.StatusNotFound)
+		return
+	}
+
+	// Only a peer holding the content can have served it
+	sp.filesMutex.RLock()
+	holds := false
+	for fileID := range sp.replicas[report.Hash] {
+		if file, exists := sp.files[fileID]; exists && file.Owner == report.PeerID {
+			holds = true
+			break
+		}
+	}
+	sp.filesMutex.RUnlock()
+	if !holds {
+		http.Error(w, "Peer does not share this content", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	key := reporterID + "/" + report.PeerID + "/" + report.Hash
+	sp.routingMutex.Lock()
+	last, reported := sp.peerReports[key]
+	if !reported || now.Sub(last) >= reportWindow {
+		sp.peerReports[key] = now
+	}
+	sp.routingMutex.Unlock()
+	if reported && now.Sub(last) < reportWindow {
+		http.Error(w, "Transfer already reported", http.StatusTooManyRequests)
+		return
+	}
+
+	var stats reputation.Stats
+	switch report.Outcome {
+	case reportSuccess, reportFailure:
+		stats = sp.reputation.RecordDownload(report.PeerID, report.Outcome == reportSuccess, weight, now)
+	case reportHashMismatch:
+		stats = sp.reputation.RecordMismatch(report.PeerID, weight, now)
+		log.Printf("🚨 %s reported corrupt data for %s from %s", reporterID, report.Hash, report.PeerID)
+	}
+	if err := sp.persist(reputationBucket, report.PeerID, stats); err != nil {
+		writeFailed(w)
+		return
+	}
+	sp.updateReputations(report.PeerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Report recorded successfully",
+	})
+}
+
+// Recompute the reputation of the given peers, or of every peer if none are
+// given, from their stats and the ratings of their files
+func (sp *SuperPeer) updateReputations(peerIDs ...string) {
+	type votes struct {
+		total float64
+		count int
+	}
+	ratings := make(map[string]votes)
+	sp.filesMutex.RLock()
+	for _, file := range sp.files {
+		if file.RatingCount > 0 {
+			v := ratings[file.Owner]
+			v.total += file.Rating * float64(file.RatingCount)
+			v.count += file.RatingCount
+			ratings[file.Owner] = v
+		}
+	}
+	sp.filesMutex.RUnlock()
+
+	now := time.Now()
+	var b batch
+	defer func() { sp.save(b) }()
+	sp.peersMutex.Lock()
+	defer sp.peersMutex.Unlock()
+
+	if len(peerIDs) == 0 {
+		for id := range sp.peers {
+			peerIDs = append(peerIDs, id)
+		}
+	}
+	for _, id := range peerIDs {
+		peer, exists := sp.peers[id]
+		if !exists {
+			continue
+		}
+		score := sp.reputation.Score(id, ratings[id].total, ratings[id].count, now)
+		if score != peer.Reputation {
+			peer.Reputation = score
+			b.put(peersBucket, id, peer)
+		}
+	}
+}
+
+// Ratings
+
+// Limits on reviews
+const (
+	maxCommentLength = 1000
+	maxRecentReviews = 5
+)
+
+// Rating handler. A signed peer rates the content with the given hash from 1
+// to 5, with an optional comment; rating again replaces its earlier vote.
+func (sp *SuperPeer) rateFileHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+
+	peerID, status, err := sp.authenticatePeer(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	var req struct {
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if len(comment) > maxCommentLength {
+		http.Error(w, fmt.Sprintf("Comment longer than %d bytes", maxCommentLength), http.StatusBadRequest)
+		return
+	}
+
+	// The rating counts towards the reputation of every peer holding the
+	// content, so none of them may rate it
+	sp.filesMutex.RLock()
+	var owners []string
+	for fileID := range sp.replicas[hash] {
+		if file, exists := sp.files[fileID]; exists && !slices.Contains(owners, file.Owner) {
+			owners = append(owners, file.Owner)
+		}
+	}
+	sp.filesMutex.RUnlock()
+	if len(owners) == 0 {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if slices.Contains(owners, peerID) {
+		http.Error(w, "Peers cannot rate their own files", http.StatusForbidden)
+		return
+	}
+
+	review := &Review{
+		Hash:      hash,
+		PeerID:    peerID,
+		Rating:    req.Rating,
+		Comment:   comment,
+		CreatedAt: time.Now(),
+	}
+
+	sp.ratingsMutex.Lock()
+	if sp.ratings[hash] == nil {
+		sp.ratings[hash] = make(map[string]*Review)
+	}
+	sp.ratings[hash][peerID] = review
+	var b batch
+	b.put(ratingsBucket, hash+"/"+peerID, review)
+	sp.ratingsMutex.Unlock()
+	if err := sp.save(b); err != nil {
+		writeFailed(w)
+		return
+	}
+
+	rating, count := sp.applyRatings(hash)
+	sp.updateReputations(owners...)
+
+	sp.broadcastUpdate("file_rated", map[string]interface{}{
+		"hash":         hash,
+		"rating":       rating,
+		"rating_count": count,
+		"review":       review,
+	})
+
+	log.Printf("⭐ %s rated %s: %d/5", peerID, hash, req.Rating)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "success",
+		"rating":       rating,
+		"rating_count": count,
+		"message":      "Rating recorded successfully",
+	})
+}
+
+// List the reviews of some content, most recent first, with the aggregate
+// rating. Supports page_size and cursor.
+func (sp *SuperPeer) getFileRatingsHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	params, err := pagination.ParseParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sp.ratingsMutex.RLock()
+	reviews := make([]Review, 0, len(sp.ratings[hash]))
+	for _, review := range sp.ratings[hash] {
+		reviews = append(reviews, *review)
+	}
+	sp.ratingsMutex.RUnlock()
+	rating, count, _ := sp.ratingSummary(hash)
+
+	page, err := pagination.Paginate(reviews, params, reviewLess,
+		func(r Review) Review { return Review{PeerID: r.PeerID, CreatedAt: r.CreatedAt} })
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hash":         hash,
+		"rating":       rating,
+		"rating_count": count,
+		"reviews":      page.Items,
+		"total":        page.Total,
+		"page_size":    page.PageSize,
+		"next_cursor":  page.NextCursor,
+	})
+}
+
+// Most recent review first
+func reviewLess(a, b Review) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.PeerID < b.PeerID
+}
+
+// Aggregate rating, vote count and most recent reviews of some content
+func (sp *SuperPeer) ratingSummary(hash string) (float64, int, []Review) {
+	sp.ratingsMutex.RLock()
+	defer sp.ratingsMutex.RUnlock()
+
+	votes := sp.ratings[hash]
+	if len(votes) == 0 {
+		return 0, 0, nil
+	}
+
+	total := 0
+	reviews := make([]Review, 0, len(votes))
+	for _, review := range votes {
+		total += review.Rating
+		reviews = append(reviews, *review)
+	}
+	sort.Slice(reviews, func(i, j int) bool { return reviewLess(reviews[i], reviews[j]) })
+	if len(reviews) > maxRecentReviews {
+		reviews = reviews[:maxRecentReviews]
+	}
+	return float64(total) / float64(len(votes)), len(votes), reviews
+}
+
+// Copy the rating summary of some content into every file record holding
+// it. Returns the aggregate rating and vote count.
+func (sp *SuperPeer) applyRatings(hash string) (float64, int) {
+	var b batch
+	rating, count := sp.copyRatings(&b, hash)
+	sp.save(b)
+	return rating, count
+}
+
+// Copy the rating summary into the file records, adding the writes to b
+func (sp *SuperPeer) copyRatings(b *batch, hash string) (float64, int) {
+	rating, count, reviews := sp.ratingSummary(hash)
+
+	sp.filesMutex.Lock()
+	for fileID := range sp.replicas[hash] {
+		if file, exists := sp.files[fileID]; exists {
+			file.Rating, file.RatingCount, file.Reviews = rating, count, reviews
+			b.put(filesBucket, fileID, file)
+		}
+	}
+	sp.filesMutex.Unlock()
+
+	return rating, count
+}
+
+// Advanced search handler. The query is given as URL parameters or as a JSON
+// SearchQuery body and may use the query language of the search package.
+// Free text is looked up in the inverted index, or matched against filenames
+// with typo tolerance when fuzzy is set, and ranked by relevance unless
+// another sort order is requested. Files that are unavailable or whose owner
+// is offline are left out unless include_offline is set.
+func (sp *SuperPeer) searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	var req SearchQuery
+	var err error
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid search query", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req, err = searchQueryFromURL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// limit predates pagination and is the default page size
+	if req.PageSize <= 0 {
+		req.PageSize = req.Limit
+	}
+	if req.PageSize <= 0 {
+		req.PageSize = 50
+	}
+
+	parsed, err := search.ParseQuery(req.Query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid search query: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Category != "" {
+		parsed.Filters = append(parsed.Filters, search.CategoryFilter{Category: req.Category})
+	}
+	for _, tag := range req.Tags {
+		parsed.Filters = append(parsed.Filters, search.TagFilter{Tag: tag})
+	}
+
+	offline := make(map[string]bool)
+	if !req.IncludeOffline {
+		sp.peersMutex.RLock()
+		for id, peer := range sp.peers {
+			if !peer.IsOnline {
+				offline[id] = true
+			}
+		}
+		sp.peersMutex.RUnlock()
+	}
+
+	visible := func(file *FileInfo) bool {
+		if !req.IncludeOffline && (!file.Available || offline[file.Owner]) {
+			return false
+		}
+		return parsed.MatchFields(searchFields(file))
+	}
+
+	var results []SearchResult
+	switch {
+	case req.Fuzzy && len(parsed.Terms) > 0:
+		results = sp.fuzzySearch(parsed, visible)
+	case parsed.HasText():
+		matches := sp.index.Search(parsed)
+		sp.filesMutex.RLock()
+		for _, match := range matches {
+			if file, exists := sp.files[match.ID]; exists && visible(file) {
+				results = append(results, SearchResult{
+					FileInfo:   file,
+					Score:      match.Score,
+					Highlights: search.Highlight(parsed, file.Filename),
+				})
+			}
+		}
+		sp.filesMutex.RUnlock()
+	default:
+		sp.filesMutex.RLock()
+		for _, file := range sp.files {
+			if visible(file) {
+				results = append(results, SearchResult{FileInfo: file})
+			}
+		}
+		sp.filesMutex.RUnlock()
+	}
+	if len(sp.config.Federation) > 0 && r.Header.Get(federatedSearchHeader) == "" {
+		seen := make(map[string]bool, len(results))
+		for _, result := range results {
+			seen[result.ID] = true
+		}
+		for _, result := range sp.federatedSearch(req) {
+			if !seen[result.ID] {
+				seen[result.ID] = true
+				results = append(results, result)
+			}
+		}
+	}
+	if req.SortBy == "" && len(parsed.Terms) > 0 {
+		req.SortBy = "relevance"
+	}
+
+	page, err := pagination.Paginate(results, pagination.Params{PageSize: req.PageSize, Cursor: req.Cursor},
+		searchLess(req.SortBy), searchPosition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     page.Items,
+		"count":       len(page.Items),
+		"total":       page.Total,
+		"page_size":   page.PageSize,
+		"next_cursor": page.NextCursor,
+		"query":       req.Query,
+	})
+}
+
+// Match the free text of a query against filenames allowing for typos. The
+// index narrows the files down to those with a close enough word first.
+func (sp *SuperPeer) fuzzySearch(parsed search.Query, visible func(*FileInfo) bool) []SearchResult {
+	var words []string
+	for _, term := range parsed.Terms {
+		words = append(words, term.Words...)
+	}
+	text := strings.Join(words, " ")
+
+	var allowed map[string]bool
+	if len(parsed.Excluded) > 0 {
+		allowed = make(map[string]bool)
+		for _, match := range sp.index.Search(search.Query{Excluded: parsed.Excluded}) {
+			allowed[match.ID] = true
+		}
+	}
+
+	candidates := sp.index.FuzzyCandidates(text)
+
+	var results []SearchResult
+	sp.filesMutex.RLock()
+	for _, id := range candidates {
+		file, exists := sp.files[id]
+		if !exists || (allowed != nil && !allowed[id]) || !visible(file) {
+			continue
+		}
+		if score, spans, ok := search.FuzzyMatch(text, file.Filename); ok {
+			results = append(results, SearchResult{FileInfo: file, Score: score, Highlights: spans})
+		}
+	}
+	sp.filesMutex.RUnlock()
+
+	return results
+}
+
+// Read a SearchQuery from the URL parameters q, category, tags (comma
+// separated), sort, limit, include_offline, fuzzy, page_size and cursor
+func searchQueryFromURL(r *http.Request) (SearchQuery, error) {
+	page, err := pagination.ParseParams(r)
+	if err != nil {
+		return SearchQuery{}, err
+	}
+
+	params := r.URL.Query()
+	req := SearchQuery{
+		Query:          params.Get("q"),
+		Category:       params.Get("category"),
+		SortBy:         params.Get("sort"),
+		IncludeOffline: params.Get("include_offline") == "true",
+		Fuzzy:          params.Get("fuzzy") == "true",
+		PageSize:       page.PageSize,
+		Cursor:         page.Cursor,
+	}
+	for _, tag := range strings.Split(params.Get("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			req.Tags = append(req.Tags, tag)
+		}
+	}
+	if l, err := strconv.Atoi(params.Get("limit")); err == nil {
+		req.Limit = l
+	}
+	return req, nil
+}
+
+// WebSocket handler for real-time updates
+func (sp *SuperPeer) websocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	sp.wsMutex.Lock()
+	sp.wsConnections[conn] = true
+	sp.wsMutex.Unlock()
+
+	defer func() {
+		sp.wsMutex.Lock()
+		delete(sp.wsConnections, conn)
+		sp.wsMutex.Unlock()
+	}()
+
+	// Send initial data
+	sp.sendNetworkStats(conn)
+
+	// Keep connection alive
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+	}
+}
+
+// Broadcast updates to all WebSocket connections
+func (sp *SuperPeer) broadcastUpdate(eventType string, data interface{}) {
+	message := map[string]interface{}{
+		"type":      eventType,
+		"data":      data,
+		"timestamp": time.Now(),
+	}
+
+	sp.wsMutex.Lock() // Acquire write lock
+	for conn := range sp.wsConnections {
+		if err := conn.WriteJSON(message); err != nil {
+			log.Printf("Error broadcasting to WebSocket: %v", err)
+			// Optionally, remove broken connection
+			// delete(sp.wsConnections, conn)
+		}
+	}
+	sp.wsMutex.Unlock() // Release write lock
+}
+
+// Disconnect WebSocket clients with a going-away close frame
+func (sp *SuperPeer) closeWebSockets() {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+	sp.wsMutex.Lock()
+	for conn := range sp.wsConnections {
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		conn.Close()
+		delete(sp.wsConnections, conn)
+	}
+	sp.wsMutex.Unlock()
+}
+
+// Health check service
+func (sp *SuperPeer) healthCheckService(ctx context.Context) {
+	defer sp.services.Done()
+	ticker := time.NewTicker(time.Duration(sp.config.HeartbeatInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// Followers get peer status from the leader
+			if sp.isLeader() {
+				if sp.raft != nil {
+					sp.migrateFileIDs()
+				}
+				sp.checkPeerHealth()
+				sp.expireAliases()
+				sp.expireReports()
+			}
+		}
+	}
+}
+
+// Mark peers that have not sent a heartbeat recently as offline
+func (sp *SuperPeer) checkPeerHealth() {
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(sp.config.CleanupInterval))
+
+	// Uptime stats change on every tick; they are only written when the
+	// peer went offline or the stored copy is getting stale
+	var b batch
+	sp.peersMutex.Lock()
+	var offline []string
+	for id, peer := range sp.peers {
+		wentOffline := peer.IsOnline && peer.LastSeen.Before(cutoff)
+		if wentOffline {
+			peer.IsOnline = false
+			b.put(peersBucket, id, peer)
+			offline = append(offline, id)
+			log.Printf("⚠️ Peer %s marked offline", id)
+		}
+		stats := sp.reputation.RecordUptime(id, peer.IsOnline, now)
+		if wentOffline || now.Sub(sp.uptimeStored[id]) >= uptimePersistInterval {
+			sp.uptimeStored[id] = now
+			b.put(reputationBucket, id, stats)
+		}
+	}
+	sp.peersMutex.Unlock()
+	sp.save(b)
+
+	for _, id := range offline {
+		sp.setFilesAvailable(id, false)
+	}
+	sp.updateReputations()
+
+	sp.updateStats()
+}
+
+// Statistics service
+func (sp *SuperPeer) statisticsService(ctx context.Context) {
+	defer sp.services.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sp.updateStats()
+			if sp.isLeader() {
+				sp.recordStats()
+			}
+			sp.broadcastUpdate("stats_update", sp.stats)
+		}
+	}
+}
+
+// Snapshot service compacts the index store's write-ahead log
+func (sp *SuperPeer) snapshotService(ctx context.Context) {
+	defer sp.services.Done()
+	ticker := time.NewTicker(time.Duration(sp.config.SnapshotInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sp.store.Snapshot(); err != nil {
+				log.Printf("❌ Failed to snapshot index: %v", err)
+			}
+		}
+	}
+}
+
+// Update network statistics
 func (sp *SuperPeer) updateStats() {
 	sp.peersMutex.RLock()
-	onlinePeers := 0
+	onlinePeers := 0
+	for _, peer := range sp.peers {
+		if peer.IsOnline {
+			onlinePeers++
+		}
+	}
+	totalPeers := len(sp.peers)
+	sp.peersMutex.RUnlock()
+
+	sp.filesMutex.RLock()
+	totalFiles := len(sp.files)
+	totalDownloads := 0
+	for _, file := range sp.files {
+		totalDownloads += file.Downloads
+	}
+	sp.filesMutex.RUnlock()
+
+	healthScore := 0.0
+	if totalPeers > 0 {
+		healthScore = float64(onlinePeers) / float64(totalPeers) * 100
+	}
+
+	sp.stats = NetworkStats{
+		TotalPeers:     totalPeers,
+		OnlinePeers:    onlinePeers,
+		TotalFiles:     totalFiles,
+		TotalDownloads: totalDownloads,
+		NetworkHealth:  healthScore,
+		LastUpdated:    time.Now(),
+	}
+}
+
+// Append the current statistics to the persisted history
+func (sp *SuperPeer) recordStats() {
+	var b batch
+	sp.statsMutex.Lock()
+	sp.statsHistory = append(sp.statsHistory, sp.stats)
+	b.put(statsBucket, statsKey(sp.stats.LastUpdated), sp.stats)
+
+	for len(sp.statsHistory) > maxStatsHistory {
+		b.delete(statsBucket, statsKey(sp.statsHistory[0].LastUpdated))
+		sp.statsHistory = sp.statsHistory[1:]
+	}
+	sp.statsMutex.Unlock()
+
+	sp.save(b)
+}
+
+// Configuration
+
+// Environment variables and the flags they stand in for
+var superPeerEnv = map[string]string{
+	"SUPER_PEER_CONFIG":               "config",
+	"SUPER_PEER_PORT":                 "port",
+	"SUPER_PEER_ADDRESS":              "address",
+	"SUPER_PEER_DATA_DIR":             "data-dir",
+	"SUPER_PEER_STORAGE":              "storage",
+	"SUPER_PEER_MAX_PEERS":            "max-peers",
+	"SUPER_PEER_HEARTBEAT_INTERVAL":   "heartbeat-interval",
+	"SUPER_PEER_CLEANUP_INTERVAL":     "cleanup-interval",
+	"SUPER_PEER_SNAPSHOT_INTERVAL":    "snapshot-interval",
+	"SUPER_PEER_SHUTDOWN_TIMEOUT":     "shutdown-timeout",
+	"SUPER_PEER_REPUTATION_HALF_LIFE": "reputation-half-life",
+	"SUPER_PEER_FEDERATION":           "federation",
+	"SUPER_PEER_FEDERATION_KEY":       "federation-key",
+	"SUPER_PEER_GOSSIP_INTERVAL":      "gossip-interval",
+	"SUPER_PEER_CLUSTER":              "cluster",
+	"SUPER_PEER_CLUSTER_KEY":          "cluster-key",
+	"SUPER_PEER_DHT":                  "dht",
+	"SUPER_PEER_ID_MIGRATION_WINDOW":  "id-migration-window",
+}
+
+// Build the configuration from defaults, the config file, environment
+// variables and command-line args, in increasing precedence
+func loadConfig(args []string) (SuperPeerConfig, error) {
+	cfg := SuperPeerConfig{
+		Port:              8080,
+		DataDirectory:     "data",
+		Storage:           "disk",
+		MaxPeers:          1000,
+		HeartbeatInterval: config.Duration(30 * time.Second),
+		CleanupInterval:   config.Duration(5 * time.Minute),
+		SnapshotInterval:  config.Duration(5 * time.Minute),
+		ShutdownTimeout:   config.Duration(30 * time.Second),
+		ReputationDecay:   config.Duration(7 * 24 * time.Hour),
+		GossipInterval:    config.Duration(15 * time.Second),
+		IDMigration:       config.Duration(30 * 24 * time.Hour),
+	}
+
+	fs := flag.NewFlagSet("super-peer", flag.ContinueOnError)
+	fs.String("config", "", "path to a YAML or JSON config file (default "+config.DefaultFile+" if present)")
+	fs.IntVar(&cfg.Port, "port", cfg.Port, "port to listen on")
+	fs.StringVar(&cfg.Address, "address", "", "host:port other super-peers reach this one at (default localhost:<port>)")
+	fs.StringVar(&cfg.DataDirectory, "data-dir", cfg.DataDirectory, "directory of the index store")
+	fs.StringVar(&cfg.Storage, "storage", cfg.Storage, "index store backend: disk or memory")
+	fs.IntVar(&cfg.MaxPeers, "max-peers", cfg.MaxPeers, "maximum number of registered peers (0 for no limit)")
+	fs.Var(&cfg.HeartbeatInterval, "heartbeat-interval", "interval between peer health checks, e.g. 30s")
+	fs.Var(&cfg.CleanupInterval, "cleanup-interval", "silence after which a peer is marked offline, e.g. 5m")
+	fs.Var(&cfg.SnapshotInterval, "snapshot-interval", "interval between index snapshots, e.g. 5m")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "how long to wait for in-flight requests on shutdown, e.g. 30s")
+	fs.Var(&cfg.Federation, "federation", "comma-separated host:port of the super-peers to federate with")
+	fs.StringVar(&cfg.FederationKey, "federation-key", "", "secret shared by the federated super-peers to sign gossip with")
+	fs.Var(&cfg.GossipInterval, "gossip-interval", "interval between federation gossip rounds, e.g. 15s")
+	fs.Var(&cfg.Cluster, "cluster", "comma-separated host:port of the other super-peers sharing this index")
+	fs.StringVar(&cfg.ClusterKey, "cluster-key", "", "secret shared by the clustered super-peers to sign raft RPCs with")
+	fs.BoolVar(&cfg.DHT, "dht", cfg.DHT, "serve as a bootstrap node of the peers' DHT")
+	fs.Var(&cfg.IDMigration, "id-migration-window", "how long file IDs from before the ID migration keep redirecting, e.g. 720h")
+	fs.Var(&cfg.ReputationDecay, "reputation-half-life", "time after which peer behaviour counts half towards reputation, e.g. 168h")
+
+	path, err := config.Apply(fs, args, "super_peer", superPeerEnv, &cfg)
+	if err != nil {
+		return SuperPeerConfig{}, err
+	}
+	cfg.ConfigFile = path
+	if cfg.Address == "" {
+		cfg.Address = fmt.Sprintf("localhost:%d", cfg.Port)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return SuperPeerConfig{}, err
+	}
+	return cfg, nil
+}
+
+func (c SuperPeerConfig) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.Storage != "disk" && c.Storage != "memory" {
+		return fmt.Errorf("storage must be disk or memory, got %q", c.Storage)
+	}
+	if c.Storage == "disk" && c.DataDirectory == "" {
+		return fmt.Errorf("data_directory is required for disk storage")
+	}
+	if c.MaxPeers < 0 {
+		return fmt.Errorf("max_peers must not be negative")
+	}
+	if c.HeartbeatInterval < config.Duration(time.Second) {
+		return fmt.Errorf("heartbeat_interval must be at least 1s")
+	}
+	if c.CleanupInterval < c.HeartbeatInterval {
+		return fmt.Errorf("cleanup_interval must not be shorter than heartbeat_interval")
+	}
+	if c.SnapshotInterval < config.Duration(time.Second) {
+		return fmt.Errorf("snapshot_interval must be at least 1s")
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if c.ReputationDecay < config.Duration(time.Minute) {
+		return fmt.Errorf("reputation_half_life must be at least 1m")
+	}
+	for _, address := range c.Federation {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("federation entries must be host:port, got %q", address)
+		}
+		if address == c.Address {
+			return fmt.Errorf("federation must not list this super-peer's own address %q", address)
+		}
+	}
+	if c.IDMigration < 0 {
+		return fmt.Errorf("id_migration_window must not be negative")
+	}
+	if c.GossipInterval < config.Duration(time.Second) {
+		return fmt.Errorf("gossip_interval must be at least 1s")
+	}
+	for _, address := range c.Cluster {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("cluster entries must be host:port, got %q", address)
+		}
+		if address == c.Address {
+			return fmt.Errorf("cluster must not list this super-peer's own address %q", address)
+		}
+	}
+	if len(c.Cluster) > 0 && c.ClusterKey == "" {
+		return fmt.Errorf("cluster_key is required in a cluster")
+	}
+	if len(c.Cluster) > 0 && c.Storage != "disk" {
+		return fmt.Errorf("a cluster requires disk storage")
+	}
+	return nil
+}
+
+// Effective configuration after applying the file, environment and flags
+func (sp *SuperPeer) getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sp.config)
+}
+
+// Persistence helpers
+func openStore(cfg SuperPeerConfig) (storage.Store, error) {
+	if cfg.Storage == "memory" {
+		log.Println("⚠️ Using in-memory index store, state will not survive restarts")
+		return storage.NewMemoryStore(), nil
+	}
+	return storage.OpenDiskStore(cfg.DataDirectory)
+}
+
+// Load peers, files and statistics history from the store, replacing the
+// in-memory state. The state is also reloaded while serving, so it is
+// swapped under all of its locks; handlers look records up again after
+// taking a lock rather than keep them across a save.
+func (sp *SuperPeer) loadState() error {
+	sp.lockState()
+	defer sp.unlockState()
+
+	sp.resetState()
+	for _, bucket := range storeBuckets {
+		err := sp.store.ForEach(bucket, func(key string, value json.RawMessage) error {
+			return sp.loadRecord(bucket, key, value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Files of peers that went away while we were down are unavailable
+	for _, file := range sp.files {
+		owner, exists := sp.peers[file.Owner]
+		file.Available = exists && owner.IsOnline
+	}
+
+	log.Printf("📦 Loaded %d peers, %d files and %d stats samples from store",
+		len(sp.peers), len(sp.files), len(sp.statsHistory))
+	return nil
+}
+
+// Take the locks of all in-memory state loaded from the store, in the
+// order handlers take them
+func (sp *SuperPeer) lockState() {
+	sp.peersMutex.Lock()
+	sp.filesMutex.Lock()
+	sp.ratingsMutex.Lock()
+	sp.statsMutex.Lock()
+}
+
+func (sp *SuperPeer) unlockState() {
+	sp.statsMutex.Unlock()
+	sp.ratingsMutex.Unlock()
+	sp.filesMutex.Unlock()
+	sp.peersMutex.Unlock()
+}
+
+// Empty the in-memory state. The caller holds the state locks.
+func (sp *SuperPeer) resetState() {
+	sp.peers = make(map[string]*Peer)
+	for id := range sp.files {
+		sp.index.Remove(id)
+	}
+	sp.files = make(map[string]*FileInfo)
+	sp.aliases = make(map[string]*FileAlias)
+	sp.replicas = make(map[string]map[string]bool)
+	sp.completions = make(map[string]bool)
+	sp.ratings = make(map[string]map[string]*Review)
+	sp.reputation.Reset()
+	sp.statsHistory = nil
+}
+
+// Apply a stored record to the in-memory state, replacing any earlier
+// version of it. The caller holds the state locks.
+func (sp *SuperPeer) loadRecord(bucket, key string, value json.RawMessage) error {
+	switch bucket {
+	case peersBucket:
+		var peer Peer
+		if err := json.Unmarshal(value, &peer); err != nil {
+			return fmt.Errorf("peer %s: %w", key, err)
+		}
+		sp.peers[peer.ID] = &peer
+
+	case filesBucket:
+		var file FileInfo
+		if err := json.Unmarshal(value, &file); err != nil {
+			return fmt.Errorf("file %s: %w", key, err)
+		}
+		if previous, exists := sp.files[file.ID]; exists {
+			sp.removeReplica(previous)
+		}
+		sp.files[file.ID] = &file
+		sp.addReplica(&file)
+		sp.indexFile(&file)
+
+	case aliasesBucket:
+		var alias FileAlias
+		if err := json.Unmarshal(value, &alias); err != nil {
+			return fmt.Errorf("alias %s: %w", key, err)
+		}
+		sp.aliases[alias.ID] = &alias
+
+	case ratingsBucket:
+		var review Review
+		if err := json.Unmarshal(value, &review); err != nil {
+			return fmt.Errorf("rating %s: %w", key, err)
+		}
+		if sp.ratings[review.Hash] == nil {
+			sp.ratings[review.Hash] = make(map[string]*Review)
+		}
+		sp.ratings[review.Hash][review.PeerID] = &review
+
+	case downloadsBucket:
+		sp.completions[key] = true
+
+	case reputationBucket:
+		var stats reputation.Stats
+		if err := json.Unmarshal(value, &stats); err != nil {
+			return fmt.Errorf("reputation %s: %w", key, err)
+		}
+		sp.reputation.Load(key, stats)
+
+	case statsBucket:
+		var stats NetworkStats
+		if err := json.Unmarshal(value, &stats); err != nil {
+			return fmt.Errorf("stats %s: %w", key, err)
+		}
+		sp.statsHistory = append(sp.statsHistory, stats)
+	}
+	return nil
+}
+
+// Drop a deleted record from the in-memory state. The caller holds the
+// state locks.
+func (sp *SuperPeer) unloadRecord(bucket, key string) {
+	switch bucket {
+	case peersBucket:
+		delete(sp.peers, key)
+
+	case filesBucket:
+		if file, exists := sp.files[key]; exists {
+			delete(sp.files, key)
+			sp.removeReplica(file)
+			sp.index.Remove(key)
+		}
+
+	case aliasesBucket:
+		delete(sp.aliases, key)
+
+	case ratingsBucket:
+		hash, peerID, _ := strings.Cut(key, "/")
+		delete(sp.ratings[hash], peerID)
+		if len(sp.ratings[hash]) == 0 {
+			delete(sp.ratings, hash)
+		}
+
+	case downloadsBucket:
+		delete(sp.completions, key)
+
+	case statsBucket:
+		sp.statsHistory = slices.DeleteFunc(sp.statsHistory, func(stats NetworkStats) bool {
+			return statsKey(stats.LastUpdated) == key
+		})
+	}
+}
+
+// A set of store writes made together. In a cluster a batch is committed
+// to the leader's log as one entry.
+type batch []mutation
+
+// Add a write of value to the batch. The value is encoded right away, while
+// the caller still holds the lock guarding it.
+func (b *batch) put(bucket, key string, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("❌ Failed to encode %s/%s: %v", bucket, key, err)
+		return
+	}
+	*b = append(*b, mutation{Op: "put", Bucket: bucket, Key: key, Value: data})
+}
+
+// Add a deletion to the batch
+func (b *batch) delete(bucket, key string) {
+	*b = append(*b, mutation{Op: "delete", Bucket: bucket, Key: key})
+}
+
+// Make a batch of writes durable. Callers build the batch under the locks
+// guarding the records and save it after releasing them, since in a cluster
+// the batch is committed through the leader's log, which can take up to two
+// election timeouts, and only reaches the store once a majority holds it.
+// The error says it did not; the in-memory state is then rebuilt from the
+// store.
+func (sp *SuperPeer) save(b batch) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if sp.raft == nil {
+		for _, m := range b {
+			if err := sp.storeMutation(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if err := sp.raft.Commit(data); err != nil {
+		log.Printf("⚠️ %d writes starting with %s/%s not committed: %v", len(b), b[0].Bucket, b[0].Key, err)
+		return err
+	}
+	return nil
+}
+
+// Save a single record. The caller must not hold any state lock.
+func (sp *SuperPeer) persist(bucket, key string, value interface{}) error {
+	var b batch
+	b.put(bucket, key, value)
+	return sp.save(b)
+}
+
+// Write a mutation to the store
+func (sp *SuperPeer) storeMutation(m mutation) error {
+	var err error
+	switch m.Op {
+	case "put":
+		if err = sp.store.Put(m.Bucket, m.Key, m.Value); err != nil {
+			log.Printf("❌ Failed to persist %s/%s: %v", m.Bucket, m.Key, err)
+		}
+	case "delete":
+		if err = sp.store.Delete(m.Bucket, m.Key); err != nil {
+			log.Printf("❌ Failed to delete %s/%s: %v", m.Bucket, m.Key, err)
+		}
+	}
+	return err
+}
+
+// Answer a write that was not made durable. In a cluster the client retries
+// and reaches the current leader.
+func writeFailed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Write not committed", http.StatusServiceUnavailable)
+}
+
+// Stats keys sort chronologically so the history reloads in order
+func statsKey(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000")
+}
+
+// Authentication helpers
+
+// Limit on request bodies read into memory for signature checks
+const maxRequestBody = 16 * 1024 * 1024
+
+func readBody(r *http.Request) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(r.Body, maxRequestBody))
+}
+
+// Check that a request is signed by a registered peer. Returns the peer ID,
+// or the HTTP status and error to reply with.
+func (sp *SuperPeer) authenticatePeer(r *http.Request, body []byte) (string, int, error) {
+	peerID := r.Header.Get(identity.HeaderPeerID)
+	if peerID == "" {
+		return "", http.StatusBadRequest, fmt.Errorf("Peer ID required")
+	}
+
+	sp.peersMutex.RLock()
+	peer, exists := sp.peers[peerID]
+	var encodedKey string
+	if exists {
+		encodedKey = peer.PublicKey
+	}
+	sp.peersMutex.RUnlock()
+
+	if !exists {
+		return "", http.StatusNotFound, fmt.Errorf("Peer not registered")
+	}
+
+	publicKey, err := identity.DecodePublicKey(encodedKey)
+	if err != nil {
+		return "", http.StatusUnauthorized, fmt.Errorf("Peer has no valid public key, register again")
+	}
+	if err := identity.Verify(r, body, publicKey, sp.nonces); err != nil {
+		return "", http.StatusUnauthorized, err
+	}
+	return peerID, http.StatusOK, nil
+}
+
+// Helper functions
+
+// A file path relative to a shared directory: slash-separated, clean and
+// not leaving the directory
+func validFilePath(p string) bool {
+	return len(p) <= 4096 && p == path.Clean(p) && !path.IsAbs(p) &&
+		p != "." && p != ".." && !strings.HasPrefix(p, "../") && !strings.Contains(p, "\\")
+}
+
+// Check that the piece hashes of a file add up to its Merkle root
+func validatePieceHashes(file *FileInfo) error {
+	if file.MerkleRoot == "" && len(file.PieceHashes) == 0 {
+		return nil // Legacy peers only send the whole-file hash
+	}
+	if file.PieceSize <= 0 {
+		return fmt.Errorf("piece size must be positive")
+	}
+	if expected := (file.Size + file.PieceSize - 1) / file.PieceSize; int64(len(file.PieceHashes)) != expected {
+		return fmt.Errorf("expected %d piece hashes, got %d", expected, len(file.PieceHashes))
+	}
+	root, err := merkle.Root(file.PieceHashes)
+	if err != nil {
+		return err
+	}
+	if root != file.MerkleRoot {
+		return fmt.Errorf("merkle root mismatch")
+	}
+	return nil
+}
+
+// Attributes of a file that search filters are evaluated against
+func searchFields(file *FileInfo) search.Fields {
+	return search.Fields{
+		Category: file.Category,
+		Tags:     file.Tags,
+		Owner:    file.Owner,
+		Size:     file.Size,
+		Uploaded: file.UploadTime,
+	}
+}
+
+// Add or refresh a file in the full-text index
+func (sp *SuperPeer) indexFile(file *FileInfo) {
+	// Folder names are searchable like tags
+	terms := strings.Join(file.Tags, " ")
+	if dir := path.Dir(file.Path); dir != "." {
+		terms += " " + strings.ReplaceAll(dir, "/", " ")
+	}
+	sp.index.Add(file.ID, file.Filename, file.Category, terms)
+}
+
+// Order of search results for a sort option, ties broken by file ID so that
+// pages are stable
+func searchLess(sortBy string) func(a, b SearchResult) bool {
+	var compare func(a, b SearchResult) int
+	switch sortBy {
+	case "relevance":
+		compare = func(a, b SearchResult) int { return compareDesc(a.Score, b.Score) }
+	case "name":
+		compare = func(a, b SearchResult) int { return strings.Compare(a.Filename, b.Filename) }
+	case "size":
+		compare = func(a, b SearchResult) int { return compareDesc(a.Size, b.Size) }
+	case "downloads":
+		compare = func(a, b SearchResult) int { return compareDesc(a.Downloads, b.Downloads) }
+	case "rating":
+		compare = func(a, b SearchResult) int { return compareDesc(a.Rating, b.Rating) }
+	default: // date
+		compare = func(a, b SearchResult) int { return b.UploadTime.Compare(a.UploadTime) }
+	}
+
+	return func(a, b SearchResult) bool {
+		if c := compare(a, b); c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	}
+}
+
+// The fields of a search result that searchLess compares
+func searchPosition(result SearchResult) SearchResult {
+	return SearchResult{
+		FileInfo: &FileInfo{
+			ID:         result.ID,
+			Filename:   result.Filename,
+			Size:       result.Size,
+			Downloads:  result.Downloads,
+			Rating:     result.Rating,
+			UploadTime: result.UploadTime,
+		},
+		Score: result.Score,
+	}
+}
+
+// Compare for a descending order
+func compareDesc[T int | int64 | float64](a, b T) int {
+	switch {
+	case a > b:
+		return -1
+	case a < b:
+		return 1
+	}
+	return 0
+}
+
+// API handlers
+// List endpoints are ordered by ID and paginated with page_size and cursor
+func (sp *SuperPeer) getPeersHandler(w http.ResponseWriter, r *http.Request) {
+	sp.peersMutex.RLock()
+	peers := make([]Peer, 0, len(sp.peers))
+	for _, peer := range sp.peers {
+		peers = append(peers, *peer)
+	}
+	sp.peersMutex.RUnlock()
+
+	pagination.WriteList(w, r, peers,
+		func(a, b Peer) bool { return a.ID < b.ID },
+		func(p Peer) Peer { return Peer{ID: p.ID} })
+}
+
+func (sp *SuperPeer) getFilesHandler(w http.ResponseWriter, r *http.Request) {
+	sp.filesMutex.RLock()
+	files := make([]FileInfo, 0, len(sp.files))
+	for _, file := range sp.files {
+		files = append(files, *file)
+	}
+	sp.filesMutex.RUnlock()
+
+	pagination.WriteList(w, r, files,
+		func(a, b FileInfo) bool { return a.ID < b.ID },
+		func(f FileInfo) FileInfo { return FileInfo{ID: f.ID} })
+}
+
+// List every online peer holding a copy of the content with the given hash,
+// best download source first
+func (sp *SuperPeer) getFileSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	candidates := sp.rankReplicas(hash, clientRegion(r))
+	sources := make([]FileInfo, 0, len(candidates))
+	for _, candidate := range candidates {
+		sources = append(sources, candidate.file)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hash":    hash,
+		"sources": sources,
+		"count":   len(sources),
+	})
+}
+
+func (sp *SuperPeer) getStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sp.stats)
+}
+
+func (sp *SuperPeer) getStatsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	sp.statsMutex.RLock()
+	history := make([]NetworkStats, len(sp.statsHistory))
+	copy(history, sp.statsHistory)
+	sp.statsMutex.RUnlock()
+
+	// Oldest sample first
+	pagination.WriteList(w, r, history,
+		func(a, b NetworkStats) bool { return a.LastUpdated.Before(b.LastUpdated) },
+		func(s NetworkStats) NetworkStats { return NetworkStats{LastUpdated: s.LastUpdated} })
+}
+
+func (sp *SuperPeer) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileID := vars["fileId"]
+
+	sp.filesMutex.RLock()
+	file, exists := sp.files[fileID]
+	var hash, filename string
+	if exists {
+		hash, filename = file.Hash, file.Filename
+	}
+	sp.filesMutex.RUnlock()
+
+	if !exists {
+		// Links with a file ID from before the migration move to the new ID
+		if newID, aliased := sp.resolveAlias(fileID); aliased {
+			target := *r.URL
+			target.Path = "/api/v1/download/" + newID
+			http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+			return
+		}
+		remote, federated := sp.federatedFile(fileID)
+		if !federated {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		hash, filename = remote.Hash, remote.Filename
+	}
+
+	// Try the replicas best-first, skipping peers that cannot be reached
+	for _, candidate := range sp.rankReplicas(hash, clientRegion(r)) {
+		if !probePeer(candidate.file.PeerAddress) {
+			sp.recordFailure(candidate.file.Owner)
+			log.Printf("⚠️ Replica %s of %s unreachable, trying next", candidate.file.PeerAddress, filename)
+			continue
+		}
+		sp.recordLoad(candidate.file.Owner)
+
+		// Redirect to peer for actual download. Downloads are counted when
+		// the downloader reports completion.
+		downloadURL := fmt.Sprintf("http://%s/api/v1/content/%s", candidate.file.PeerAddress, hash)
+		http.Redirect(w, r, downloadURL, http.StatusFound)
+		return
+	}
+
+	http.Error(w, "No replica of this file is available", http.StatusServiceUnavailable)
+}
+
+// Federation
+
+// Header marking searches forwarded by a federated super-peer, which are
+// answered from the local index only
+const federatedSearchHeader = "X-Federated-Search"
+
+// Timeout for requests to federated super-peers
+const federationTimeout = 3 * time.Second
+
+// Most peers and files one federation summary may carry
+const (
+	maxSummaryPeers = 10000
+	maxSummaryFiles = 100000
+)
+
+// Gossip service sends a summary of our peers and files to every federated
+// super-peer
+func (sp *SuperPeer) gossipService(ctx context.Context) {
+	defer sp.services.Done()
+	ticker := time.NewTicker(time.Duration(sp.config.GossipInterval))
+	defer ticker.Stop()
+
+	sp.gossip()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sp.gossip()
+		}
+	}
+}
+
+func (sp *SuperPeer) gossip() {
+	// Within a cluster only the leader speaks for the shared index
+	if !sp.isLeader() {
+		return
+	}
+
+	summary := FederationSummary{
+		SuperPeer: sp.config.Address,
+		Peers:     []Peer{},
+		Files:     []FileInfo{},
+		SentAt:    time.Now(),
+	}
+
+	sp.peersMutex.RLock()
 	for _, peer := range sp.peers {
 		if peer.IsOnline {
-			onlinePeers++
+			summary.Peers = append(summary.Peers, *peer)
+		}
+	}
+	sp.peersMutex.RUnlock()
+
+	sp.filesMutex.RLock()
+	for _, file := range sp.files {
+		if file.Available {
+			brief := *file
+			brief.PieceHashes = nil
+			brief.Reviews = nil
+			summary.Files = append(summary.Files, brief)
+		}
+	}
+	sp.filesMutex.RUnlock()
+
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: federationTimeout}
+	var wg sync.WaitGroup
+	for _, address := range sp.config.Federation {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/v1/federation/gossip", address), bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if sp.config.FederationKey != "" {
+				identity.SignShared(req, body, sp.config.Address, []byte(sp.config.FederationKey))
+			}
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("returned %s", resp.Status)
+				}
+			}
+			sp.setReachable(address, err)
+		}(address)
+	}
+	wg.Wait()
+}
+
+// Log when a federated super-peer stops or starts answering
+func (sp *SuperPeer) setReachable(address string, err error) {
+	sp.federationMutex.Lock()
+	defer sp.federationMutex.Unlock()
+
+	if err != nil && !sp.unreachable[address] {
+		log.Printf("⚠️ Federated super-peer %s unreachable: %v", address, err)
+	} else if err == nil && sp.unreachable[address] {
+		log.Printf("🔗 Federated super-peer %s reachable again", address)
+	}
+	sp.unreachable[address] = err != nil
+}
+
+// Gossip handler. Summaries are only accepted from the super-peers listed in
+// the federation config, and replace the sender's previous summary. The
+// sender proves who it is by signing with the federation key or, without
+// one, by sending from the address it is listed under.
+func (sp *SuperPeer) gossipHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		http.Error(w, "Invalid summary", http.StatusBadRequest)
+		return
+	}
+	var summary FederationSummary
+	if err := json.Unmarshal(body, &summary); err != nil {
+		http.Error(w, "Invalid summary", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(sp.config.Federation, summary.SuperPeer) {
+		http.Error(w, "Super-peer not federated", http.StatusForbidden)
+		return
+	}
+	if sp.config.FederationKey != "" {
+		sender, err := identity.VerifyShared(r, body, []byte(sp.config.FederationKey), sp.nonces)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if sender != summary.SuperPeer {
+			http.Error(w, "Summary signed by another super-peer", http.StatusForbidden)
+			return
 		}
+	} else if host, _, _ := net.SplitHostPort(summary.SuperPeer); !advertisedFrom(host, r) {
+		http.Error(w, "Summary not sent from the super-peer's address", http.StatusForbidden)
+		return
+	}
+	if len(summary.Peers) > maxSummaryPeers || len(summary.Files) > maxSummaryFiles {
+		http.Error(w, "Summary too large", http.StatusRequestEntityTooLarge)
+		return
 	}
-	totalPeers := len(sp.peers)
-	sp.peersMutex.RUnlock()
 
-	sp.filesMutex.RLock()
-	totalFiles := len(sp.files)
-	totalDownloads := 0
-	for _, file := range sp.files {
-		totalDownloads += file.Downloads
+	summary.ReceivedAt = time.Now()
+	for i := range summary.Files {
+		summary.Files[i].SuperPeer = summary.SuperPeer
 	}
-	sp.filesMutex.RUnlock()
 
-	healthScore := 0.0
-	if totalPeers > 0 {
-		healthScore = float64(onlinePeers) / float64(totalPeers) * 100
+	// A replayed summary must not replace a newer one
+	sp.federationMutex.Lock()
+	previous, known := sp.federation[summary.SuperPeer]
+	if known && !summary.SentAt.After(previous.SentAt) {
+		sp.federationMutex.Unlock()
+		http.Error(w, "Summary older than the last one received", http.StatusConflict)
+		return
 	}
+	sp.federation[summary.SuperPeer] = &summary
+	sp.federationMutex.Unlock()
 
-	sp.stats = NetworkStats{
-		TotalPeers:     totalPeers,
-		OnlinePeers:    onlinePeers,
-		TotalFiles:     totalFiles,
-		TotalDownloads: totalDownloads,
-		NetworkHealth:  healthScore,
-		LastUpdated:    time.Now(),
+	if !known {
+		log.Printf("🔗 Federated with %s (%d peers, %d files)", summary.SuperPeer, len(summary.Peers), len(summary.Files))
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"message": "Summary received",
+	})
 }
 
-// Helper functions
-func generatePeerID(address string, port int) string {
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", address, port, time.Now().Unix())))
-	return fmt.Sprintf("%x", hash)[:16]
+// Whether a request comes from the host a super-peer advertises
+func advertisedFrom(address string, r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	if address == host {
+		return true
+	}
+	addrs, err := net.LookupHost(address)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(addrs, host)
+}
+
+// Federation status: every federated super-peer with the number of peers and
+// files it last reported
+func (sp *SuperPeer) getFederationHandler(w http.ResponseWriter, r *http.Request) {
+	sp.federationMutex.RLock()
+	superPeers := make([]map[string]interface{}, 0, len(sp.config.Federation))
+	for _, address := range sp.config.Federation {
+		status := map[string]interface{}{
+			"address":   address,
+			"reachable": !sp.unreachable[address],
+			"peers":     0,
+			"files":     0,
+		}
+		if summary, exists := sp.federation[address]; exists {
+			status["peers"] = len(summary.Peers)
+			status["files"] = len(summary.Files)
+			status["received_at"] = summary.ReceivedAt
+			status["fresh"] = sp.isFresh(summary)
+		}
+		superPeers = append(superPeers, status)
+	}
+	sp.federationMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"address":     sp.config.Address,
+		"super_peers": superPeers,
+	})
 }
 
-func generateFileID(filename, owner string) string {
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", filename, owner, time.Now().Unix())))
-	return fmt.Sprintf("%x", hash)[:16]
+// Summaries older than three gossip rounds are from super-peers that went
+// away and are ignored
+func (sp *SuperPeer) isFresh(summary *FederationSummary) bool {
+	return time.Since(summary.ReceivedAt) < 3*time.Duration(sp.config.GossipInterval)
 }
 
-func matchesSearch(file *FileInfo, query, category string) bool {
-	if category != "" && file.Category != category {
-		return false
+// Current summaries of the federated super-peers
+func (sp *SuperPeer) federatedSummaries() []*FederationSummary {
+	sp.federationMutex.RLock()
+	defer sp.federationMutex.RUnlock()
+
+	var summaries []*FederationSummary
+	for _, summary := range sp.federation {
+		if sp.isFresh(summary) {
+			summaries = append(summaries, summary)
+		}
 	}
+	return summaries
+}
 
-	if query == "" {
-		return true
+// Find a file registered with a federated super-peer
+func (sp *SuperPeer) federatedFile(fileID string) (FileInfo, bool) {
+	for _, summary := range sp.federatedSummaries() {
+		for _, file := range summary.Files {
+			if file.ID == fileID {
+				return file, true
+			}
+		}
+	}
+	return FileInfo{}, false
+}
+
+// Run a search on every federated super-peer. Each returns all its matches
+// (up to the maximum page size), which are merged with ours before paging.
+func (sp *SuperPeer) federatedSearch(req SearchQuery) []SearchResult {
+	req.PageSize = pagination.MaxPageSize
+	req.Cursor = ""
+	req.Limit = 0
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+
+	client := &http.Client{Timeout: federationTimeout}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var results []SearchResult
+	for _, address := range sp.config.Federation {
+		// Do not hold up searches on super-peers known to be down
+		sp.federationMutex.RLock()
+		down := sp.unreachable[address]
+		sp.federationMutex.RUnlock()
+		if down {
+			continue
+		}
+
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+
+			httpReq, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/v1/files/search", address), bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			httpReq.Header.Set("Content-Type", "application/json")
+			httpReq.Header.Set(federatedSearchHeader, sp.config.Address)
+
+			resp, err := client.Do(httpReq)
+			if err != nil {
+				sp.setReachable(address, err)
+				return
+			}
+			defer resp.Body.Close()
+
+			var page struct {
+				Results []SearchResult `json:"results"`
+			}
+			if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&page) != nil {
+				return
+			}
+			mutex.Lock()
+			for _, result := range page.Results {
+				if result.FileInfo == nil {
+					continue
+				}
+				if result.SuperPeer == "" {
+					result.SuperPeer = address
+				}
+				results = append(results, result)
+			}
+			mutex.Unlock()
+		}(address)
 	}
+	wg.Wait()
+	return results
+}
+
+// Cluster
 
-	queryLower := strings.ToLower(query)
-	return strings.Contains(strings.ToLower(file.Filename), queryLower) ||
-		strings.Contains(strings.ToLower(file.Category), queryLower) ||
-		containsTag(file.Tags, queryLower)
+// A mutation of the index store, replicated from the cluster leader to the
+// followers
+type mutation struct {
+	Op     string          `json:"op"` // put or delete
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
 }
 
-func containsTag(tags []string, query string) bool {
-	for _, tag := range tags {
-		if strings.Contains(strings.ToLower(tag), query) {
-			return true
+// POST endpoints that do not modify the index and are served by followers
+var followerPosts = []string{"/api/v1/files/search", "/api/v1/federation/gossip"}
+
+// Cluster service runs leader election and log replication
+func (sp *SuperPeer) clusterService(ctx context.Context) {
+	defer sp.services.Done()
+	sp.raft.Run(ctx)
+}
+
+// Whether this super-peer accepts writes: always when standalone, only as
+// leader when clustered
+func (sp *SuperPeer) isLeader() bool {
+	return sp.raft == nil || sp.raft.IsLeader()
+}
+
+// Apply a committed batch to the store and, unless this super-peer made it
+// and applies it to its in-memory state itself, to the in-memory state
+func (sp *SuperPeer) applyMutation(data []byte, local bool) {
+	var b batch
+	if err := json.Unmarshal(data, &b); err != nil {
+		log.Printf("❌ Invalid replicated batch: %v", err)
+		return
+	}
+
+	for _, m := range b {
+		sp.storeMutation(m)
+	}
+	if local {
+		return
+	}
+
+	sp.lockState()
+	defer sp.unlockState()
+	for _, m := range b {
+		switch m.Op {
+		case "put":
+			if err := sp.loadRecord(m.Bucket, m.Key, m.Value); err != nil {
+				log.Printf("❌ Failed to load replicated %v", err)
+			}
+		case "delete":
+			sp.unloadRecord(m.Bucket, m.Key)
 		}
 	}
-	return false
 }
 
-func sortResults(results []*FileInfo, sortBy string) {
-	switch sortBy {
-	case "name":
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].Filename < results[j].Filename
-		})
-	case "size":
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].Size > results[j].Size
+// Full content of the store, sent to followers too far behind the log
+func (sp *SuperPeer) snapshotState() ([]byte, error) {
+	state := make(map[string]map[string]json.RawMessage)
+	for _, bucket := range storeBuckets {
+		records := make(map[string]json.RawMessage)
+		err := sp.store.ForEach(bucket, func(key string, value json.RawMessage) error {
+			records[key] = value
+			return nil
 		})
-	case "downloads":
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].Downloads > results[j].Downloads
+		if err != nil {
+			return nil, err
+		}
+		state[bucket] = records
+	}
+	return json.Marshal(state)
+}
+
+// Replace the store and in-memory state with a snapshot from the leader
+func (sp *SuperPeer) restoreState(data []byte) error {
+	var state map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	for _, bucket := range storeBuckets {
+		var stale []string
+		err := sp.store.ForEach(bucket, func(key string, value json.RawMessage) error {
+			if _, exists := state[bucket][key]; !exists {
+				stale = append(stale, key)
+			}
+			return nil
 		})
-	case "rating":
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].Rating > results[j].Rating
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			if err := sp.store.Delete(bucket, key); err != nil {
+				return err
+			}
+		}
+		for key, value := range state[bucket] {
+			if err := sp.store.Put(bucket, key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("📸 Restoring index from the cluster leader's snapshot")
+	return sp.loadState()
+}
+
+// Drop writes that were not committed by rebuilding the in-memory state
+// from the store, which only holds committed ones
+func (sp *SuperPeer) reloadState() {
+	log.Printf("♻️ Reloading index after uncommitted writes")
+	if err := sp.loadState(); err != nil {
+		log.Printf("❌ Failed to reload index: %v", err)
+	}
+}
+
+// In a cluster only the leader accepts writes. Followers redirect them to the
+// leader with a 307, which clients follow with the same method and body, or
+// answer 503 while no leader is elected.
+func (sp *SuperPeer) leaderWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			!slices.Contains(followerPosts, r.URL.Path) && !strings.HasPrefix(r.URL.Path, raft.PathPrefix) && !strings.HasPrefix(r.URL.Path, dht.PathPrefix)
+		if !write || sp.isLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A new leader takes writes once it has caught up with the log
+		leader := sp.raft.Leader()
+		if leader == "" || leader == sp.config.Address {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "No cluster leader elected", http.StatusServiceUnavailable)
+			return
+		}
+		target := *r.URL
+		target.Scheme = "http"
+		target.Host = leader
+		http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+	})
+}
+
+// Cluster status: this super-peer's role, the current leader and, on the
+// leader, how far each follower has replicated the log
+func (sp *SuperPeer) getClusterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if sp.raft == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    sp.config.Address,
+			"state": "standalone",
 		})
-	default: // date
-		sort.Slice(results, func(i, j int) bool {
-			return results[i].UploadTime.After(results[j].UploadTime)
+		return
+	}
+	json.NewEncoder(w).Encode(sp.raft.Status())
+}
+
+// DHT
+
+// DHT service keeps the bootstrap node's routing table fresh. Every
+// super-peer of a cluster runs its own node, leader or not.
+func (sp *SuperPeer) dhtService(ctx context.Context) {
+	defer sp.services.Done()
+	sp.dht.Run(ctx)
+}
+
+// DHT status of the bootstrap node
+func (sp *SuperPeer) getDHTHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if sp.dht == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled": false,
 		})
+		return
 	}
+	json.NewEncoder(w).Encode(sp.dht.Status())
 }
 
-// API handlers
-func (sp *SuperPeer) getPeersHandler(w http.ResponseWriter, r *http.Request) {
-	sp.peersMutex.RLock()
-	peers := make([]*Peer, 0, len(sp.peers))
-	for _, peer := range sp.peers {
-		peers = append(peers, peer)
+// Returning peers
+
+// A peer that replaced its key registers with a succession proof signed by
+// the old key. The records of the old ID are merged into the new one:
+// transfer counts, reputation, file ownership and reviews. Nothing is merged
+// without the proof, so no peer can take over another's records. All of it
+// is saved as one batch.
+func (sp *SuperPeer) mergePreviousRecords(peerID, previousID string) {
+	var b batch
+	sp.peersMutex.Lock()
+	peer, exists := sp.peers[peerID]
+	old, known := sp.peers[previousID]
+	if !exists || !known || previousID == peerID {
+		sp.peersMutex.Unlock()
+		return // Nothing left to merge
 	}
-	sp.peersMutex.RUnlock()
+	peer.Transfers.UploadsCompleted += old.Transfers.UploadsCompleted
+	peer.Transfers.UploadsFailed += old.Transfers.UploadsFailed
+	peer.Transfers.BytesServed += old.Transfers.BytesServed
+	if uploads := peer.Transfers.UploadsCompleted + peer.Transfers.UploadsFailed; uploads > 0 {
+		peer.Transfers.SuccessRate = float64(peer.Transfers.UploadsCompleted) / float64(uploads) * 100
+	}
+	delete(sp.peers, previousID)
+	b.delete(peersBucket, previousID)
+	b.put(peersBucket, peerID, peer)
+	sp.peersMutex.Unlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(peers)
+	now := time.Now()
+	b.put(reputationBucket, peerID, sp.reputation.Merge(previousID, peerID, now))
+	b.delete(reputationBucket, previousID)
+
+	// Files keep working under their old IDs for the migration window
+	expires := now.Add(time.Duration(sp.config.IDMigration))
+	files := 0
+	sp.filesMutex.Lock()
+	for _, file := range sp.files {
+		if file.Owner == previousID {
+			sp.rekeyFile(&b, file, peerID, expires)
+			files++
+		}
+	}
+	sp.filesMutex.Unlock()
+
+	// One vote per peer: the earlier identity's vote only counts where the
+	// peer has not voted again
+	var rated []string
+	sp.ratingsMutex.Lock()
+	for hash, votes := range sp.ratings {
+		review, voted := votes[previousID]
+		if !voted {
+			continue
+		}
+		delete(votes, previousID)
+		b.delete(ratingsBucket, hash+"/"+previousID)
+		if _, revoted := votes[peerID]; !revoted {
+			review.PeerID = peerID
+			votes[peerID] = review
+			b.put(ratingsBucket, hash+"/"+peerID, review)
+		}
+		rated = append(rated, hash)
+	}
+	sp.ratingsMutex.Unlock()
+	for _, hash := range rated {
+		sp.copyRatings(&b, hash)
+	}
+	if err := sp.save(b); err != nil {
+		return
+	}
+
+	log.Printf("🔗 Merged the records of peer %s into %s (%d files)", previousID, peerID, files)
 }
 
-func (sp *SuperPeer) getFilesHandler(w http.ResponseWriter, r *http.Request) {
+// File ID migration
+
+// Re-key file records stored before IDs were derived from content hash,
+// owner and path. The old IDs stay resolvable as aliases for the migration
+// window. In a cluster the leader runs it, so the new records are committed
+// like any other write.
+func (sp *SuperPeer) migrateFileIDs() {
 	sp.filesMutex.RLock()
-	files := make([]*FileInfo, 0, len(sp.files))
-	for _, file := range sp.files {
-		files = append(files, file)
+	var stale []*FileInfo
+	for id, file := range sp.files {
+		if id != fileid.Derive(file.Hash, file.Owner, recordPath(file)) {
+			stale = append(stale, file)
+		}
 	}
 	sp.filesMutex.RUnlock()
+	if len(stale) == 0 {
+		return
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(files)
+	var b batch
+	sp.filesMutex.Lock()
+	stale = slices.DeleteFunc(stale, func(file *FileInfo) bool {
+		return sp.files[file.ID] != file
+	})
+	expires := time.Now().Add(time.Duration(sp.config.IDMigration))
+	for _, file := range stale {
+		sp.rekeyFile(&b, file, file.Owner, expires)
+	}
+	sp.filesMutex.Unlock()
+	if len(stale) == 0 || sp.save(b) != nil {
+		return
+	}
+
+	if sp.config.IDMigration > 0 {
+		log.Printf("🔀 Migrated %d file records to content-derived IDs, old IDs redirect until %s",
+			len(stale), expires.Format(time.RFC3339))
+	} else {
+		log.Printf("🔀 Migrated %d file records to content-derived IDs", len(stale))
+	}
 }
 
-func (sp *SuperPeer) getStatsHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sp.stats)
+// Move a file record to the ID of its content hash, path and a new owner,
+// leaving an alias behind until expires. A record the owner already
+// registered under the new ID is kept and the old one dropped. The caller
+// holds filesMutex and saves the writes added to b.
+func (sp *SuperPeer) rekeyFile(b *batch, file *FileInfo, owner string, expires time.Time) {
+	oldID := file.ID
+	sp.removeReplica(file)
+	sp.index.Remove(oldID)
+	delete(sp.files, oldID)
+	b.delete(filesBucket, oldID)
+
+	file.Owner = owner
+	file.Path = recordPath(file)
+	file.ID = fileid.Derive(file.Hash, owner, file.Path)
+	if _, exists := sp.files[file.ID]; !exists {
+		sp.files[file.ID] = file
+		sp.addReplica(file)
+		sp.indexFile(file)
+		b.put(filesBucket, file.ID, file)
+	}
+
+	if sp.config.IDMigration > 0 {
+		alias := &FileAlias{ID: oldID, FileID: file.ID, Expires: expires}
+		sp.aliases[oldID] = alias
+		b.put(aliasesBucket, oldID, alias)
+	}
+	// Aliases left by an earlier migration follow the record
+	for id, alias := range sp.aliases {
+		if alias.FileID == oldID && id != oldID {
+			alias.FileID = file.ID
+			b.put(aliasesBucket, id, alias)
+		}
+	}
 }
 
-func (sp *SuperPeer) downloadHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	fileID := vars["fileId"]
+// Path a file record is shared at. Records of legacy peers, which share a
+// flat directory, may only have a filename.
+func recordPath(file *FileInfo) string {
+	if file.Path == "" {
+		return file.Filename
+	}
+	return file.Path
+}
+
+// The current ID of a file known by a pre-migration ID
+func (sp *SuperPeer) resolveAlias(id string) (string, bool) {
+	sp.filesMutex.RLock()
+	defer sp.filesMutex.RUnlock()
 
+	alias, exists := sp.aliases[id]
+	if !exists || time.Now().After(alias.Expires) {
+		return "", false
+	}
+	_, current := sp.files[alias.FileID]
+	return alias.FileID, current
+}
+
+// Drop aliases once the migration window is over
+func (sp *SuperPeer) expireAliases() {
+	var b batch
+	now := time.Now()
 	sp.filesMutex.Lock()
-	file, exists := sp.files[fileID]
-	if exists {
-		file.Downloads++
+	for id, alias := range sp.aliases {
+		if now.After(alias.Expires) {
+			delete(sp.aliases, id)
+			b.delete(aliasesBucket, id)
+		}
 	}
 	sp.filesMutex.Unlock()
 
-	if !exists {
-		http.Error(w, "File not found", http.StatusNotFound)
+	sp.save(b)
+}
+
+// Replica selection
+
+type replicaCandidate struct {
+	file  FileInfo
+	score float64
+}
+
+// Track a new file in the replica set of its content hash
+func (sp *SuperPeer) addReplica(file *FileInfo) {
+	if file.Hash == "" {
 		return
 	}
+	if sp.replicas[file.Hash] == nil {
+		sp.replicas[file.Hash] = make(map[string]bool)
+	}
+	sp.replicas[file.Hash][file.ID] = true
+}
+
+// Drop a removed file from the replica set of its content hash
+func (sp *SuperPeer) removeReplica(file *FileInfo) {
+	delete(sp.replicas[file.Hash], file.ID)
+	if len(sp.replicas[file.Hash]) == 0 {
+		delete(sp.replicas, file.Hash)
+	}
+}
+
+// Rank the online replicas of a content hash by reputation, region, current
+// load and recent failures, best first
+func (sp *SuperPeer) rankReplicas(hash, region string) []replicaCandidate {
+	sp.filesMutex.RLock()
+	var files []FileInfo
+	for fileID := range sp.replicas[hash] {
+		if file, exists := sp.files[fileID]; exists && file.Available {
+			files = append(files, *file)
+		}
+	}
+	sp.filesMutex.RUnlock()
+
+	sp.peersMutex.RLock()
+	candidates := make([]replicaCandidate, 0, len(files))
+	for _, file := range files {
+		owner, known := sp.peers[file.Owner]
+		if known && !owner.IsOnline {
+			continue
+		}
+
+		score := 50.0 // Neutral score for owners we know nothing about
+		if known {
+			score = float64(owner.Reputation)
+			if region != "" && owner.Region == region {
+				score += regionBonus
+			}
+		}
+		candidates = append(candidates, replicaCandidate{file: file, score: score})
+	}
+
+	// Replicas registered with federated super-peers, unless the owner has
+	// since moved to us
+	for _, summary := range sp.federatedSummaries() {
+		owners := make(map[string]Peer, len(summary.Peers))
+		for _, peer := range summary.Peers {
+			owners[peer.ID] = peer
+		}
+		for _, file := range summary.Files {
+			owner, online := owners[file.Owner]
+			if file.Hash != hash || !online {
+				continue
+			}
+			if local, known := sp.peers[file.Owner]; known && local.IsOnline {
+				continue
+			}
+			score := float64(owner.Reputation)
+			if region != "" && owner.Region == region {
+				score += regionBonus
+			}
+			candidates = append(candidates, replicaCandidate{file: file, score: score})
+		}
+	}
+	sp.peersMutex.RUnlock()
+
+	sp.routingMutex.Lock()
+	now := time.Now()
+	for i := range candidates {
+		owner := candidates[i].file.Owner
+		candidates[i].score -= loadPenalty * float64(countRecent(sp.peerLoad, owner, now.Add(-loadWindow)))
+		candidates[i].score -= failurePenalty * float64(countRecent(sp.peerFailures, owner, now.Add(-failureWindow)))
+	}
+	sp.routingMutex.Unlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].file.Downloads < candidates[j].file.Downloads
+	})
+	return candidates
+}
+
+func (sp *SuperPeer) recordLoad(peerID string) {
+	sp.routingMutex.Lock()
+	sp.peerLoad[peerID] = append(sp.peerLoad[peerID], time.Now())
+	sp.routingMutex.Unlock()
+}
+
+func (sp *SuperPeer) recordFailure(peerID string) {
+	sp.routingMutex.Lock()
+	sp.peerFailures[peerID] = append(sp.peerFailures[peerID], time.Now())
+	sp.routingMutex.Unlock()
+}
+
+// Forget peer reports old enough to be repeated
+func (sp *SuperPeer) expireReports() {
+	sp.routingMutex.Lock()
+	defer sp.routingMutex.Unlock()
+
+	cutoff := time.Now().Add(-reportWindow)
+	for key, last := range sp.peerReports {
+		if last.Before(cutoff) {
+			delete(sp.peerReports, key)
+		}
+	}
+}
+
+// Count the events of a peer since cutoff, dropping older ones
+func countRecent(events map[string][]time.Time, peerID string, cutoff time.Time) int {
+	recent := events[peerID][:0]
+	for _, t := range events[peerID] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(events, peerID)
+	} else {
+		events[peerID] = recent
+	}
+	return len(recent)
+}
+
+// Check that a peer accepts connections before redirecting a client to it
+func probePeer(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
 
-	// Redirect to peer for actual download
-	downloadURL := fmt.Sprintf("http://%s/download?filename=%s", file.PeerAddress, file.Filename)
-	http.Redirect(w, r, downloadURL, http.StatusFound)
+// Region of the requesting client, used to prefer nearby replicas
+func clientRegion(r *http.Request) string {
+	if region := r.URL.Query().Get("region"); region != "" {
+		return region
+	}
+	return r.Header.Get("X-Peer-Region")
 }
 
 func (sp *SuperPeer) serveHomePage(w http.ResponseWriter, r *http.Request) {
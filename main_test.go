@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"sp/identity"
+	"sp/reputation"
+	"sp/search"
+	"sp/storage"
+)
+
+func newTestSuperPeer() *SuperPeer {
+	return &SuperPeer{
+		peers:         make(map[string]*Peer),
+		files:         make(map[string]*FileInfo),
+		wsConnections: make(map[*websocket.Conn]bool),
+		store:         storage.NewMemoryStore(),
+		index:         search.NewIndex(),
+		ratings:       make(map[string]map[string]*Review),
+		completions:   make(map[string]bool),
+		replicas:      make(map[string]map[string]bool),
+		peerLoad:      make(map[string][]time.Time),
+		peerFailures:  make(map[string][]time.Time),
+		peerReports:   make(map[string]time.Time),
+		seenPersisted: make(map[string]time.Time),
+		uptimeStored:  make(map[string]time.Time),
+		reputation:    reputation.NewEngine(7 * 24 * time.Hour),
+		nonces:        identity.NewNonces(),
+	}
+}
+
+func (sp *SuperPeer) addTestPeer(id, region string, reputation int, online bool) {
+	sp.peers[id] = &Peer{ID: id, Region: region, Reputation: reputation, IsOnline: online}
+}
+
+func (sp *SuperPeer) addTestFile(id, hash, owner, address string) *FileInfo {
+	file := &FileInfo{ID: id, Filename: id + ".txt", Hash: hash, Owner: owner, PeerAddress: address, Available: true}
+	sp.files[id] = file
+	sp.addReplica(file)
+	return file
+}
+
+func rankedOwners(candidates []replicaCandidate) string {
+	owners := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		owners[i] = candidate.file.Owner
+	}
+	return strings.Join(owners, ",")
+}
+
+func TestRankReplicas(t *testing.T) {
+	sp := newTestSuperPeer()
+	sp.addTestPeer("a", "eu", 60, true)
+	sp.addTestPeer("b", "us", 70, true)
+	sp.addTestPeer("c", "eu", 90, false)
+	sp.addTestFile("fa", "h", "a", "")
+	sp.addTestFile("fb", "h", "b", "")
+	sp.addTestFile("fc", "h", "c", "")
+	sp.addTestFile("other", "h2", "c", "")
+	sp.addTestPeer("d", "eu", 100, true)
+	sp.addTestFile("fd", "h", "d", "").Available = false
+
+	if got := rankedOwners(sp.rankReplicas("h", "")); got != "b,a" {
+		t.Errorf("by reputation: got %s, want b,a", got)
+	}
+	if got := rankedOwners(sp.rankReplicas("h", "eu")); got != "a,b" {
+		t.Errorf("same region first: got %s, want a,b", got)
+	}
+
+	// Recent redirects and failures count against a peer
+	for i := 0; i < 3; i++ {
+		sp.recordLoad("b")
+	}
+	if got := rankedOwners(sp.rankReplicas("h", "")); got != "a,b" {
+		t.Errorf("with b loaded: got %s, want a,b", got)
+	}
+	sp.recordFailure("a")
+	if got := rankedOwners(sp.rankReplicas("h", "")); got != "b,a" {
+		t.Errorf("with a failing: got %s, want b,a", got)
+	}
+}
+
+func TestCountRecent(t *testing.T) {
+	now := time.Now()
+	events := map[string][]time.Time{"a": {now.Add(-2 * time.Minute), now}, "b": {now.Add(-time.Hour)}}
+
+	if n := countRecent(events, "a", now.Add(-time.Minute)); n != 1 || len(events["a"]) != 1 {
+		t.Fatalf("got %d recent events, %d kept", n, len(events["a"]))
+	}
+	if n := countRecent(events, "b", now.Add(-time.Minute)); n != 0 {
+		t.Fatalf("got %d recent events, want 0", n)
+	}
+	if _, kept := events["b"]; kept {
+		t.Fatal("peer without recent events was kept")
+	}
+}
+
+func TestDownloadSkipsUnreachableReplicas(t *testing.T) {
+	reachable := httptest.NewServer(http.NotFoundHandler())
+	defer reachable.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	sp := newTestSuperPeer()
+	sp.addTestPeer("a", "", 90, true)
+	sp.addTestPeer("b", "", 50, true)
+	sp.addTestFile("fa", "h", "a", unreachable)
+	file := sp.addTestFile("fb", "h", "b", strings.TrimPrefix(reachable.URL, "http://"))
+
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/api/v1/download/fb", nil), map[string]string{"fileId": "fb"})
+	w := httptest.NewRecorder()
+	sp.downloadHandler(w, r)
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %d, want a redirect", w.Code)
+	}
+	if want := reachable.URL + "/api/v1/content/h"; w.Header().Get("Location") != want {
+		t.Fatalf("redirected to %s, want %s", w.Header().Get("Location"), want)
+	}
+	if len(sp.peerFailures["a"]) != 1 || len(sp.peerLoad["b"]) != 1 {
+		t.Fatalf("failures %v, load %v", sp.peerFailures, sp.peerLoad)
+	}
+	// Downloads are counted from completion reports, not redirects
+	if file.Downloads != 0 {
+		t.Fatalf("counted %d downloads on redirect", file.Downloads)
+	}
+
+	// With no reachable replica left the download is refused
+	sp.peers["b"].IsOnline = false
+	w = httptest.NewRecorder()
+	sp.downloadHandler(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want 503", w.Code)
+	}
+}
+
+// Ratings
+
+// Register a peer with a fresh identity, for signed requests
+func (sp *SuperPeer) addSignedPeer(t *testing.T) *identity.Identity {
+	t.Helper()
+	id, err := identity.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.peers[id.ID] = &Peer{ID: id.ID, PublicKey: identity.EncodePublicKey(id.PublicKey), IsOnline: true}
+	return id
+}
+
+func rateFile(sp *SuperPeer, id *identity.Identity, hash, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/files/ratings/"+hash, strings.NewReader(body))
+	if id != nil {
+		id.Sign(r, []byte(body))
+	}
+	r = mux.SetURLVars(r, map[string]string{"hash": hash})
+	w := httptest.NewRecorder()
+	sp.rateFileHandler(w, r)
+	return w
+}
+
+func TestRateFile(t *testing.T) {
+	sp := newTestSuperPeer()
+	owner := sp.addSignedPeer(t)
+	alice := sp.addSignedPeer(t)
+	bob := sp.addSignedPeer(t)
+	file := sp.addTestFile("f", "h", owner.ID, "")
+	replica := sp.addTestFile("g", "h", "other", "")
+
+	tests := []struct {
+		name   string
+		id     *identity.Identity
+		hash   string
+		body   string
+		status int
+	}{
+		{"unsigned", nil, "h", `{"rating":4}`, http.StatusBadRequest},
+		{"unknown content", alice, "missing", `{"rating":4}`, http.StatusNotFound},
+		{"own content", owner, "h", `{"rating":5}`, http.StatusForbidden},
+		{"too low", alice, "h", `{"rating":0}`, http.StatusBadRequest},
+		{"too high", alice, "h", `{"rating":6}`, http.StatusBadRequest},
+		{"comment too long", alice, "h", `{"rating":3,"comment":"` + strings.Repeat("x", maxCommentLength+1) + `"}`, http.StatusBadRequest},
+		{"not JSON", alice, "h", `rating=4`, http.StatusBadRequest},
+		{"alice", alice, "h", `{"rating":2,"comment":"  meh  "}`, http.StatusOK},
+		{"bob", bob, "h", `{"rating":5}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := rateFile(sp, tt.id, tt.hash, tt.body); w.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+
+	// Every replica carries the aggregate
+	for _, f := range []*FileInfo{file, replica} {
+		if f.Rating != 3.5 || f.RatingCount != 2 || len(f.Reviews) != 2 {
+			t.Errorf("%s: rating %v from %d votes, %d reviews", f.ID, f.Rating, f.RatingCount, len(f.Reviews))
+		}
+	}
+	if review := sp.ratings["h"][alice.ID]; review == nil || review.Comment != "meh" {
+		t.Errorf("alice's review: %+v", review)
+	}
+
+	// Rating again replaces the earlier vote
+	w := rateFile(sp, alice, "h", `{"rating":4}`)
+	var resp struct {
+		Rating      float64 `json:"rating"`
+		RatingCount int     `json:"rating_count"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rating != 4.5 || resp.RatingCount != 2 || file.Rating != 4.5 {
+		t.Errorf("after re-rating: %+v, file rating %v", resp, file.Rating)
+	}
+}
+
+func TestRateFileRejectsReplay(t *testing.T) {
+	sp := newTestSuperPeer()
+	owner := sp.addSignedPeer(t)
+	alice := sp.addSignedPeer(t)
+	sp.addTestFile("f", "h", owner.ID, "")
+
+	body := `{"rating":1}`
+	signed := httptest.NewRequest("POST", "/api/v1/files/ratings/h", nil)
+	alice.Sign(signed, []byte(body))
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		r := httptest.NewRequest("POST", "/api/v1/files/ratings/h", strings.NewReader(body))
+		r.Header = signed.Header.Clone()
+		w := httptest.NewRecorder()
+		sp.rateFileHandler(w, mux.SetURLVars(r, map[string]string{"hash": "h"}))
+		if w.Code != want {
+			t.Fatalf("attempt %d: got status %d, want %d: %s", i+1, w.Code, want, w.Body)
+		}
+	}
+	if count := len(sp.ratings["h"]); count != 1 {
+		t.Fatalf("got %d votes, want 1", count)
+	}
+}
+
+func TestRatingsReload(t *testing.T) {
+	sp := newTestSuperPeer()
+	owner := sp.addSignedPeer(t)
+	alice := sp.addSignedPeer(t)
+	sp.addTestFile("f", "h", owner.ID, "")
+	if w := rateFile(sp, alice, "h", `{"rating":4,"comment":"good"}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+
+	reloaded := newTestSuperPeer()
+	reloaded.store = sp.store
+	if err := reloaded.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	review := reloaded.ratings["h"][alice.ID]
+	if review == nil || review.Rating != 4 || review.Comment != "good" {
+		t.Fatalf("reloaded review: %+v", review)
+	}
+	if rating, count, _ := reloaded.ratingSummary("h"); rating != 4 || count != 1 {
+		t.Errorf("reloaded summary: %v from %d votes", rating, count)
+	}
+}
+
+func TestRatingSummaryKeepsRecentReviews(t *testing.T) {
+	sp := newTestSuperPeer()
+	if rating, count, reviews := sp.ratingSummary("h"); rating != 0 || count != 0 || reviews != nil {
+		t.Fatalf("unrated content: %v, %d, %v", rating, count, reviews)
+	}
+
+	start := time.Now()
+	sp.ratings["h"] = make(map[string]*Review)
+	for i := 0; i < maxRecentReviews+2; i++ {
+		peerID := string(rune('a' + i))
+		sp.ratings["h"][peerID] = &Review{Hash: "h", PeerID: peerID, Rating: i%5 + 1, CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+	}
+
+	rating, count, reviews := sp.ratingSummary("h")
+	if count != maxRecentReviews+2 || rating != 18.0/7 {
+		t.Errorf("got %v from %d votes", rating, count)
+	}
+	if len(reviews) != maxRecentReviews || reviews[0].PeerID != "g" || reviews[maxRecentReviews-1].PeerID != "c" {
+		t.Errorf("recent reviews: %+v", reviews)
+	}
+}
+
+func TestGetFileRatingsPages(t *testing.T) {
+	sp := newTestSuperPeer()
+	start := time.Now()
+	sp.ratings["h"] = map[string]*Review{
+		"a": {Hash: "h", PeerID: "a", Rating: 5, CreatedAt: start},
+		"b": {Hash: "h", PeerID: "b", Rating: 3, CreatedAt: start.Add(time.Minute)},
+		"c": {Hash: "h", PeerID: "c", Rating: 1, CreatedAt: start},
+	}
+
+	var walked []string
+	cursor := ""
+	for pages := 0; pages < 3; pages++ {
+		r := httptest.NewRequest("GET", "/api/v1/files/ratings/h?page_size=2&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		sp.getFileRatingsHandler(w, mux.SetURLVars(r, map[string]string{"hash": "h"}))
+
+		var resp struct {
+			Rating      float64  `json:"rating"`
+			RatingCount int      `json:"rating_count"`
+			Reviews     []Review `json:"reviews"`
+			Total       int      `json:"total"`
+			NextCursor  string   `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Rating != 3 || resp.RatingCount != 3 || resp.Total != 3 {
+			t.Fatalf("got %+v", resp)
+		}
+		for _, review := range resp.Reviews {
+			walked = append(walked, review.PeerID)
+		}
+		if cursor = resp.NextCursor; cursor == "" {
+			break
+		}
+	}
+	// Most recent first, ties by peer ID
+	if got := strings.Join(walked, ","); got != "b,a,c" {
+		t.Errorf("got reviews %s, want b,a,c", got)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/files/ratings/h?page_size=0", nil)
+	w := httptest.NewRecorder()
+	sp.getFileRatingsHandler(w, mux.SetURLVars(r, map[string]string{"hash": "h"}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("page_size=0: got status %d", w.Code)
+	}
+}
+
+// Download reports
+
+func reportDownload(sp *SuperPeer, id *identity.Identity, report string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/v1/downloads/report", strings.NewReader(report))
+	id.Sign(r, []byte(report))
+	w := httptest.NewRecorder()
+	sp.reportDownloadHandler(w, r)
+	return w
+}
+
+func reportCounted(t *testing.T, w *httptest.ResponseRecorder) bool {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Counted bool `json:"counted"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Counted
+}
+
+func TestReportDownloadCountsOncePerDownloader(t *testing.T) {
+	sp := newTestSuperPeer()
+	a := sp.addSignedPeer(t)
+	b := sp.addSignedPeer(t)
+	alice := sp.addSignedPeer(t)
+	bob := sp.addSignedPeer(t)
+	fa := sp.addTestFile("fa", "h", a.ID, "")
+	fb := sp.addTestFile("fb", "h", b.ID, "")
+	fa.Size, fb.Size = 100, 100
+
+	// Without a file ID the download counts for the replica that sent most
+	report := `{"hash":"h","status":"completed","verified":true,"sources":[` +
+		`{"peer_id":"` + a.ID + `","bytes":10},{"peer_id":"` + b.ID + `","bytes":30}]}`
+	if !reportCounted(t, reportDownload(sp, alice, report)) {
+		t.Fatal("completed download not counted")
+	}
+	if fa.Downloads != 0 || fb.Downloads != 1 {
+		t.Fatalf("downloads %d, %d, want 0, 1", fa.Downloads, fb.Downloads)
+	}
+
+	// The same downloader is counted once per content
+	if reportCounted(t, reportDownload(sp, alice, report)) || fb.Downloads != 1 {
+		t.Fatalf("repeated report counted, %d downloads", fb.Downloads)
+	}
+
+	// Unverified and failed downloads are not counted
+	for _, status := range []string{
+		`{"hash":"h","status":"completed","verified":false}`,
+		`{"hash":"h","status":"failed","verified":true}`,
+	} {
+		if reportCounted(t, reportDownload(sp, bob, status)) {
+			t.Errorf("%s counted", status)
+		}
+	}
+
+	// A reported file ID takes precedence
+	if !reportCounted(t, reportDownload(sp, bob, `{"hash":"h","file_id":"fa","status":"completed","verified":true}`)) || fa.Downloads != 1 {
+		t.Fatalf("download for fa not counted, %d downloads", fa.Downloads)
+	}
+	if sp.stats.TotalDownloads != 2 {
+		t.Errorf("stats count %d downloads, want 2", sp.stats.TotalDownloads)
+	}
+
+	// Counted downloads survive a restart
+	reloaded := newTestSuperPeer()
+	reloaded.store = sp.store
+	if err := reloaded.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.completions["h/"+alice.ID] || !reloaded.completions["h/"+bob.ID] {
+		t.Errorf("completions after reload: %v", reloaded.completions)
+	}
+}
+
+func TestReportDownloadSources(t *testing.T) {
+	sp := newTestSuperPeer()
+	a := sp.addSignedPeer(t)
+	b := sp.addSignedPeer(t)
+	stranger := sp.addSignedPeer(t)
+	alice := sp.addSignedPeer(t)
+	file := sp.addTestFile("fa", "h", a.ID, "")
+	file.Size = 100
+	file.PieceHashes = []string{"p0", "p1"}
+	sp.addTestFile("fb", "h", b.ID, "")
+
+	// a is listed twice and merged, capped at the file size; b only failed;
+	// the stranger holds no replica and is ignored
+	report := `{"hash":"h","status":"completed","verified":true,"sources":[` +
+		`{"peer_id":"` + a.ID + `","bytes":80,"pieces":2},` +
+		`{"peer_id":"` + a.ID + `","bytes":80,"pieces":2},` +
+		`{"peer_id":"` + b.ID + `","failures":3},` +
+		`{"peer_id":"` + stranger.ID + `","bytes":50}]}`
+	reportCounted(t, reportDownload(sp, alice, report))
+
+	if got := sp.peers[a.ID].Transfers; got.UploadsCompleted != 1 || got.BytesServed != 100 || got.SuccessRate != 100 {
+		t.Errorf("a: %+v", got)
+	}
+	if got := sp.peers[b.ID].Transfers; got.UploadsFailed != 1 || got.UploadsCompleted != 0 || got.SuccessRate != 0 {
+		t.Errorf("b: %+v", got)
+	}
+	if got := sp.peers[stranger.ID].Transfers; got != (TransferStats{}) {
+		t.Errorf("stranger: %+v", got)
+	}
+
+	// Both outcomes count towards reputation
+	if stats, _ := sp.reputation.Stats(a.ID, time.Now()); stats.Successes == 0 {
+		t.Errorf("a's reputation has no successful downloads: %+v", stats)
+	}
+	if stats, _ := sp.reputation.Stats(b.ID, time.Now()); stats.Failures == 0 {
+		t.Errorf("b's reputation has no failed downloads: %+v", stats)
+	}
+
+	tests := []struct {
+		name   string
+		report string
+	}{
+		{"no hash", `{"status":"completed"}`},
+		{"unknown status", `{"hash":"h","status":"done"}`},
+		{"negative bytes", `{"hash":"h","status":"completed","bytes":-1}`},
+		{"negative source", `{"hash":"h","status":"failed","sources":[{"peer_id":"` + a.ID + `","failures":-1}]}`},
+		{"own source", `{"hash":"h","status":"completed","sources":[{"peer_id":"` + alice.ID + `","bytes":1}]}`},
+		{"not JSON", `hash=h`},
+	}
+	for _, tt := range tests {
+		if w := reportDownload(sp, alice, tt.report); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", tt.name, w.Code)
+		}
+	}
+}
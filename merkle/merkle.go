@@ -0,0 +1,137 @@
+// Package merkle builds SHA-256 Merkle trees over the piece hashes of a file.
+//
+// Piece hashes are the hex-encoded SHA-256 hashes of each piece. A leaf is the
+// SHA-256 of a 0x00 byte and the piece hash, an interior node the SHA-256 of a
+// 0x01 byte and its two children concatenated, so a leaf can never pass for an
+// interior node or the other way round. A node without a sibling is promoted
+// to the next level unchanged. The root of a file without pieces is the
+// SHA-256 of the empty string.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Prefixes separating leaves from interior nodes
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// ProofNode is one sibling hash on the path from a leaf to the root.
+type ProofNode struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // sibling is on the left of the path
+}
+
+// Root computes the Merkle root of the given piece hashes.
+func Root(pieceHashes []string) (string, error) {
+	levels, err := build(pieceHashes)
+	if err != nil {
+		return "", err
+	}
+	top := levels[len(levels)-1]
+	return hex.EncodeToString(top[0]), nil
+}
+
+// Proof returns the inclusion proof for the piece at index.
+func Proof(pieceHashes []string, index int) ([]ProofNode, error) {
+	if index < 0 || index >= len(pieceHashes) {
+		return nil, fmt.Errorf("piece index %d out of range", index)
+	}
+
+	levels, err := build(pieceHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := []ProofNode{}
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, ProofNode{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < index,
+			})
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// Verify checks that pieceHash is included under root according to proof.
+func Verify(root, pieceHash string, proof []ProofNode) bool {
+	piece, err := hex.DecodeString(pieceHash)
+	if err != nil || len(piece) != sha256.Size {
+		return false
+	}
+	node := hashLeaf(piece)
+
+	for _, sibling := range proof {
+		siblingHash, err := hex.DecodeString(sibling.Hash)
+		if err != nil {
+			return false
+		}
+		if sibling.Left {
+			node = hashPair(siblingHash, node)
+		} else {
+			node = hashPair(node, siblingHash)
+		}
+	}
+	return hex.EncodeToString(node) == root
+}
+
+// HashPiece returns the leaf hash of a piece's contents.
+func HashPiece(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// build returns every level of the tree, leaves first and root last.
+func build(pieceHashes []string) ([][][]byte, error) {
+	if len(pieceHashes) == 0 {
+		empty := sha256.Sum256(nil)
+		return [][][]byte{{empty[:]}}, nil
+	}
+
+	level := make([][]byte, len(pieceHashes))
+	for i, h := range pieceHashes {
+		piece, err := hex.DecodeString(h)
+		if err != nil || len(piece) != sha256.Size {
+			return nil, fmt.Errorf("invalid piece hash %d", i)
+		}
+		level[i] = hashLeaf(piece)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, hashPair(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, nil
+}
+
+func hashLeaf(pieceHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(pieceHash)
+	return h.Sum(nil)
+}
+
+func hashPair(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{nodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
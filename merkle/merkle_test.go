@@ -0,0 +1,132 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func pieces(n int) []string {
+	hashes := make([]string, n)
+	for i := range hashes {
+		hashes[i] = HashPiece([]byte(fmt.Sprintf("piece %d", i)))
+	}
+	return hashes
+}
+
+func hexHash(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func decode(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRootLayout(t *testing.T) {
+	hashes := pieces(3)
+	leaf := func(i int) []byte { return decode(t, hexHash([]byte{0x00}, decode(t, hashes[i]))) }
+	pair := decode(t, hexHash([]byte{0x01}, leaf(0), leaf(1)))
+
+	tests := []struct {
+		name   string
+		hashes []string
+		want   string
+	}{
+		{"no pieces", nil, hexHash()},
+		{"single piece", hashes[:1], hex.EncodeToString(leaf(0))},
+		{"two pieces", hashes[:2], hex.EncodeToString(pair)},
+		// The third leaf has no sibling and is promoted unchanged
+		{"odd count", hashes, hexHash([]byte{0x01}, pair, leaf(2))},
+	}
+	for _, tt := range tests {
+		got, err := Root(tt.hashes)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got root %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRootRejectsInvalidHashes(t *testing.T) {
+	for _, hashes := range [][]string{{"zz"}, {"abcd"}, {HashPiece(nil), ""}} {
+		if _, err := Root(hashes); err == nil {
+			t.Errorf("accepted piece hashes %q", hashes)
+		}
+	}
+}
+
+func TestProofVerifies(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 13} {
+		hashes := pieces(n)
+		root, err := Root(hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range hashes {
+			proof, err := Proof(hashes, i)
+			if err != nil {
+				t.Fatalf("%d pieces, piece %d: %v", n, i, err)
+			}
+			if !Verify(root, hashes[i], proof) {
+				t.Errorf("%d pieces: proof of piece %d does not verify", n, i)
+			}
+			if Verify(root, hashes[(i+1)%n], proof) && n > 1 {
+				t.Errorf("%d pieces: proof of piece %d verifies another piece", n, i)
+			}
+		}
+	}
+}
+
+func TestProofOutOfRange(t *testing.T) {
+	hashes := pieces(3)
+	for _, index := range []int{-1, 3} {
+		if _, err := Proof(hashes, index); err == nil {
+			t.Errorf("got a proof for piece %d of 3", index)
+		}
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	hashes := pieces(4)
+	root, _ := Root(hashes)
+	proof, _ := Proof(hashes, 2)
+
+	flipped := append([]ProofNode(nil), proof...)
+	flipped[0].Left = !flipped[0].Left
+	if Verify(root, hashes[2], flipped) {
+		t.Error("verified a proof with a sibling on the wrong side")
+	}
+	if Verify(root, hashes[2], proof[:1]) {
+		t.Error("verified a truncated proof")
+	}
+	if Verify(root, "not hex", proof) {
+		t.Error("verified an invalid piece hash")
+	}
+}
+
+func TestInteriorNodeIsNotALeaf(t *testing.T) {
+	// Without domain separation the two leaf hashes of a pair would make up a
+	// one-piece "file" whose piece hash is the pair's node and share its root
+	hashes := pieces(2)
+	root, _ := Root(hashes)
+	levels, _ := build(hashes)
+	node := hex.EncodeToString(levels[1][0])
+	if forged, _ := Root([]string{node}); forged == root {
+		t.Fatal("an interior node passes as a leaf")
+	}
+	if Verify(root, node, nil) {
+		t.Fatal("an interior node verifies as a piece")
+	}
+}
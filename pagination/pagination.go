@@ -0,0 +1,159 @@
+// Package pagination implements cursor-based pagination for list endpoints.
+//
+// Lists are sorted in a stable total order and a page ends with an opaque
+// cursor encoding the sort position of its last item. The next page starts
+// right after that position, so walking a list that changes in between never
+// repeats or skips items that stayed in place.
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Page size limits
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// ErrInvalidCursor is returned for cursors that were not issued by Paginate.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Page is one page of a list.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`
+	PageSize   int    `json:"page_size"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Params selects a page: up to PageSize items after the position encoded in
+// Cursor. A zero PageSize means DefaultPageSize; an empty Cursor means the
+// first page.
+type Params struct {
+	PageSize int    `json:"page_size"`
+	Cursor   string `json:"cursor"`
+}
+
+// Requested reports whether the request asks for a page, via the page_size
+// or cursor parameters.
+func Requested(r *http.Request) bool {
+	params := r.URL.Query()
+	return params.Has("page_size") || params.Has("cursor")
+}
+
+// ParseParams reads the page_size and cursor parameters of r.
+func ParseParams(r *http.Request) (Params, error) {
+	params := Params{Cursor: r.URL.Query().Get("cursor")}
+	if value := r.URL.Query().Get("page_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 {
+			return Params{}, errors.New("page_size must be a positive integer")
+		}
+		params.PageSize = size
+	}
+	return params, nil
+}
+
+// Paginate sorts items by less and returns the page selected by params. less
+// must be a strict total order, typically breaking ties by ID. position
+// strips an item down to the fields less compares, which is what the cursor
+// stores.
+func Paginate[T any](items []T, params Params, less func(a, b T) bool, position func(T) T) (Page[T], error) {
+	pageSize := params.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(items[i], items[j])
+	})
+
+	start := 0
+	if params.Cursor != "" {
+		after, err := decodeCursor[T](params.Cursor)
+		if err != nil {
+			return Page[T]{}, err
+		}
+		start = sort.Search(len(items), func(i int) bool {
+			return less(after, items[i])
+		})
+	}
+
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := Page[T]{
+		Items:    append([]T{}, items[start:end]...),
+		Total:    len(items),
+		PageSize: pageSize,
+	}
+	if end < len(items) {
+		cursor, err := encodeCursor(position(items[end-1]))
+		if err != nil {
+			return Page[T]{}, err
+		}
+		page.NextCursor = cursor
+	}
+	return page, nil
+}
+
+// WriteList writes items sorted by less as JSON. Requests with page_size or
+// cursor get a Page; others get the whole list as an array, as list endpoints
+// returned before pagination existed. Both carry an X-Total-Count header.
+func WriteList[T any](w http.ResponseWriter, r *http.Request, items []T, less func(a, b T) bool, position func(T) T) {
+	if !Requested(r) {
+		sort.SliceStable(items, func(i, j int) bool {
+			return less(items[i], items[j])
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+
+	params, err := ParseParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := Paginate(items, params, less, position)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	json.NewEncoder(w).Encode(page)
+}
+
+func encodeCursor(position interface{}) (string, error) {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor[T any](cursor string) (T, error) {
+	var position T
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return position, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &position); err != nil {
+		return position, ErrInvalidCursor
+	}
+	return position, nil
+}
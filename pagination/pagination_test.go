@@ -0,0 +1,249 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type item struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+	Note string `json:"note,omitempty"`
+}
+
+// Largest first, ties broken by ID
+func bySize(a, b item) bool {
+	if a.Size != b.Size {
+		return a.Size > b.Size
+	}
+	return a.ID < b.ID
+}
+
+func sizePosition(it item) item {
+	return item{ID: it.ID, Size: it.Size}
+}
+
+func makeItems(n int) []item {
+	items := make([]item, n)
+	for i := range items {
+		items[i] = item{ID: strconv.Itoa(i), Size: i % 3, Note: "x"}
+	}
+	return items
+}
+
+func ids(items []item) []string {
+	out := make([]string, len(items))
+	for i, it := range items {
+		out[i] = it.ID
+	}
+	return out
+}
+
+func TestPaginateWalksEveryItemOnce(t *testing.T) {
+	items := makeItems(10)
+	var walked []string
+	params := Params{PageSize: 3}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("pagination does not end")
+		}
+		page, err := Paginate(items, params, bySize, sizePosition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 10 || page.PageSize != 3 {
+			t.Fatalf("total %d, page size %d", page.Total, page.PageSize)
+		}
+		walked = append(walked, ids(page.Items)...)
+		if page.NextCursor == "" {
+			break
+		}
+		params.Cursor = page.NextCursor
+	}
+
+	want := []string{"2", "5", "8", "1", "4", "7", "0", "3", "6", "9"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("walked %v, want %v", walked, want)
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	page, err := Paginate(makeItems(5), Params{PageSize: 2}, bySize, sizePosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := decodeCursor[item](page.NextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The cursor holds the sort position of the last item, not the whole item
+	if want := (item{ID: "1", Size: 1}); position != want {
+		t.Errorf("cursor decoded to %+v, want %+v", position, want)
+	}
+}
+
+func TestCursorSurvivesChanges(t *testing.T) {
+	items := makeItems(6)
+	first, err := Paginate(items, Params{PageSize: 2}, bySize, sizePosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(first.Items); !reflect.DeepEqual(got, []string{"2", "5"}) {
+		t.Fatalf("first page %v", got)
+	}
+
+	// An item is removed from the first page and one is added before the
+	// cursor; the next page still starts after "5"
+	changed := append([]item{{ID: "00", Size: 9}}, makeItems(6)...)
+	changed = append(changed[:3], changed[4:]...)
+	next, err := Paginate(changed, Params{PageSize: 2, Cursor: first.NextCursor}, bySize, sizePosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(next.Items); !reflect.DeepEqual(got, []string{"1", "4"}) {
+		t.Errorf("next page %v, want [1 4]", got)
+	}
+}
+
+func TestInvalidCursor(t *testing.T) {
+	cursors := []string{
+		"not base64!",
+		"eyJpZCI6", // Standard padding-free base64 of truncated JSON
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),     // Valid base64, not JSON
+		base64.RawURLEncoding.EncodeToString([]byte(`{"size":"x"}`)), // Wrong field type
+		base64.StdEncoding.EncodeToString([]byte(`{"id":"1"}`)),      // Padded encoding
+	}
+	for _, cursor := range cursors {
+		if _, err := Paginate(makeItems(3), Params{Cursor: cursor}, bySize, sizePosition); err != ErrInvalidCursor {
+			t.Errorf("cursor %q: got %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestTamperedCursor(t *testing.T) {
+	// A cursor edited to point elsewhere is still a position in the order and
+	// just moves the page; it can't read past the list
+	data, _ := json.Marshal(item{ID: "zzz", Size: -1})
+	page, err := Paginate(makeItems(3), Params{Cursor: base64.RawURLEncoding.EncodeToString(data)}, bySize, sizePosition)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 0 || page.NextCursor != "" || page.Total != 3 {
+		t.Errorf("got %+v", page)
+	}
+}
+
+func TestPageSizeBounds(t *testing.T) {
+	items := makeItems(MaxPageSize + 5)
+	tests := []struct {
+		size, want int
+	}{
+		{0, DefaultPageSize},
+		{-1, DefaultPageSize},
+		{1, 1},
+		{MaxPageSize, MaxPageSize},
+		{MaxPageSize + 1, MaxPageSize},
+	}
+	for _, tt := range tests {
+		page, err := Paginate(items, Params{PageSize: tt.size}, bySize, sizePosition)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.PageSize != tt.want || len(page.Items) != tt.want {
+			t.Errorf("page_size %d: got %d items, page size %d, want %d", tt.size, len(page.Items), page.PageSize, tt.want)
+		}
+	}
+
+	page, err := Paginate(makeItems(3), Params{PageSize: 3}, bySize, sizePosition)
+	if err != nil || page.NextCursor != "" {
+		t.Errorf("an exactly full last page has a cursor: %+v, %v", page, err)
+	}
+	page, err = Paginate([]item{}, Params{}, bySize, sizePosition)
+	if err != nil || page.Items == nil || page.Total != 0 {
+		t.Errorf("empty list: %+v, %v", page, err)
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Params
+		ok    bool
+	}{
+		{"", Params{}, true},
+		{"page_size=10", Params{PageSize: 10}, true},
+		{"page_size=5000", Params{PageSize: 5000}, true}, // Clamped by Paginate
+		{"cursor=abc", Params{Cursor: "abc"}, true},
+		{"page_size=0", Params{}, false},
+		{"page_size=-3", Params{}, false},
+		{"page_size=ten", Params{}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/files?"+tt.query, nil)
+		got, err := ParseParams(r)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %+v, %v", tt.query, got, err)
+		}
+	}
+}
+
+func TestWriteListLegacyArray(t *testing.T) {
+	items := makeItems(4)
+	w := httptest.NewRecorder()
+	WriteList(w, httptest.NewRequest(http.MethodGet, "/files", nil), items, bySize, sizePosition)
+
+	if got := w.Header().Get("X-Total-Count"); got != "4" {
+		t.Errorf("X-Total-Count = %q, want 4", got)
+	}
+	var got []item
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("response is not an array: %v", err)
+	}
+	if want := []string{"2", "1", "0", "3"}; !reflect.DeepEqual(ids(got), want) {
+		t.Errorf("got %v, want %v", ids(got), want)
+	}
+	if got[0].Note != "x" {
+		t.Error("items lost fields")
+	}
+}
+
+func TestWriteListPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteList(w, httptest.NewRequest(http.MethodGet, "/files?page_size=3", nil), makeItems(4), bySize, sizePosition)
+
+	if got := w.Header().Get("X-Total-Count"); got != "4" {
+		t.Errorf("X-Total-Count = %q, want 4", got)
+	}
+	var page Page[item]
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 4 || page.PageSize != 3 || len(page.Items) != 3 || page.NextCursor == "" {
+		t.Errorf("got %+v", page)
+	}
+
+	w = httptest.NewRecorder()
+	WriteList(w, httptest.NewRequest(http.MethodGet, "/files?cursor="+page.NextCursor, nil), makeItems(4), bySize, sizePosition)
+	page = Page[item]{}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(page.Items); !reflect.DeepEqual(got, []string{"3"}) || page.NextCursor != "" {
+		t.Errorf("second page %v, cursor %q", got, page.NextCursor)
+	}
+}
+
+func TestWriteListBadRequest(t *testing.T) {
+	for _, query := range []string{"page_size=0", "page_size=x", "cursor=%21%21"} {
+		w := httptest.NewRecorder()
+		WriteList(w, httptest.NewRequest(http.MethodGet, "/files?"+query, nil), makeItems(2), bySize, sizePosition)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package peer
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"sp/config"
+)
+
+// peerFileConfig is the "peer:" section of the config file. Sizes and
+// intervals accept units ("100MB", "30s") there and in flags and env vars.
+type peerFileConfig struct {
+	Port              int             `yaml:"port" json:"port"`
+	Address           string          `yaml:"address" json:"address"`
+	SuperPeerAddress  string          `yaml:"super_peer_address" json:"super_peer_address"`
+	SuperPeers        config.List     `yaml:"super_peers" json:"super_peers"`
+	SharedDirectory   string          `yaml:"shared_directory" json:"shared_directory"`
+	StateDirectory    string          `yaml:"state_directory" json:"state_directory"`
+	MaxFileSize       config.Size     `yaml:"max_file_size" json:"max_file_size"`
+	HeartbeatInterval config.Duration `yaml:"heartbeat_interval" json:"heartbeat_interval"`
+	ShutdownTimeout   config.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	DHT               bool            `yaml:"dht" json:"dht"`
+	DHTBootstrap      config.List     `yaml:"dht_bootstrap" json:"dht_bootstrap"`
+	RotateIdentity    bool            `yaml:"-" json:"-"` // a one-off action, not a setting
+
+	// Upload limits; rates are per second
+	UploadRate          config.Size `yaml:"upload_rate" json:"upload_rate"`
+	UploadRatePerClient config.Size `yaml:"upload_rate_per_client" json:"upload_rate_per_client"`
+	UploadSlots         int         `yaml:"upload_slots" json:"upload_slots"`
+	UploadQueue         int         `yaml:"upload_queue" json:"upload_queue"`
+	UploadSchedule      config.List `yaml:"upload_schedule" json:"upload_schedule"`
+}
+
+// Environment variables and the flags they stand in for
+var peerEnv = map[string]string{
+	"PEER_CONFIG":                 "config",
+	"PEER_PORT":                   "port",
+	"PEER_ADDRESS":                "address",
+	"PEER_SUPER_PEER_ADDRESS":     "super-peer",
+	"PEER_SUPER_PEERS":            "super-peers",
+	"PEER_SHARED_DIRECTORY":       "shared-dir",
+	"PEER_STATE_DIRECTORY":        "state-dir",
+	"PEER_MAX_FILE_SIZE":          "max-file-size",
+	"PEER_HEARTBEAT_INTERVAL":     "heartbeat-interval",
+	"PEER_SHUTDOWN_TIMEOUT":       "shutdown-timeout",
+	"PEER_DHT":                    "dht",
+	"PEER_DHT_BOOTSTRAP":          "dht-bootstrap",
+	"PEER_ROTATE_IDENTITY":        "rotate-identity",
+	"PEER_UPLOAD_RATE":            "upload-rate",
+	"PEER_UPLOAD_RATE_PER_CLIENT": "upload-rate-per-client",
+	"PEER_UPLOAD_SLOTS":           "upload-slots",
+	"PEER_UPLOAD_QUEUE":           "upload-queue",
+	"PEER_UPLOAD_SCHEDULE":        "upload-schedule",
+}
+
+// LoadConfig builds the peer configuration from defaults, the config file,
+// environment variables and command-line args, in increasing precedence.
+func LoadConfig(args []string) (PeerConfig, error) {
+	fileConfig := peerFileConfig{
+		Port:              9001,
+		Address:           "127.0.0.1",
+		SuperPeerAddress:  "localhost:8080",
+		SharedDirectory:   "./shared_files",
+		MaxFileSize:       100 * 1024 * 1024, // 100MB
+		HeartbeatInterval: config.Duration(30 * time.Second),
+		ShutdownTimeout:   config.Duration(30 * time.Second),
+		UploadQueue:       32,
+	}
+
+	fs := flag.NewFlagSet("peer", flag.ContinueOnError)
+	fs.String("config", "", "path to a YAML or JSON config file (default "+config.DefaultFile+" if present)")
+	fs.IntVar(&fileConfig.Port, "port", fileConfig.Port, "port to listen on")
+	fs.StringVar(&fileConfig.Address, "address", fileConfig.Address, "address other peers reach this peer at")
+	fs.StringVar(&fileConfig.SuperPeerAddress, "super-peer", fileConfig.SuperPeerAddress, "super-peer host:port")
+	fs.Var(&fileConfig.SuperPeers, "super-peers", "comma-separated super-peers to fail over between, overrides -super-peer")
+	fs.StringVar(&fileConfig.SharedDirectory, "shared-dir", fileConfig.SharedDirectory, "directory of shared files")
+	fs.StringVar(&fileConfig.StateDirectory, "state-dir", "", "directory for peer state (default peer_state/<port>)")
+	fs.Var(&fileConfig.MaxFileSize, "max-file-size", "largest file accepted for sharing, e.g. 100MB")
+	fs.Var(&fileConfig.HeartbeatInterval, "heartbeat-interval", "interval between heartbeats, e.g. 30s")
+	fs.Var(&fileConfig.ShutdownTimeout, "shutdown-timeout", "how long to wait for in-flight uploads on shutdown, e.g. 30s")
+	fs.BoolVar(&fileConfig.DHT, "dht", false, "announce and look up content in the DHT")
+	fs.Var(&fileConfig.DHTBootstrap, "dht-bootstrap", "comma-separated DHT nodes to join through (default the super-peers)")
+	fs.BoolVar(&fileConfig.RotateIdentity, "rotate-identity", false, "replace the peer's key on startup, handing its records to the new ID")
+	fs.Var(&fileConfig.UploadRate, "upload-rate", "total upload rate per second, e.g. 1MB (0 for unlimited)")
+	fs.Var(&fileConfig.UploadRatePerClient, "upload-rate-per-client", "upload rate per second to each client, e.g. 256KB (0 for unlimited)")
+	fs.IntVar(&fileConfig.UploadSlots, "upload-slots", fileConfig.UploadSlots, "uploads served at once (0 for unlimited)")
+	fs.IntVar(&fileConfig.UploadQueue, "upload-queue", fileConfig.UploadQueue, "uploads waiting for a slot before more are turned away")
+	fs.Var(&fileConfig.UploadSchedule, "upload-schedule", "comma-separated time-of-day upload rates, e.g. 09:00-17:00=100KB")
+
+	path, err := config.Apply(fs, args, "peer", peerEnv, &fileConfig)
+	if err != nil {
+		return PeerConfig{}, err
+	}
+
+	cfg := PeerConfig{
+		Port:                fileConfig.Port,
+		Address:             fileConfig.Address,
+		SuperPeerAddress:    fileConfig.SuperPeerAddress,
+		SharedDirectory:     fileConfig.SharedDirectory,
+		StateDirectory:      fileConfig.StateDirectory,
+		MaxFileSize:         int64(fileConfig.MaxFileSize),
+		HeartbeatInterval:   int(time.Duration(fileConfig.HeartbeatInterval) / time.Second),
+		ShutdownTimeout:     int(time.Duration(fileConfig.ShutdownTimeout) / time.Second),
+		SuperPeers:          fileConfig.SuperPeers,
+		DHT:                 fileConfig.DHT,
+		DHTBootstrap:        fileConfig.DHTBootstrap,
+		RotateIdentity:      fileConfig.RotateIdentity,
+		UploadRate:          int64(fileConfig.UploadRate),
+		UploadRatePerClient: int64(fileConfig.UploadRatePerClient),
+		UploadSlots:         fileConfig.UploadSlots,
+		UploadQueue:         fileConfig.UploadQueue,
+		UploadSchedule:      fileConfig.UploadSchedule,
+		ConfigFile:          path,
+	}
+	if len(cfg.SuperPeers) == 0 {
+		cfg.SuperPeers = []string{cfg.SuperPeerAddress}
+	}
+	if len(cfg.DHTBootstrap) == 0 {
+		cfg.DHTBootstrap = cfg.SuperPeers
+	}
+	cfg.SuperPeerAddress = cfg.SuperPeers[0]
+	if cfg.StateDirectory == "" {
+		// Keep the state of peers sharing a working directory apart
+		cfg.StateDirectory = filepath.Join("peer_state", strconv.Itoa(cfg.Port))
+	}
+
+	if err := cfg.validate(); err != nil {
+		return PeerConfig{}, err
+	}
+	return cfg, nil
+}
+
+func (c PeerConfig) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.Address == "" {
+		return fmt.Errorf("address is required")
+	}
+	for _, address := range c.SuperPeers {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("super-peer addresses must be host:port, got %q", address)
+		}
+	}
+	for _, address := range c.DHTBootstrap {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return fmt.Errorf("DHT bootstrap addresses must be host:port, got %q", address)
+		}
+	}
+	if c.SharedDirectory == "" {
+		return fmt.Errorf("shared_directory is required")
+	}
+	if c.MaxFileSize <= 0 {
+		return fmt.Errorf("max_file_size must be positive")
+	}
+	// The super-peer marks peers offline after 5 minutes without a heartbeat
+	if c.HeartbeatInterval < 1 || c.HeartbeatInterval > 240 {
+		return fmt.Errorf("heartbeat_interval must be between 1s and 4m, got %ds", c.HeartbeatInterval)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout must not be negative")
+	}
+	if c.UploadRate < 0 || c.UploadRatePerClient < 0 {
+		return fmt.Errorf("upload rates must not be negative")
+	}
+	if c.UploadSlots < 0 || c.UploadQueue < 0 {
+		return fmt.Errorf("upload_slots and upload_queue must not be negative")
+	}
+	if _, err := parseUploadSchedule(c.UploadSchedule); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"sp/dht"
+)
+
+// dhtMetadata is what a peer announces along with the content hashes it holds
+type dhtMetadata struct {
+	Filename   string `json:"filename"`
+	Size       int64  `json:"size"`
+	MerkleRoot string `json:"merkle_root"`
+}
+
+// Join the DHT under a node ID derived from the peer ID. Shared files are
+// announced as they are registered.
+func (p *Peer) startDHT() {
+	p.dht = dht.NewNode(dht.Config{
+		ID:        dht.NewID(p.ID),
+		Address:   p.selfAddress(),
+		PeerID:    p.ID,
+		Bootstrap: p.Config.DHTBootstrap,
+	})
+
+	p.services.Add(1)
+	go func() {
+		defer p.services.Done()
+		p.dht.Run(p.ctx)
+	}()
+	log.Printf("🧭 DHT mode on, bootstrapping from %v", p.Config.DHTBootstrap)
+}
+
+// Announce a shared file's content hash to the DHT
+func (p *Peer) announceFile(file *SharedFile) {
+	if p.dht == nil || file.Hash == "" {
+		return
+	}
+	key, err := dht.ParseID(file.Hash)
+	if err != nil {
+		return
+	}
+	metadata, _ := json.Marshal(dhtMetadata{Filename: file.Filename, Size: file.Size, MerkleRoot: file.MerkleRoot})
+	if err := p.dht.Announce(key, metadata); err != nil {
+		log.Printf("⚠️ Failed to announce %s to the DHT: %v", file.Filename, err)
+	}
+}
+
+// Stop announcing content we no longer hold
+func (p *Peer) withdrawFile(file *SharedFile) {
+	if p.dht == nil {
+		return
+	}
+	if key, err := dht.ParseID(file.Hash); err == nil {
+		p.dht.Withdraw(key)
+	}
+}
+
+// Look up the peers holding a content hash in the DHT, as swarm sources
+func (p *Peer) dhtSources(hash string) []RemoteFile {
+	key, err := dht.ParseID(hash)
+	if err != nil {
+		return nil
+	}
+
+	self := p.selfAddress()
+	var sources []RemoteFile
+	for _, provider := range p.dht.FindProviders(key) {
+		if provider.Address == self || provider.PeerID == p.ID {
+			continue
+		}
+		var metadata dhtMetadata
+		json.Unmarshal(provider.Metadata, &metadata)
+		sources = append(sources, RemoteFile{
+			Filename:    metadata.Filename,
+			Size:        metadata.Size,
+			Hash:        hash,
+			MerkleRoot:  metadata.MerkleRoot,
+			Owner:       provider.PeerID,
+			PeerAddress: provider.Address,
+		})
+	}
+	return sources
+}
+
+// HTTP handlers
+
+// DHT status: routing table size, stored records and announced keys
+func (p *Peer) getDHTHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if p.dht == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled": false,
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(p.dht.Status())
+}
+
+// Look up the providers of a content hash
+func (p *Peer) getProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	key, err := dht.ParseID(hash)
+	if err != nil {
+		http.Error(w, "Invalid content hash", http.StatusBadRequest)
+		return
+	}
+
+	providers := p.dht.FindProviders(key)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hash":      hash,
+		"providers": providers,
+		"total":     len(providers),
+	})
+}
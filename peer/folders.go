@@ -0,0 +1,314 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FolderEntry is a subfolder of the shared directory as listed by the browse
+// endpoint
+type FolderEntry struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Shared bool   `json:"shared"`
+	Files  int    `json:"files"` // shared files in the folder and below
+	Size   int64  `json:"size"`
+}
+
+// Path of a file relative to the shared directory, with forward slashes.
+// "" for the shared directory itself.
+func (p *Peer) relativePath(filePath string) string {
+	rel, err := filepath.Rel(p.Config.SharedDirectory, filePath)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// Directory of a relative path, "" at the top level
+func folderOf(rel string) string {
+	if dir := path.Dir(rel); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// Whether a relative path is a folder or below it ("" holds everything)
+func inFolder(rel, folder string) bool {
+	return folder == "" || rel == folder || strings.HasPrefix(rel, folder+"/")
+}
+
+// Check a relative path sent by a client. Paths may not leave the shared
+// directory; "" stands for the shared directory itself.
+func cleanRelativePath(rel string) (string, error) {
+	rel = strings.Trim(strings.ReplaceAll(rel, "\\", "/"), " ")
+	if rel == "" {
+		return "", nil
+	}
+	cleaned := path.Clean(rel)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") || filepath.VolumeName(rel) != "" {
+		return "", fmt.Errorf("path %q is outside the shared directory", rel)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// The filename of an uploaded file as sent by the client. Go's multipart
+// reader keeps only the base name, so the relative path of a folder upload is
+// read from the Content-Disposition header.
+func uploadPath(header *multipart.FileHeader) string {
+	if _, params, err := mime.ParseMediaType(header.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return header.Filename
+}
+
+// Unshared paths
+
+// Whether a relative path, or a folder above it, was unshared
+func (p *Peer) isUnshared(rel string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for rel != "" {
+		if p.unshared[rel] {
+			return true
+		}
+		rel = folderOf(rel)
+	}
+	return false
+}
+
+// Mark a relative path unshared, or shared again along with everything below
+// it
+func (p *Peer) setUnshared(rel string, unshared bool) {
+	p.mutex.Lock()
+	changed := p.unshared[rel] != unshared
+	if unshared {
+		p.unshared[rel] = true
+	} else {
+		delete(p.unshared, rel)
+		for existing := range p.unshared {
+			if rel == "" || strings.HasPrefix(existing, rel+"/") {
+				delete(p.unshared, existing)
+				changed = true
+			}
+		}
+	}
+	p.mutex.Unlock()
+
+	if changed {
+		p.saveUnshared()
+	}
+}
+
+func (p *Peer) unsharedPath() string {
+	return filepath.Join(p.Config.StateDirectory, "unshared.json")
+}
+
+func (p *Peer) loadUnshared() {
+	data, err := os.ReadFile(p.unsharedPath())
+	if err != nil {
+		return
+	}
+	var paths []string
+	if err := json.Unmarshal(data, &paths); err != nil {
+		log.Printf("⚠️ Ignoring unreadable unshared list: %v", err)
+		return
+	}
+
+	p.mutex.Lock()
+	for _, rel := range paths {
+		p.unshared[rel] = true
+	}
+	p.mutex.Unlock()
+}
+
+func (p *Peer) saveUnshared() {
+	p.mutex.RLock()
+	paths := make([]string, 0, len(p.unshared))
+	for rel := range p.unshared {
+		paths = append(paths, rel)
+	}
+	p.mutex.RUnlock()
+	sort.Strings(paths)
+
+	data, err := json.MarshalIndent(paths, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(p.Config.StateDirectory, 0755)
+	tmpPath := p.unsharedPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err == nil {
+		os.Rename(tmpPath, p.unsharedPath())
+	}
+}
+
+// HTTP handlers
+
+// Browse a folder of the shared directory: its subfolders, the files shared
+// in it and the files in it that are not shared
+func (p *Peer) browseFolderHandler(w http.ResponseWriter, r *http.Request) {
+	rel, err := cleanRelativePath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(p.Config.SharedDirectory, filepath.FromSlash(rel)))
+	if err != nil {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	p.mutex.RLock()
+	shared := make(map[string]bool, len(p.SharedFiles))
+	for _, file := range p.SharedFiles {
+		shared[file.Path] = true
+	}
+	p.mutex.RUnlock()
+
+	folders := []FolderEntry{}
+	unshared := []string{}
+	for _, entry := range entries {
+		child := path.Join(rel, entry.Name())
+		if entry.IsDir() {
+			folders = append(folders, FolderEntry{Name: entry.Name(), Path: child, Shared: !p.isUnshared(child)})
+		} else if !shared[child] {
+			unshared = append(unshared, child)
+		}
+	}
+
+	files := []SharedFile{}
+	p.mutex.RLock()
+	for _, file := range p.SharedFiles {
+		if file.Folder == rel {
+			files = append(files, *file)
+		}
+		for i := range folders {
+			if strings.HasPrefix(file.Path, folders[i].Path+"/") {
+				folders[i].Files++
+				folders[i].Size += file.Size
+			}
+		}
+	}
+	p.mutex.RUnlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+
+	response := map[string]interface{}{
+		"path":     rel,
+		"shared":   rel == "" || !p.isUnshared(rel),
+		"folders":  folders,
+		"files":    files,
+		"unshared": unshared,
+	}
+	if rel != "" {
+		response["parent"] = folderOf(rel)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Share a folder of the shared directory again after it, or files in it,
+// were unshared. New files are uploaded through /files/share.
+func (p *Peer) shareFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	rel, err := cleanRelativePath(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(filepath.Join(p.Config.SharedDirectory, filepath.FromSlash(rel))); err != nil || !info.IsDir() {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	p.setUnshared(rel, false)
+	p.scanPath(rel)
+
+	files := 0
+	p.mutex.RLock()
+	for _, file := range p.SharedFiles {
+		if inFolder(file.Path, rel) {
+			files++
+		}
+	}
+	p.mutex.RUnlock()
+
+	log.Printf("📂 Folder shared: /%s (%d files)", rel, files)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"path":    rel,
+		"files":   files,
+		"message": "Folder shared successfully",
+	})
+}
+
+// Stop sharing every file in a folder and below. With delete=true the folder
+// is removed from disk, otherwise it is remembered as unshared so the file
+// watcher leaves it alone.
+func (p *Peer) unshareFolderHandler(w http.ResponseWriter, r *http.Request) {
+	rel, err := cleanRelativePath(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rel == "" {
+		http.Error(w, "Folder path required", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(p.Config.SharedDirectory, filepath.FromSlash(rel))
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("delete") == "true" {
+		if err := os.RemoveAll(dir); err != nil {
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		p.setUnshared(rel, true)
+	}
+
+	p.mutex.Lock()
+	var removed []*SharedFile
+	for id, file := range p.SharedFiles {
+		if strings.HasPrefix(file.Path, rel+"/") {
+			delete(p.SharedFiles, id)
+			removed = append(removed, file)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, file := range removed {
+		go p.unregisterFileWithSuperPeer(file)
+		p.broadcastUpdate("file_unshared", file)
+	}
+
+	log.Printf("📂 Folder unshared: /%s (%d files)", rel, len(removed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"path":    rel,
+		"files":   len(removed),
+		"message": "Folder unshared successfully",
+	})
+}
@@ -0,0 +1,124 @@
+package peer
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"sp/merkle"
+)
+
+// hashCacheEntry is the digest of a file as of its size, modification time
+// and inode
+type hashCacheEntry struct {
+	Size        int64    `json:"size"`
+	ModTime     int64    `json:"mod_time"` // Unix nanoseconds
+	Inode       uint64   `json:"inode,omitempty"`
+	Hash        string   `json:"hash"`
+	MerkleRoot  string   `json:"merkle_root"`
+	PieceHashes []string `json:"piece_hashes"`
+}
+
+// hashCache remembers the digests of shared files across restarts, so files
+// are only hashed again when they change
+type hashCache struct {
+	path    string
+	mutex   sync.Mutex
+	entries map[string]hashCacheEntry // by path relative to the shared directory
+	dirty   bool
+}
+
+func loadHashCache(path string) *hashCache {
+	c := &hashCache{path: path, entries: make(map[string]hashCacheEntry)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		log.Printf("⚠️ Ignoring unreadable hash cache: %v", err)
+		c.entries = make(map[string]hashCacheEntry)
+	}
+	return c
+}
+
+// The cached digest of a file, if the file has not changed since
+func (c *hashCache) lookup(rel string, info os.FileInfo) (FileDigest, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, exists := c.entries[rel]
+	if !exists || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.Inode != fileInode(info) {
+		return FileDigest{}, false
+	}
+	// Roots cached by a build with another tree layout are computed again
+	if root, err := merkle.Root(entry.PieceHashes); err != nil || root != entry.MerkleRoot {
+		return FileDigest{}, false
+	}
+	return FileDigest{Hash: entry.Hash, MerkleRoot: entry.MerkleRoot, PieceHashes: entry.PieceHashes}, true
+}
+
+func (c *hashCache) store(rel string, info os.FileInfo, digest FileDigest) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[rel] = hashCacheEntry{
+		Size:        info.Size(),
+		ModTime:     info.ModTime().UnixNano(),
+		Inode:       fileInode(info),
+		Hash:        digest.Hash,
+		MerkleRoot:  digest.MerkleRoot,
+		PieceHashes: digest.PieceHashes,
+	}
+	c.dirty = true
+}
+
+// Drop the entries of files under folder ("" for all) that were not seen
+func (c *hashCache) prune(folder string, seen map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for rel := range c.entries {
+		if inFolder(rel, folder) && !seen[rel] {
+			delete(c.entries, rel)
+			c.dirty = true
+		}
+	}
+}
+
+// Write the cache if it changed since it was last saved
+func (c *hashCache) save() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.dirty {
+		return
+	}
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(c.path), 0755)
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		log.Printf("⚠️ Failed to save hash cache: %v", err)
+		return
+	}
+	if err := os.Rename(tmpPath, c.path); err == nil {
+		c.dirty = false
+	}
+}
+
+// The digest of a shared file, from the cache unless the file changed
+func (p *Peer) fileDigest(filePath, rel string, info os.FileInfo) (FileDigest, error) {
+	if digest, ok := p.hashes.lookup(rel, info); ok {
+		return digest, nil
+	}
+	digest, err := calculateFileDigest(filePath)
+	if err != nil {
+		return FileDigest{}, err
+	}
+	p.hashes.store(rel, info, digest)
+	return digest, nil
+}
@@ -0,0 +1,552 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decentralized search settings
+const (
+	maxNeighbors        = 16
+	maxNeighborFailures = 3
+	neighborInterval    = time.Minute
+	floodTTL            = 3  // hops of a flooding query
+	walkTTL             = 8  // hops of each random walk
+	maxSearchTTL        = 10 // largest TTL a peer accepts or forwards
+	searchWalkers       = 3  // random walks started per query
+	hopTimeout          = time.Second
+	seenQueryExpiry     = time.Minute
+)
+
+// Neighbor is another peer this one sends decentralized searches to
+type Neighbor struct {
+	ID       string    `json:"id,omitempty"`
+	Address  string    `json:"address"` // host:port
+	LastSeen time.Time `json:"last_seen"`
+	Failures int       `json:"failures"` // consecutive failed queries
+}
+
+// NetworkResult is content found by a decentralized search, with every peer
+// that reported holding it
+type NetworkResult struct {
+	Hash     string       `json:"hash"`
+	Filename string       `json:"filename"`
+	Size     int64        `json:"size"`
+	Category string       `json:"category"`
+	Score    float64      `json:"score"`
+	Sources  []RemoteFile `json:"sources"`
+}
+
+// networkQuery is a decentralized search as forwarded from peer to peer
+type networkQuery struct {
+	ID       string
+	Query    string // lowercase
+	Category string
+	Hash     string
+	Fuzzy    bool
+	Mode     string // flood or walk
+	TTL      int    // hops left, counting the peer receiving the query
+}
+
+// HTTP Handlers
+
+// Search the other peers directly, without the super-peer. mode=flood (the
+// default) sends the query to every neighbor, which pass it on to theirs
+// until ttl hops are used; mode=walk sends it along a few random paths
+// instead. Results are grouped by content hash.
+func (p *Peer) networkSearchHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := networkQuery{
+		Query:    strings.ToLower(params.Get("q")),
+		Category: params.Get("category"),
+		Hash:     params.Get("hash"),
+		Fuzzy:    params.Get("fuzzy") == "true",
+		Mode:     params.Get("mode"),
+	}
+	if q.Mode == "" {
+		q.Mode = "flood"
+	}
+	if q.Mode != "flood" && q.Mode != "walk" {
+		http.Error(w, "mode must be flood or walk", http.StatusBadRequest)
+		return
+	}
+	q.TTL = floodTTL
+	if q.Mode == "walk" {
+		q.TTL = walkTTL
+	}
+	if value := params.Get("ttl"); value != "" {
+		ttl, err := strconv.Atoi(value)
+		if err != nil || ttl < 1 || ttl > maxSearchTTL {
+			http.Error(w, fmt.Sprintf("ttl must be between 1 and %d", maxSearchTTL), http.StatusBadRequest)
+			return
+		}
+		q.TTL = ttl
+	}
+
+	results := p.networkSearch(q)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query_id":  q.ID,
+		"results":   results,
+		"count":     len(results),
+		"mode":      q.Mode,
+		"ttl":       q.TTL,
+		"neighbors": len(p.neighborAddresses("")),
+	})
+}
+
+// Answer a decentralized search forwarded by another peer with our own
+// matches and those of the neighbors we pass it on to. A query seen before
+// is answered with no results, so floods do not loop.
+func (p *Peer) forwardedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	q, err := parseNetworkQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Peers that query us make good neighbors, as long as the address they
+	// give is the one the query came from
+	from := r.URL.Query().Get("from")
+	if from != "" && sentFrom(r, from) {
+		p.addNeighbor(from, "")
+	}
+
+	results := []NetworkResult{}
+	if p.markQuerySeen(q.ID) {
+		results = p.answerQuery(q, from)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query_id": q.ID,
+		"results":  results,
+		"count":    len(results),
+	})
+}
+
+func (p *Peer) getNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	p.neighborsMutex.Lock()
+	neighbors := make([]Neighbor, 0, len(p.neighbors))
+	for _, neighbor := range p.neighbors {
+		neighbors = append(neighbors, *neighbor)
+	}
+	p.neighborsMutex.Unlock()
+
+	sort.Slice(neighbors, func(i, j int) bool { return neighbors[i].Address < neighbors[j].Address })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(neighbors)
+}
+
+// Searching
+
+// Run a decentralized search from this peer. Our own files are left out.
+func (p *Peer) networkSearch(q networkQuery) []NetworkResult {
+	q.ID = newQueryID()
+	p.markQuerySeen(q.ID)
+
+	targets := p.neighborAddresses("")
+	if q.Mode == "walk" && len(targets) > searchWalkers {
+		targets = targets[:searchWalkers]
+	}
+
+	self := p.selfAddress()
+	results := []NetworkResult{}
+	for _, result := range p.forwardQuery(q, targets, self) {
+		result.Sources = deleteSources(result.Sources, func(source RemoteFile) bool {
+			return source.Owner == p.ID || source.PeerAddress == self
+		})
+		if len(result.Sources) > 0 {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// Our matches for a forwarded query merged with those of the next hops
+func (p *Peer) answerQuery(q networkQuery, from string) []NetworkResult {
+	self := p.selfAddress()
+	var local []NetworkResult
+	for _, result := range p.searchLocal(q.Query, q.Category, q.Hash, q.Fuzzy) {
+		file := result.SharedFile
+		local = append(local, NetworkResult{
+			Hash:     file.Hash,
+			Filename: file.Filename,
+			Size:     file.Size,
+			Category: file.Category,
+			Score:    result.Score,
+			Sources: []RemoteFile{{
+				ID:          file.ID,
+				Filename:    file.Filename,
+				Size:        file.Size,
+				Hash:        file.Hash,
+				MerkleRoot:  file.MerkleRoot,
+				Owner:       p.ID,
+				PeerAddress: self,
+			}},
+		})
+	}
+	if q.TTL <= 1 {
+		return mergeResults(local)
+	}
+
+	targets := p.neighborAddresses(from)
+	if q.Mode == "walk" && len(targets) > 1 {
+		targets = targets[:1]
+	}
+	q.TTL--
+	return mergeResults(local, p.forwardQuery(q, targets, self))
+}
+
+// Send a query to the given neighbors in parallel and merge their answers.
+// Each hop left gets another hopTimeout to answer in.
+func (p *Peer) forwardQuery(q networkQuery, targets []string, self string) []NetworkResult {
+	values := url.Values{
+		"query_id": {q.ID},
+		"q":        {q.Query},
+		"category": {q.Category},
+		"hash":     {q.Hash},
+		"fuzzy":    {strconv.FormatBool(q.Fuzzy)},
+		"mode":     {q.Mode},
+		"ttl":      {strconv.Itoa(q.TTL)},
+		"from":     {self},
+	}
+	client := &http.Client{Timeout: time.Duration(q.TTL) * hopTimeout}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var answers [][]NetworkResult
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			results, err := queryNeighbor(client, target, values)
+			p.recordNeighbor(target, err)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			answers = append(answers, results)
+			mutex.Unlock()
+		}(target)
+	}
+	wg.Wait()
+	return mergeResults(answers...)
+}
+
+func queryNeighbor(client *http.Client, address string, values url.Values) ([]NetworkResult, error) {
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/v1/search?%s", address, values.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("returned %s", resp.Status)
+	}
+
+	var result struct {
+		Results []NetworkResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// Ask the neighbors for every peer holding the content, when the super-peer
+// cannot be reached
+func (p *Peer) networkSources(hash string) []RemoteFile {
+	results := p.networkSearch(networkQuery{Hash: hash, Mode: "flood", TTL: floodTTL})
+	for _, result := range results {
+		if result.Hash == hash {
+			return result.Sources
+		}
+	}
+	return nil
+}
+
+// Group results by content hash, keeping the best score and one source per
+// peer, best score first
+func mergeResults(lists ...[]NetworkResult) []NetworkResult {
+	byHash := make(map[string]*NetworkResult)
+	var order []string
+	for _, list := range lists {
+		for _, result := range list {
+			merged, exists := byHash[result.Hash]
+			if !exists {
+				copied := result
+				copied.Sources = nil
+				merged = &copied
+				byHash[result.Hash] = merged
+				order = append(order, result.Hash)
+			}
+			merged.Score = max(merged.Score, result.Score)
+			for _, source := range result.Sources {
+				known := false
+				for _, existing := range merged.Sources {
+					known = known || existing.PeerAddress == source.PeerAddress
+				}
+				if !known {
+					merged.Sources = append(merged.Sources, source)
+				}
+			}
+		}
+	}
+
+	results := make([]NetworkResult, 0, len(order))
+	for _, hash := range order {
+		results = append(results, *byHash[hash])
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Hash < results[j].Hash
+	})
+	return results
+}
+
+func deleteSources(sources []RemoteFile, drop func(RemoteFile) bool) []RemoteFile {
+	kept := sources[:0]
+	for _, source := range sources {
+		if !drop(source) {
+			kept = append(kept, source)
+		}
+	}
+	return kept
+}
+
+func parseNetworkQuery(params url.Values) (networkQuery, error) {
+	q := networkQuery{
+		ID:       params.Get("query_id"),
+		Query:    strings.ToLower(params.Get("q")),
+		Category: params.Get("category"),
+		Hash:     params.Get("hash"),
+		Fuzzy:    params.Get("fuzzy") == "true",
+		Mode:     params.Get("mode"),
+	}
+	if q.ID == "" || len(q.ID) > 64 {
+		return q, fmt.Errorf("invalid query_id")
+	}
+	if q.Mode != "flood" && q.Mode != "walk" {
+		return q, fmt.Errorf("mode must be flood or walk")
+	}
+	ttl, err := strconv.Atoi(params.Get("ttl"))
+	if err != nil || ttl < 1 || ttl > maxSearchTTL {
+		return q, fmt.Errorf("ttl must be between 1 and %d", maxSearchTTL)
+	}
+	q.TTL = ttl
+	return q, nil
+}
+
+func newQueryID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Remember a query ID. Returns false if it was seen recently.
+func (p *Peer) markQuerySeen(id string) bool {
+	p.queriesMutex.Lock()
+	defer p.queriesMutex.Unlock()
+
+	now := time.Now()
+	for seenID, seenAt := range p.seenQueries {
+		if now.Sub(seenAt) > seenQueryExpiry {
+			delete(p.seenQueries, seenID)
+		}
+	}
+	if _, seen := p.seenQueries[id]; seen {
+		return false
+	}
+	p.seenQueries[id] = now
+	return true
+}
+
+// Neighbors
+
+func (p *Peer) selfAddress() string {
+	return fmt.Sprintf("%s:%d", p.Address, p.Port)
+}
+
+// Neighbor service keeps the neighbor list filled from the super-peer's peer
+// list. While the super-peer is down the cached list is used as is.
+func (p *Peer) neighborService() {
+	defer p.services.Done()
+	p.loadNeighbors()
+
+	ticker := time.NewTicker(neighborInterval)
+	defer ticker.Stop()
+
+	for {
+		p.refreshNeighbors()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Peer) refreshNeighbors() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/v1/peers", p.superPeerAddress()))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var peers []struct {
+		ID       string `json:"id"`
+		Address  string `json:"address"`
+		Port     int    `json:"port"`
+		IsOnline bool   `json:"is_online"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&peers) != nil {
+		return
+	}
+	mathrand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+	self := p.selfAddress()
+	now := time.Now()
+	p.neighborsMutex.Lock()
+	for _, peer := range peers {
+		address := net.JoinHostPort(peer.Address, strconv.Itoa(peer.Port))
+		if peer.ID == p.ID || peer.Address == "" || address == self {
+			continue
+		}
+		neighbor, known := p.neighbors[address]
+		switch {
+		case known && !peer.IsOnline:
+			delete(p.neighbors, address)
+		case known:
+			neighbor.ID = peer.ID
+			neighbor.LastSeen = now
+		case peer.IsOnline && len(p.neighbors) < maxNeighbors:
+			p.neighbors[address] = &Neighbor{ID: peer.ID, Address: address, LastSeen: now}
+		}
+	}
+	p.neighborsMutex.Unlock()
+
+	p.saveNeighbors()
+}
+
+// Whether address is on the host the request came from. Anyone can claim
+// any address, so only such claims are taken as neighbors.
+func sentFrom(r *http.Request, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(net.ParseIP(clientAddress(r)))
+}
+
+// Add a peer to the neighbor list if there is room
+func (p *Peer) addNeighbor(address, id string) {
+	if _, _, err := net.SplitHostPort(address); err != nil || address == p.selfAddress() {
+		return
+	}
+
+	p.neighborsMutex.Lock()
+	defer p.neighborsMutex.Unlock()
+	if _, known := p.neighbors[address]; !known && len(p.neighbors) < maxNeighbors {
+		p.neighbors[address] = &Neighbor{ID: id, Address: address, LastSeen: time.Now()}
+	}
+}
+
+// Neighbor addresses in random order, without exclude
+func (p *Peer) neighborAddresses(exclude string) []string {
+	p.neighborsMutex.Lock()
+	addresses := make([]string, 0, len(p.neighbors))
+	for address := range p.neighbors {
+		if address != exclude {
+			addresses = append(addresses, address)
+		}
+	}
+	p.neighborsMutex.Unlock()
+
+	mathrand.Shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+	return addresses
+}
+
+// Track whether a neighbor answers; neighbors that fail repeatedly are
+// dropped
+func (p *Peer) recordNeighbor(address string, err error) {
+	p.neighborsMutex.Lock()
+	defer p.neighborsMutex.Unlock()
+
+	neighbor, known := p.neighbors[address]
+	if !known {
+		return
+	}
+	if err == nil {
+		neighbor.Failures = 0
+		neighbor.LastSeen = time.Now()
+		return
+	}
+	neighbor.Failures++
+	if neighbor.Failures >= maxNeighborFailures {
+		delete(p.neighbors, address)
+		log.Printf("🕸️ Dropped unresponsive neighbor %s", address)
+	}
+}
+
+func (p *Peer) neighborsPath() string {
+	return filepath.Join(p.Config.StateDirectory, "neighbors.json")
+}
+
+// Reload the neighbors cached by a previous run, so searches work even if
+// the super-peer is down from the start
+func (p *Peer) loadNeighbors() {
+	data, err := os.ReadFile(p.neighborsPath())
+	if err != nil {
+		return
+	}
+	var neighbors []Neighbor
+	if err := json.Unmarshal(data, &neighbors); err != nil {
+		log.Printf("⚠️ Ignoring unreadable neighbor cache: %v", err)
+		return
+	}
+
+	p.neighborsMutex.Lock()
+	for i := range neighbors {
+		if len(p.neighbors) < maxNeighbors {
+			p.neighbors[neighbors[i].Address] = &neighbors[i]
+		}
+	}
+	p.neighborsMutex.Unlock()
+}
+
+func (p *Peer) saveNeighbors() {
+	p.neighborsMutex.Lock()
+	neighbors := make([]Neighbor, 0, len(p.neighbors))
+	for _, neighbor := range p.neighbors {
+		neighbors = append(neighbors, *neighbor)
+	}
+	p.neighborsMutex.Unlock()
+
+	data, err := json.MarshalIndent(neighbors, "", "  ")
+	if err != nil {
+		return
+	}
+	tmpPath := p.neighborsPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err == nil {
+		os.Rename(tmpPath, p.neighborsPath())
+	}
+}
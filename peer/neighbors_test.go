@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSentFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		from   string
+		want   bool
+	}{
+		{"same host", "10.0.0.5:41234", "10.0.0.5:9001", true},
+		{"other host", "10.0.0.5:41234", "10.0.0.6:9001", false},
+		{"ipv6", "[::1]:41234", "[::1]:9001", true},
+		{"hostname", "127.0.0.1:41234", "localhost:9001", false},
+		{"no port", "10.0.0.5:41234", "10.0.0.5", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/network/query", nil)
+		r.RemoteAddr = tt.remote
+		if got := sentFrom(r, tt.from); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwardedSearchOnlyAddsSender(t *testing.T) {
+	p := &Peer{
+		Address:     "127.0.0.1",
+		Port:        9001,
+		SharedFiles: make(map[string]*SharedFile),
+		neighbors:   make(map[string]*Neighbor),
+		seenQueries: make(map[string]time.Time),
+	}
+
+	for _, from := range []string{"10.0.0.6:9001", "10.0.0.5:9002"} {
+		r := httptest.NewRequest("GET", "/?query_id=q"+from+"&q=x&mode=flood&ttl=1&from="+from, nil)
+		r.RemoteAddr = "10.0.0.5:41234"
+		p.forwardedSearchHandler(httptest.NewRecorder(), r)
+	}
+
+	if len(p.neighbors) != 1 || p.neighbors["10.0.0.5:9002"] == nil {
+		t.Fatalf("got neighbors %v, want only the sending host", p.neighbors)
+	}
+}
@@ -0,0 +1,186 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"sp/merkle"
+)
+
+// downloadState is the sidecar saved next to a .part file so that a download
+// can resume after a crash or restart
+type downloadState struct {
+	Hash      string        `json:"hash"`
+	Filename  string        `json:"filename"`
+	Manifest  PieceManifest `json:"manifest"`
+	Completed []int         `json:"completed"`
+	UpdatedAt time.Time     `json:"updated_at"`
+}
+
+// Directory holding partial downloads
+func (p *Peer) partialDirectory() string {
+	return filepath.Join(p.Config.StateDirectory, "downloads")
+}
+
+func (p *Peer) partialPaths(hash string) (partPath, statePath string) {
+	base := filepath.Join(p.partialDirectory(), hash)
+	return base + ".part", base + ".part.json"
+}
+
+func (p *Peer) removePartialDownload(hash string) error {
+	partPath, statePath := p.partialPaths(hash)
+	os.Remove(statePath)
+	return os.Remove(partPath)
+}
+
+// Restart every download that has partial state on disk
+func (p *Peer) resumeDownloads() {
+	statePaths, _ := filepath.Glob(filepath.Join(p.partialDirectory(), "*.part.json"))
+	for _, statePath := range statePaths {
+		state, err := loadDownloadState(statePath)
+		if err != nil {
+			log.Printf("⚠️ Ignoring unreadable download state %s: %v", statePath, err)
+			continue
+		}
+		if p.startDownload(state.Hash, state.Filename) {
+			log.Printf("⏯️ Resuming download: %s", state.Filename)
+		}
+	}
+}
+
+// Load the manifest and completed pieces of an earlier attempt, provided its
+// manifest still matches the trusted Merkle root and registered size
+func resumeState(statePath, hash, root string, size int64) (*PieceManifest, []int) {
+	state, err := loadDownloadState(statePath)
+	if err != nil || state.Hash != hash || state.Manifest.Size != size {
+		return nil, nil
+	}
+
+	manifest := state.Manifest
+	if int64(len(manifest.PieceHashes)) != pieceCount(manifest.Size, manifest.PieceSize) {
+		return nil, nil
+	}
+	if computed, err := merkle.Root(manifest.PieceHashes); root == "" || err != nil || computed != root {
+		return nil, nil
+	}
+	return &manifest, state.Completed
+}
+
+func loadDownloadState(statePath string) (*downloadState, error) {
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if !isContentHash(state.Hash) || state.Manifest.PieceSize <= 0 {
+		return nil, os.ErrInvalid
+	}
+	return &state, nil
+}
+
+// Re-hash the pieces an earlier attempt completed and keep the valid ones.
+// Returns the number of bytes recovered.
+func (d *swarmDownload) verifyCompleted(part *os.File, completed []int) int64 {
+	buf := make([]byte, d.manifest.PieceSize)
+
+	var recovered int64
+	for _, index := range completed {
+		if index < 0 || index >= len(d.completed) {
+			continue
+		}
+
+		n, err := part.ReadAt(buf, int64(index)*d.manifest.PieceSize)
+		if err != nil && err != io.EOF {
+			continue
+		}
+		if merkle.HashPiece(buf[:n]) != d.manifest.PieceHashes[index] {
+			continue
+		}
+
+		d.completed[index] = true
+		recovered += int64(n)
+	}
+
+	atomic.StoreInt64(&d.downloaded, recovered)
+	d.resumed = recovered
+	return recovered
+}
+
+// Flush the .part file and then record which pieces it holds. The state is
+// captured before the flush, so it never claims a piece that is not on disk.
+func (d *swarmDownload) checkpoint(part *os.File, statePath string) error {
+	d.mutex.Lock()
+	if d.manifest == nil {
+		d.mutex.Unlock()
+		return nil
+	}
+	state := downloadState{
+		Hash:      d.hash,
+		Filename:  d.filename,
+		Manifest:  *d.manifest,
+		Completed: []int{},
+		UpdatedAt: time.Now(),
+	}
+	for index, done := range d.completed {
+		if done {
+			state.Completed = append(state.Completed, index)
+		}
+	}
+	d.mutex.Unlock()
+
+	if err := part.Sync(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// Move a completed download into place, copying when the state and shared
+// directories are on different filesystems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	} else if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -2,31 +2,61 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
+
+	"sp/dht"
+	"sp/fileid"
+	"sp/identity"
+	"sp/merkle"
+	"sp/pagination"
+	"sp/search"
 )
 
 // Configuration
 type PeerConfig struct {
-	Port              int    `json:"port"`
-	SuperPeerAddress  string `json:"super_peer_address"`
-	SharedDirectory   string `json:"shared_directory"`
-	MaxFileSize       int64  `json:"max_file_size"`
-	HeartbeatInterval int    `json:"heartbeat_interval"`
+	Port              int      `json:"port"`
+	Address           string   `json:"address"`
+	SuperPeerAddress  string   `json:"super_peer_address"`
+	SuperPeers        []string `json:"super_peers"` // failover order, starting with SuperPeerAddress
+	SharedDirectory   string   `json:"shared_directory"`
+	StateDirectory    string   `json:"state_directory"`
+	MaxFileSize       int64    `json:"max_file_size"`
+	HeartbeatInterval int      `json:"heartbeat_interval"`
+	ShutdownTimeout   int      `json:"shutdown_timeout"`
+	DHT               bool     `json:"dht"`
+	DHTBootstrap      []string `json:"dht_bootstrap,omitempty"`
+	RotateIdentity    bool     `json:"-"`
+
+	// Upload limits; rates are bytes per second, 0 for unlimited
+	UploadRate          int64    `json:"upload_rate"`
+	UploadRatePerClient int64    `json:"upload_rate_per_client"`
+	UploadSlots         int      `json:"upload_slots"` // 0 for unlimited
+	UploadQueue         int      `json:"upload_queue"`
+	UploadSchedule      []string `json:"upload_schedule,omitempty"` // "HH:MM-HH:MM=RATE", overriding UploadRate
+
+	ConfigFile string `json:"config_file,omitempty"`
 }
 
 // Peer represents this peer instance
@@ -41,11 +71,41 @@ type Peer struct {
 	DownloadStats DownloadStats          `json:"download_stats"`
 	UploadStats   UploadStats            `json:"upload_stats"`
 	mutex         sync.RWMutex
+
+	uploads *uploadLimiter
+
+	identity *identity.Identity
+
+	downloads      map[string]*swarmDownload
+	downloadsMutex sync.RWMutex
+
+	ctx       context.Context // cancelled when the peer starts shutting down
+	services  sync.WaitGroup
+	transfers sync.WaitGroup // running swarm downloads
+
+	superPeerIndex    int // index in Config.SuperPeers of the super-peer in use
+	superPeerMutex    sync.RWMutex
+	registering       atomic.Bool
+	heartbeatFailures int
+
+	neighbors      map[string]*Neighbor // by address
+	neighborsMutex sync.Mutex
+	seenQueries    map[string]time.Time // decentralized search IDs already answered
+	queriesMutex   sync.Mutex
+
+	dht *dht.Node // nil unless DHT mode is on
+
+	unshared map[string]bool // relative paths of unshared files and folders, guarded by mutex
+
+	hashes    *hashCache
+	scanMutex sync.Mutex // one scan of the shared directory at a time
 }
 
 type SharedFile struct {
 	ID          string    `json:"id"`
 	Filename    string    `json:"filename"`
+	Path        string    `json:"path"`   // relative to the shared directory, with forward slashes
+	Folder      string    `json:"folder"` // directory of Path, "" at the top level
 	FilePath    string    `json:"file_path"`
 	Size        int64     `json:"size"`
 	Hash        string    `json:"hash"`
@@ -54,6 +114,16 @@ type SharedFile struct {
 	SharedAt    time.Time `json:"shared_at"`
 	Downloads   int       `json:"downloads"`
 	IsAvailable bool      `json:"is_available"`
+	MerkleRoot  string    `json:"merkle_root"`
+	PieceSize   int64     `json:"piece_size"`
+	PieceHashes []string  `json:"piece_hashes,omitempty"`
+}
+
+// SearchResult is a shared file matching a local search
+type SearchResult struct {
+	*SharedFile
+	Score      float64       `json:"score"`
+	Highlights []search.Span `json:"highlights,omitempty"`
 }
 
 type DownloadStats struct {
@@ -63,9 +133,14 @@ type DownloadStats struct {
 }
 
 type UploadStats struct {
-	TotalUploads  int64 `json:"total_uploads"`
-	TotalBytes    int64 `json:"total_bytes"`
-	ActiveUploads int   `json:"active_uploads"`
+	TotalUploads    int64 `json:"total_uploads"`
+	TotalBytes      int64 `json:"total_bytes"`
+	ActiveUploads   int   `json:"active_uploads"`
+	QueuedUploads   int   `json:"queued_uploads"`
+	RejectedUploads int64 `json:"rejected_uploads"` // turned away with 503
+	Slots           int   `json:"slots"`            // 0 for unlimited
+	RateLimit       int64 `json:"rate_limit"`       // bytes per second in effect now, 0 for unlimited
+	ClientRateLimit int64 `json:"client_rate_limit"`
 }
 
 type DownloadProgress struct {
@@ -84,39 +159,50 @@ var (
 )
 
 func StartPeerServer() {
+	// Load configuration from the config file, environment and flags
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+	if cfg.ConfigFile != "" {
+		log.Printf("⚙️ Loaded configuration from %s", cfg.ConfigFile)
+	}
+
+	// Stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize peer
 	p := &Peer{
 		SharedFiles: make(map[string]*SharedFile),
-		Config: PeerConfig{
-			Port:              9001, // Default port
-			SuperPeerAddress:  "localhost:8080",
-			SharedDirectory:   "./shared_files",
-			MaxFileSize:       100 * 1024 * 1024, // 100MB
-			HeartbeatInterval: 30,                // seconds
-		},
+		downloads:   make(map[string]*swarmDownload),
+		neighbors:   make(map[string]*Neighbor),
+		seenQueries: make(map[string]time.Time),
+		unshared:    make(map[string]bool),
+		uploads:     newUploadLimiter(cfg),
+		Config:      cfg,
+		Address:     cfg.Address,
+		Port:        cfg.Port,
+		ctx:         ctx,
 	}
 
-	// Override port from environment variable if set
-	if os.Getenv("PEER_PORT") != "" {
-		portStr := strings.TrimSpace(os.Getenv("PEER_PORT"))
-		if port, err := strconv.Atoi(portStr); err == nil {
-			p.Config.Port = port
-		} else {
-			log.Printf("ERROR: Failed to parse PEER_PORT '%s': %v", portStr, err)
-		}
-	}
-	p.Port = p.Config.Port // Ensure p.Port is updated from config
-	log.Printf("DEBUG: Peer will attempt to listen on port: %d", p.Config.Port)
+	// Create the peer identity (this will set p.ID)
+	p.loadIdentity()
 
-	// Load configuration (this will set p.Address and p.ID)
-	p.loadConfig()
-
-	// Create shared directory
+	// Create shared and state directories
 	os.MkdirAll(p.Config.SharedDirectory, 0755)
+	os.MkdirAll(p.partialDirectory(), 0755)
+	p.loadUnshared()
+	p.hashes = loadHashCache(filepath.Join(p.Config.StateDirectory, "hashes.json"))
 
 	// Start services
+	p.services.Add(3)
 	go p.heartbeatService()
 	go p.fileWatcherService()
+	go p.neighborService()
+	if p.Config.DHT {
+		p.startDHT()
+	}
 
 	// Setup routes
 	router := mux.NewRouter()
@@ -124,13 +210,34 @@ func StartPeerServer() {
 	// API routes
 	api := router.PathPrefix("/api/v1").Subrouter()
 	api.HandleFunc("/info", p.getPeerInfoHandler).Methods("GET")
+	api.HandleFunc("/config", p.getConfigHandler).Methods("GET")
 	api.HandleFunc("/files", p.getFilesHandler).Methods("GET")
 	api.HandleFunc("/files/share", p.shareFileHandler).Methods("POST")
 	api.HandleFunc("/files/unshare/{fileId}", p.unshareFileHandler).Methods("DELETE")
-	api.HandleFunc("/download/{fileId}", p.downloadFileHandler).Methods("GET")
+	api.HandleFunc("/folders", p.browseFolderHandler).Methods("GET")
+	api.HandleFunc("/folders/share", p.shareFolderHandler).Methods("POST")
+	api.HandleFunc("/folders/unshare", p.unshareFolderHandler).Methods("DELETE")
+	api.HandleFunc("/download/{fileId}", p.downloadFileHandler).Methods("GET", "HEAD")
 	api.HandleFunc("/upload", p.uploadFileHandler).Methods("POST")
 	api.HandleFunc("/stats", p.getStatsHandler).Methods("GET")
 	api.HandleFunc("/search", p.searchFilesHandler).Methods("GET")
+	api.HandleFunc("/search/network", p.networkSearchHandler).Methods("GET")
+	api.HandleFunc("/neighbors", p.getNeighborsHandler).Methods("GET")
+	api.HandleFunc("/ratings", p.rateFileHandler).Methods("POST")
+	api.HandleFunc("/downloads", p.startDownloadHandler).Methods("POST")
+	api.HandleFunc("/downloads", p.getDownloadsHandler).Methods("GET")
+	api.HandleFunc("/downloads/{hash}", p.cancelDownloadHandler).Methods("DELETE")
+	api.HandleFunc("/content/{hash}", p.getContentHandler).Methods("GET", "HEAD")
+	api.HandleFunc("/content/{hash}/pieces", p.getPieceManifestHandler).Methods("GET")
+	api.HandleFunc("/content/{hash}/pieces/{index}/proof", p.getPieceProofHandler).Methods("GET")
+	api.HandleFunc("/dht", p.getDHTHandler).Methods("GET")
+	if p.dht != nil {
+		api.HandleFunc("/dht/providers/{hash}", p.getProvidersHandler).Methods("GET")
+		api.HandleFunc("/dht/ping", p.dht.HandlePing).Methods("POST")
+		api.HandleFunc("/dht/find_node", p.dht.HandleFindNode).Methods("POST")
+		api.HandleFunc("/dht/find_value", p.dht.HandleFindValue).Methods("POST")
+		api.HandleFunc("/dht/store", p.dht.HandleStore).Methods("POST")
+	}
 
 	// WebSocket endpoint
 	router.HandleFunc("/ws", p.websocketHandler)
@@ -150,72 +257,176 @@ func StartPeerServer() {
 
 	fmt.Printf("🚀 Professional P2P Peer Server starting on :%d\n", p.Config.Port)
 	fmt.Printf("📁 Shared Directory: %s\n", p.Config.SharedDirectory)
-	fmt.Printf("🔗 Super-Peer: %s\n", p.Config.SuperPeerAddress)
+	fmt.Printf("🔗 Super-Peer: %s\n", strings.Join(p.Config.SuperPeers, ", "))
 	fmt.Printf("🌐 Web Interface: http://localhost:%d\n", p.Config.Port)
 
 	// Register with super-peer
 	go p.registerWithSuperPeer()
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", p.Config.Port), handler))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", p.Config.Port), Handler: handler}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	p.shutdown(server)
+}
+
+// Leave the network cleanly: deregister so the super-peer stops sending
+// clients here, let in-flight uploads finish, checkpoint running downloads
+// for resume and disconnect WebSocket clients
+func (p *Peer) shutdown(server *http.Server) {
+	log.Println("🛑 Shutting down peer...")
+
+	if p.IsRegistered {
+		p.deregisterFromSuperPeer()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Config.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("⚠️ Uploads still in flight at shutdown: %v", err)
+	}
+
+	// Downloads stop at the next piece boundary once p.ctx is cancelled
+	p.transfers.Wait()
+	p.services.Wait()
+	closeWebSockets()
+
+	log.Println("👋 Peer stopped")
 }
 
-func (p *Peer) loadConfig() {
-	// Load configuration from file or environment variables
-	// For now, using defaults
-	p.Address = "127.0.0.1"
-	p.ID = generatePeerID(p.Address, p.Port)
+func (p *Peer) deregisterFromSuperPeer() {
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/peers/deregister", p.superPeerAddress()), nil)
+	if err != nil {
+		log.Printf("⚠️ Failed to deregister from super-peer: %v", err)
+		return
+	}
+	resp.Body.Close()
 
-	// Debugging: Print PEER_PORT environment variable
-	log.Printf("DEBUG: PEER_PORT environment variable: %s", os.Getenv("PEER_PORT"))
+	if resp.StatusCode == http.StatusOK {
+		p.IsRegistered = false
+		log.Println("✅ Deregistered from super-peer")
+	} else {
+		log.Printf("⚠️ Super-peer rejected deregistration: %s", resp.Status)
+	}
+}
+
+// The peer ID is derived from the public key the super-peer verifies our
+// requests with. The key is kept in the state directory so the peer comes
+// back under the same ID, with its reputation and files. A rotated key
+// keeps a proof signed by the old one, which lets the super-peer hand the
+// old ID's records to the new one.
+func (p *Peer) loadIdentity() {
+	path := filepath.Join(p.Config.StateDirectory, "identity.json")
+	id, err := identity.Load(path)
+	switch {
+	case err == nil && p.Config.RotateIdentity:
+		previous := id
+		if id, err = previous.Rotate(); err != nil {
+			log.Fatalf("❌ Failed to rotate peer identity: %v", err)
+		}
+		if err := id.Save(path); err != nil {
+			log.Fatalf("❌ Failed to save rotated peer identity: %v", err)
+		}
+		log.Printf("🔑 Rotated peer identity %s to %s", previous.ID, id.ID)
+	case err == nil:
+		log.Printf("🔑 Loaded peer identity %s", id.ID)
+	case errors.Is(err, os.ErrNotExist):
+		if id, err = identity.Generate(); err != nil {
+			log.Fatalf("❌ Failed to generate peer identity: %v", err)
+		}
+		if err := id.Save(path); err != nil {
+			log.Printf("⚠️ Failed to save peer identity, a new one will be made on restart: %v", err)
+		}
+		log.Printf("🔑 Generated peer identity %s", id.ID)
+	default:
+		log.Fatalf("❌ Failed to load peer identity from %s: %v", path, err)
+	}
+	p.identity = id
+	p.ID = id.ID
 }
 
 func (p *Peer) initializePeer() {
 	// Scan shared directory for existing files
-	p.scanSharedDirectory()
+	p.scanPath("")
 
 	log.Printf("✅ Peer initialized with ID: %s", p.ID)
 	log.Printf("📂 Found %d shared files", len(p.SharedFiles))
 }
 
-func (p *Peer) scanSharedDirectory() {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+// Build the entry of a file in the shared directory, hashing its content
+// unless the hash cache has it
+func (p *Peer) newSharedFile(filePath string, info os.FileInfo) *SharedFile {
+	rel := p.relativePath(filePath)
+	filename := path.Base(rel)
+	digest, _ := p.fileDigest(filePath, rel, info)
 
-	filepath.Walk(p.Config.SharedDirectory, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
+	return &SharedFile{
+		ID:          fileid.Derive(digest.Hash, p.ID, rel),
+		Filename:    filename,
+		Path:        rel,
+		Folder:      folderOf(rel),
+		FilePath:    filePath,
+		Size:        info.Size(),
+		Hash:        digest.Hash,
+		MerkleRoot:  digest.MerkleRoot,
+		PieceSize:   defaultPieceSize,
+		PieceHashes: digest.PieceHashes,
+		Category:    categorizeFile(filename),
+		Tags:        extractTags(filename),
+		SharedAt:    time.Now(),
+		IsAvailable: true,
+	}
+}
 
-		fileID := generateFileID(info.Name(), p.ID)
-
-		// Calculate file hash
-		hash, _ := calculateFileHash(path)
-
-		sharedFile := &SharedFile{
-			ID:          fileID,
-			Filename:    info.Name(),
-			FilePath:    path,
-			Size:        info.Size(),
-			Hash:        hash,
-			Category:    categorizeFile(info.Name()),
-			Tags:        extractTags(info.Name()),
-			SharedAt:    time.Now(),
-			IsAvailable: true,
+// Add a shared file, replacing the entry previously shared at the same path.
+// A replaced entry with other content is unregistered.
+func (p *Peer) addSharedFile(file *SharedFile) {
+	p.mutex.Lock()
+	var replaced *SharedFile
+	for id, existing := range p.SharedFiles {
+		if existing.Path == file.Path {
+			delete(p.SharedFiles, id)
+			replaced = existing
 		}
+	}
+	p.SharedFiles[file.ID] = file
+	p.mutex.Unlock()
 
-		p.SharedFiles[fileID] = sharedFile
-		return nil
-	})
+	if replaced != nil && replaced.Hash != file.Hash {
+		go p.unregisterFileWithSuperPeer(replaced)
+	}
 }
 
 func (p *Peer) registerWithSuperPeer() {
-	for {
+	if !p.registering.CompareAndSwap(false, true) {
+		return // Already registering
+	}
+	defer p.registering.Store(false)
+
+	for attempt := 1; p.ctx.Err() == nil; attempt++ {
 		if p.registerPeer() {
-			log.Println("✅ Successfully registered with super-peer")
+			log.Printf("✅ Successfully registered with super-peer %s", p.superPeerAddress())
+			p.resumeDownloads()
+			p.refreshNeighbors()
 			return
 		}
+
+		// Try every configured super-peer before waiting
+		if attempt%len(p.Config.SuperPeers) != 0 {
+			log.Printf("❌ Failed to register with super-peer %s", p.superPeerAddress())
+			p.failover()
+			continue
+		}
 		log.Println("❌ Failed to register with super-peer, retrying in 10 seconds...")
-		time.Sleep(10 * time.Second)
+		p.failover()
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
@@ -226,16 +437,15 @@ func (p *Peer) registerPeer() bool {
 		"port":         p.Port,
 		"shared_files": len(p.SharedFiles),
 		"region":       "local", // Could be determined by IP geolocation
+		"public_key":   identity.EncodePublicKey(p.identity.PublicKey),
+	}
+	if p.identity.Previous != nil {
+		peerData["previous"] = p.identity.Previous
 	}
 
 	jsonData, _ := json.Marshal(peerData)
 
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/api/v1/peers/register", p.Config.SuperPeerAddress),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
-
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/peers/register", p.superPeerAddress()), jsonData)
 	if err != nil {
 		return false
 	}
@@ -269,121 +479,104 @@ func (p *Peer) registerAllFiles() {
 func (p *Peer) registerFileWithSuperPeer(file *SharedFile) {
 	fileData := map[string]interface{}{
 		"filename":     file.Filename,
+		"path":         file.Path,
 		"size":         file.Size,
 		"hash":         file.Hash,
 		"category":     file.Category,
 		"tags":         file.Tags,
+		"merkle_root":  file.MerkleRoot,
+		"piece_size":   file.PieceSize,
+		"piece_hashes": file.PieceHashes,
 		"owner":        p.ID,
 		"peer_address": fmt.Sprintf("%s:%d", p.Address, p.Port),
 	}
 
 	jsonData, _ := json.Marshal(fileData)
 
-	resp, err := http.Post(
-		fmt.Sprintf("http://%s/api/v1/files/register", p.Config.SuperPeerAddress),
-		"application/json",
-		bytes.NewBuffer(jsonData),
-	)
-
+	p.announceFile(file)
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/files/register", p.superPeerAddress()), jsonData)
 	if err == nil {
 		resp.Body.Close()
 	}
 }
 
-func (p *Peer) heartbeatService() {
-	ticker := time.NewTicker(time.Duration(p.Config.HeartbeatInterval) * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		p.sendHeartbeat()
+// Tell the super-peer we stopped sharing a file's content, unless another
+// shared file still has the same content
+func (p *Peer) unregisterFileWithSuperPeer(file *SharedFile) {
+	// Other paths with the same content are still shared
+	if p.findFileByHash(file.Hash) == nil {
+		p.withdrawFile(file)
 	}
-}
 
-func (p *Peer) sendHeartbeat() {
-	if !p.IsRegistered {
+	jsonData, _ := json.Marshal(map[string]interface{}{
+		"hash": file.Hash,
+		"path": file.Path,
+	})
+
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/files/unregister", p.superPeerAddress()), jsonData)
+	if err != nil {
+		log.Printf("⚠️ Failed to unregister %s from super-peer: %v", file.Filename, err)
 		return
 	}
+	resp.Body.Close()
+}
 
-	req, _ := http.NewRequest("POST",
-		fmt.Sprintf("http://%s/api/v1/peers/heartbeat", p.Config.SuperPeerAddress),
-		nil)
-	req.Header.Set("X-Peer-ID", p.ID)
+// POST a JSON body to the super-peer, signed with the peer's identity
+func (p *Peer) postSigned(url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	p.identity.Sign(req, body)
 
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err == nil {
-		resp.Body.Close()
-		p.LastHeartbeat = time.Now()
-	}
+	return client.Do(req)
 }
 
-func (p *Peer) fileWatcherService() {
-	ticker := time.NewTicker(30 * time.Second)
+func (p *Peer) heartbeatService() {
+	defer p.services.Done()
+	ticker := time.NewTicker(time.Duration(p.Config.HeartbeatInterval) * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		p.scanForNewFiles()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.sendHeartbeat()
+		}
 	}
 }
 
-func (p *Peer) scanForNewFiles() {
-	currentFiles := make(map[string]bool)
-
-	filepath.Walk(p.Config.SharedDirectory, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() {
-			return nil
-		}
-
-		filename := info.Name()
-		fileID := generateFileID(filename, p.ID)
-		currentFiles[fileID] = true
-
-		p.mutex.RLock()
-		_, exists := p.SharedFiles[fileID]
-		p.mutex.RUnlock()
-
-		if !exists {
-			// New file detected
-			hash, _ := calculateFileHash(path)
-
-			sharedFile := &SharedFile{
-				ID:          fileID,
-				Filename:    filename,
-				FilePath:    path,
-				Size:        info.Size(),
-				Hash:        hash,
-				Category:    categorizeFile(filename),
-				Tags:        extractTags(filename),
-				SharedAt:    time.Now(),
-				IsAvailable: true,
-			}
-
-			p.mutex.Lock()
-			p.SharedFiles[fileID] = sharedFile
-			p.mutex.Unlock()
-
-			// Register with super-peer
-			go p.registerFileWithSuperPeer(sharedFile)
-
-			// Broadcast to WebSocket clients
-			p.broadcastUpdate("file_added", sharedFile)
+func (p *Peer) sendHeartbeat() {
+	if !p.IsRegistered {
+		return
+	}
 
-			log.Printf("📁 New file detected: %s", filename)
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/peers/heartbeat", p.superPeerAddress()), nil)
+	if err != nil {
+		// Move to the next super-peer once this one has missed a few
+		p.heartbeatFailures++
+		if p.heartbeatFailures >= maxHeartbeatFailures && p.failover() {
+			p.heartbeatFailures = 0
+			p.IsRegistered = false
+			go p.registerWithSuperPeer()
 		}
+		return
+	}
+	resp.Body.Close()
+	p.heartbeatFailures = 0
 
-		return nil
-	})
-
-	// Check for removed files
-	p.mutex.Lock()
-	for fileID, file := range p.SharedFiles {
-		if !currentFiles[fileID] {
-			delete(p.SharedFiles, fileID)
-			p.broadcastUpdate("file_removed", file)
-			log.Printf("📁 File removed: %s", file.Filename)
-		}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		p.LastHeartbeat = time.Now()
+	case http.StatusNotFound, http.StatusUnauthorized:
+		// The super-peer no longer knows us (or our key), register again
+		log.Printf("⚠️ Heartbeat rejected (%s), re-registering", resp.Status)
+		p.IsRegistered = false
+		go p.registerWithSuperPeer()
 	}
-	p.mutex.Unlock()
 }
 
 // HTTP Handlers
@@ -396,8 +589,9 @@ func (p *Peer) getPeerInfoHandler(w http.ResponseWriter, r *http.Request) {
 		"is_registered":  p.IsRegistered,
 		"shared_files":   len(p.SharedFiles),
 		"last_heartbeat": p.LastHeartbeat,
+		"super_peer":     p.superPeerAddress(),
 		"download_stats": p.DownloadStats,
-		"upload_stats":   p.UploadStats,
+		"upload_stats":   p.uploads.stats(p.UploadStats),
 		"config":         p.Config,
 	}
 	p.mutex.RUnlock()
@@ -406,71 +600,119 @@ func (p *Peer) getPeerInfoHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(info)
 }
 
+// Effective configuration after applying the file, environment and flags
+func (p *Peer) getConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Config)
+}
+
+// List endpoints are ordered by ID and paginated with page_size and cursor
 func (p *Peer) getFilesHandler(w http.ResponseWriter, r *http.Request) {
 	p.mutex.RLock()
-	files := make([]*SharedFile, 0, len(p.SharedFiles))
+	files := make([]SharedFile, 0, len(p.SharedFiles))
 	for _, file := range p.SharedFiles {
 		if file.IsAvailable {
-			files = append(files, file)
+			files = append(files, *file)
 		}
 	}
 	p.mutex.RUnlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(files)
+	pagination.WriteList(w, r, files,
+		func(a, b SharedFile) bool { return a.ID < b.ID },
+		func(f SharedFile) SharedFile { return SharedFile{ID: f.ID} })
 }
 
+// Share uploaded files. Each file part may name a path relative to the
+// shared directory, e.g. "albums/2024/cover.jpg" when a browser uploads a
+// folder, and an optional "folder" field puts every file under that folder.
 func (p *Peer) shareFileHandler(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("file")
-	if err != nil {
+	if err := r.ParseMultipartForm(32 << 20); err != nil || len(r.MultipartForm.File["file"]) == 0 {
 		http.Error(w, "File required", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	defer r.MultipartForm.RemoveAll()
 
-	// Check file size
-	if header.Size > p.Config.MaxFileSize {
-		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	folder, err := cleanRelativePath(r.FormValue("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Save file
-	filename := header.Filename
-	filePath := filepath.Join(p.Config.SharedDirectory, filename)
+	// Check every file before saving any
+	headers := r.MultipartForm.File["file"]
+	paths := make([]string, len(headers))
+	for i, header := range headers {
+		rel, err := cleanRelativePath(uploadPath(header))
+		if err != nil || rel == "" {
+			http.Error(w, fmt.Sprintf("Invalid file path %q", uploadPath(header)), http.StatusBadRequest)
+			return
+		}
+		paths[i] = path.Join(folder, rel)
 
-	dst, err := os.Create(filePath)
-	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+		// Check file size
+		if header.Size > p.Config.MaxFileSize {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if p.isUnshared(folderOf(paths[i])) {
+			http.Error(w, "Folder is unshared, share it again first", http.StatusConflict)
+			return
+		}
 	}
-	defer dst.Close()
 
-	written, err := io.Copy(dst, file)
-	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	fileIDs := make([]string, 0, len(headers))
+	for i, header := range headers {
+		sharedFile, err := p.saveUpload(header, paths[i])
+		if err != nil {
+			log.Printf("❌ Failed to save %s: %v", paths[i], err)
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+		fileIDs = append(fileIDs, sharedFile.ID)
 	}
 
-	// Calculate hash
-	hash, _ := calculateFileHash(filePath)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"file_id":  fileIDs[0],
+		"file_ids": fileIDs,
+		"message":  "File shared successfully",
+	})
+}
 
-	// Create shared file entry
-	fileID := generateFileID(filename, p.ID)
-	sharedFile := &SharedFile{
-		ID:          fileID,
-		Filename:    filename,
-		FilePath:    filePath,
-		Size:        written,
-		Hash:        hash,
-		Category:    categorizeFile(filename),
-		Tags:        extractTags(filename),
-		SharedAt:    time.Now(),
-		IsAvailable: true,
+// Write an uploaded file at a path relative to the shared directory and
+// share it
+func (p *Peer) saveUpload(header *multipart.FileHeader, rel string) (*SharedFile, error) {
+	src, err := header.Open()
+	if err != nil {
+		return nil, err
 	}
+	defer src.Close()
 
-	p.mutex.Lock()
-	p.SharedFiles[fileID] = sharedFile
-	p.mutex.Unlock()
+	// Save file
+	filePath := filepath.Join(p.Config.SharedDirectory, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return nil, err
+	}
+	dst, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	written, err := io.Copy(dst, src)
+	dst.Close()
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sharing a path again undoes an earlier unshare of it
+	p.setUnshared(rel, false)
+
+	sharedFile := p.newSharedFile(filePath, info)
+	p.addSharedFile(sharedFile)
 
 	// Register with super-peer
 	go p.registerFileWithSuperPeer(sharedFile)
@@ -478,14 +720,8 @@ func (p *Peer) shareFileHandler(w http.ResponseWriter, r *http.Request) {
 	// Broadcast update
 	p.broadcastUpdate("file_shared", sharedFile)
 
-	log.Printf("📁 File shared: %s (%d bytes)", filename, written)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":  "success",
-		"file_id": fileID,
-		"message": "File shared successfully",
-	})
+	log.Printf("📁 File shared: %s (%d bytes)", rel, written)
+	return sharedFile, nil
 }
 
 func (p *Peer) downloadFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -517,30 +753,86 @@ func (p *Peer) downloadFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if file still exists on disk
-	log.Printf("DEBUG: Attempting to serve file from path: %s", file.FilePath) // Add this log
-	if _, err := os.Stat(file.FilePath); os.IsNotExist(err) {
-		log.Printf("ERROR: File not found on disk at path: %s, error: %v", file.FilePath, err) // Add this log
+	p.serveSharedFile(w, r, file)
+}
+
+// Serve a shared file with byte-range support. The ETag is the content hash,
+// so If-Range requests only get a partial reply while the content is unchanged.
+// Uploads take one of the upload slots and are paced to the upload rates.
+func (p *Peer) serveSharedFile(w http.ResponseWriter, r *http.Request, file *SharedFile) {
+	client := clientAddress(r)
+	if r.Method == http.MethodGet {
+		if !p.uploads.acquire(r.Context(), client) {
+			rejectUpload(w)
+			return
+		}
+		defer p.uploads.release()
+	}
+
+	f, err := os.Open(file.FilePath)
+	if err != nil {
+		log.Printf("ERROR: File not found on disk at path: %s, error: %v", file.FilePath, err)
 		http.Error(w, "File not available", http.StatusNotFound)
 		return
 	}
+	defer f.Close()
 
-	// Update download stats
-	p.mutex.Lock()
-	file.Downloads++
-	p.DownloadStats.TotalDownloads++
-	p.DownloadStats.TotalBytes += file.Size
-	p.mutex.Unlock()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "File not available", http.StatusNotFound)
+		return
+	}
 
 	// Set headers for download
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.Filename))
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if file.Hash != "" {
+		w.Header().Set("ETag", contentETag(file.Hash))
+	}
 
-	// Serve file with progress tracking
-	http.ServeFile(w, r, file.FilePath)
+	p.mutex.Lock()
+	p.UploadStats.ActiveUploads++
+	p.mutex.Unlock()
+
+	var out http.ResponseWriter = w
+	if p.uploads.throttled() {
+		out = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: p.uploads, client: p.uploads.clientBucket(client)}
+	}
+	counter := &countingWriter{ResponseWriter: out}
+	http.ServeContent(counter, r, file.Filename, info.ModTime(), f)
 
-	log.Printf("📥 File downloaded: %s by %s", file.Filename, r.RemoteAddr)
+	// Update upload stats; ranged requests only count towards bytes
+	p.mutex.Lock()
+	p.UploadStats.ActiveUploads--
+	p.UploadStats.TotalBytes += counter.written
+	if r.Header.Get("Range") == "" && r.Method == "GET" && counter.status == http.StatusOK {
+		file.Downloads++
+		p.UploadStats.TotalUploads++
+		log.Printf("📤 File downloaded: %s by %s", file.Filename, r.RemoteAddr)
+	}
+	p.mutex.Unlock()
+}
+
+// countingWriter records the status and body size of a response
+type countingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.written += int64(n)
+	return n, err
 }
 
 func (p *Peer) uploadFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -554,7 +846,7 @@ func (p *Peer) getStatsHandler(w http.ResponseWriter, r *http.Request) {
 		"peer_id":        p.ID,
 		"shared_files":   len(p.SharedFiles),
 		"download_stats": p.DownloadStats,
-		"upload_stats":   p.UploadStats,
+		"upload_stats":   p.uploads.stats(p.UploadStats),
 		"is_registered":  p.IsRegistered,
 		"last_heartbeat": p.LastHeartbeat,
 	}
@@ -564,38 +856,99 @@ func (p *Peer) getStatsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(stats)
 }
 
+// Search the local shared files. With fuzzy=true filenames are matched with
+// typo tolerance; every result carries a score and the matched spans of its
+// filename. Requests with a query_id are decentralized searches forwarded by
+// other peers.
 func (p *Peer) searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("query_id") {
+		p.forwardedSearchHandler(w, r)
+		return
+	}
+
 	query := strings.ToLower(r.URL.Query().Get("q"))
-	category := r.URL.Query().Get("category")
+	results := p.searchLocal(query, r.URL.Query().Get("category"), r.URL.Query().Get("hash"), r.URL.Query().Get("fuzzy") == "true")
 
+	params, err := pagination.ParseParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := pagination.Paginate(results, params,
+		func(a, b SearchResult) bool {
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+			return a.ID < b.ID
+		},
+		func(result SearchResult) SearchResult {
+			return SearchResult{SharedFile: &SharedFile{ID: result.ID}, Score: result.Score}
+		})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":     page.Items,
+		"count":       len(page.Items),
+		"total":       page.Total,
+		"page_size":   page.PageSize,
+		"next_cursor": page.NextCursor,
+		"query":       query,
+	})
+}
+
+// Shared files matching a lowercase query, optionally restricted to a
+// category or content hash
+func (p *Peer) searchLocal(query, category, hash string, fuzzy bool) []SearchResult {
 	p.mutex.RLock()
-	var results []*SharedFile
+	defer p.mutex.RUnlock()
+
+	var results []SearchResult
 	for _, file := range p.SharedFiles {
-		if !file.IsAvailable {
+		if !file.IsAvailable || (category != "" && file.Category != category) || (hash != "" && file.Hash != hash) {
 			continue
 		}
 
+		result := SearchResult{SharedFile: file}
 		matches := false
-		if query == "" {
+		switch {
+		case query == "":
 			matches = true
-		} else {
-			matches = strings.Contains(strings.ToLower(file.Filename), query) ||
+		case fuzzy:
+			result.Score, result.Highlights, matches = search.FuzzyMatch(query, file.Filename)
+		default:
+			result.Highlights = substringSpans(file.Filename, query)
+			matches = len(result.Highlights) > 0 ||
 				strings.Contains(strings.ToLower(file.Category), query) ||
 				containsTag(file.Tags, query)
+			if matches {
+				result.Score = 1
+			}
 		}
 
-		if matches && (category == "" || file.Category == category) {
-			results = append(results, file)
+		if matches {
+			results = append(results, result)
 		}
 	}
-	p.mutex.RUnlock()
+	return results
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"results": results,
-		"count":   len(results),
-		"query":   query,
-	})
+// Spans of every case-insensitive occurrence of query in text
+func substringSpans(text, query string) []search.Span {
+	lower := strings.ToLower(text)
+	var spans []search.Span
+	for offset := 0; ; {
+		i := strings.Index(lower[offset:], query)
+		if i < 0 {
+			return spans
+		}
+		start := utf8.RuneCountInString(lower[:offset+i])
+		spans = append(spans, search.Span{Start: start, End: start + utf8.RuneCountInString(query)})
+		offset += i + len(query)
+	}
 }
 
 func (p *Peer) unshareFileHandler(w http.ResponseWriter, r *http.Request) {
@@ -614,11 +967,16 @@ func (p *Peer) unshareFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove file from disk (optional)
+	// Remove file from disk (optional), otherwise keep the scanner from
+	// sharing it again
 	if r.URL.Query().Get("delete") == "true" {
 		os.Remove(file.FilePath)
+	} else {
+		p.setUnshared(file.Path, true)
 	}
 
+	go p.unregisterFileWithSuperPeer(file)
+
 	// Broadcast update
 	p.broadcastUpdate("file_unshared", file)
 
@@ -678,6 +1036,19 @@ func (p *Peer) broadcastUpdate(eventType string, data interface{}) {
 	wsMutex.RUnlock()
 }
 
+// Disconnect WebSocket clients with a going-away close frame
+func closeWebSockets() {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "peer shutting down")
+
+	wsMutex.Lock()
+	for conn := range wsConnections {
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		conn.Close()
+		delete(wsConnections, conn)
+	}
+	wsMutex.Unlock()
+}
+
 func (p *Peer) sendPeerInfo(conn *websocket.Conn) {
 	p.mutex.RLock()
 	info := map[string]interface{}{
@@ -697,29 +1068,49 @@ func (p *Peer) serveHomePage(w http.ResponseWriter, r *http.Request) {
 }
 
 // Utility functions
-func generatePeerID(address string, port int) string {
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", address, port, time.Now().Unix())))
-	return fmt.Sprintf("peer_%x", hash)[:16]
-}
 
-func generateFileID(filename, ownerID string) string {
-	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%d", filename, ownerID, time.Now().Unix())))
-	return fmt.Sprintf("file_%x", hash)[:16]
+// FileDigest holds the whole-file hash and the per-piece Merkle data of a file
+type FileDigest struct {
+	Hash        string
+	MerkleRoot  string
+	PieceHashes []string
 }
 
-func calculateFileHash(filePath string) (string, error) {
+// Hash the file and each of its pieces in a single pass
+func calculateFileDigest(filePath string) (FileDigest, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", err
+		return FileDigest{}, err
 	}
 	defer file.Close()
 
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	pieceHashes := []string{}
+	buf := make([]byte, defaultPieceSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			hash.Write(buf[:n])
+			pieceHashes = append(pieceHashes, merkle.HashPiece(buf[:n]))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return FileDigest{}, err
+		}
+	}
+
+	root, err := merkle.Root(pieceHashes)
+	if err != nil {
+		return FileDigest{}, err
 	}
 
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+	return FileDigest{
+		Hash:        fmt.Sprintf("%x", hash.Sum(nil)),
+		MerkleRoot:  root,
+		PieceHashes: pieceHashes,
+	}, nil
 }
 
 func categorizeFile(filename string) string {
@@ -0,0 +1,52 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Rate content on behalf of this peer. The super-peer keeps one vote per
+// peer, so rating again replaces the earlier vote.
+func (p *Peer) rateFileHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hash    string `json:"hash"`
+		Rating  int    `json:"rating"`
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !isContentHash(req.Hash) {
+		http.Error(w, "Hash required", http.StatusBadRequest)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"rating":  req.Rating,
+		"comment": req.Comment,
+	})
+	if err != nil {
+		http.Error(w, "Invalid rating", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/files/ratings/%s", p.superPeerAddress(), req.Hash), jsonData)
+	if err != nil {
+		http.Error(w, "Super-peer unreachable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		log.Printf("⭐ Rated %s: %d/5", req.Hash, req.Rating)
+	}
+
+	// Relay the super-peer's answer, errors included
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
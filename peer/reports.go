@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// DownloadReport tells the super-peer how a download went, so that it counts
+// only completed downloads and can score the sources
+type DownloadReport struct {
+	Hash       string         `json:"hash"`
+	Status     string         `json:"status"` // completed or failed
+	Bytes      int64          `json:"bytes"`
+	DurationMs int64          `json:"duration_ms"`
+	Verified   bool           `json:"verified"`
+	Sources    []SourceReport `json:"sources"`
+}
+
+// SourceReport is what one source contributed to a download
+type SourceReport struct {
+	PeerID     string `json:"peer_id"`
+	Bytes      int64  `json:"bytes"`
+	Pieces     int    `json:"pieces"`
+	Failures   int    `json:"failures"`
+	Mismatches int    `json:"mismatches"`
+}
+
+// Report a finished swarm download, successful or not, to the super-peer
+func (p *Peer) reportDownload(d *swarmDownload, downloadErr error) {
+	report := DownloadReport{
+		Hash:       d.hash,
+		Status:     "completed",
+		Bytes:      atomic.LoadInt64(&d.downloaded) - d.resumed,
+		DurationMs: time.Since(d.startedAt).Milliseconds(),
+	}
+	if downloadErr != nil {
+		report.Status = "failed"
+	}
+
+	d.mutex.Lock()
+	report.Verified = d.verified
+	for _, source := range d.sources {
+		report.Sources = append(report.Sources, SourceReport{
+			PeerID:     d.owners[source],
+			Bytes:      d.served[source],
+			Pieces:     d.delivered[source],
+			Failures:   d.failures[source],
+			Mismatches: d.strikes[source],
+		})
+	}
+	d.mutex.Unlock()
+
+	jsonData, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+
+	resp, err := p.postSigned(fmt.Sprintf("http://%s/api/v1/downloads/report", p.superPeerAddress()), jsonData)
+	if err != nil {
+		log.Printf("⚠️ Failed to report download of %s: %v", d.hash, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("⚠️ Failed to report download of %s: super-peer returned %s", d.hash, resp.Status)
+	}
+}
@@ -0,0 +1,30 @@
+package peer
+
+import "log"
+
+// Consecutive failed heartbeats after which the peer fails over to the next
+// configured super-peer
+const maxHeartbeatFailures = 2
+
+// Address of the super-peer currently in use
+func (p *Peer) superPeerAddress() string {
+	p.superPeerMutex.RLock()
+	defer p.superPeerMutex.RUnlock()
+	return p.Config.SuperPeers[p.superPeerIndex]
+}
+
+// Switch to the next configured super-peer. Returns false if there is no
+// other super-peer to switch to.
+func (p *Peer) failover() bool {
+	if len(p.Config.SuperPeers) < 2 {
+		return false
+	}
+
+	p.superPeerMutex.Lock()
+	p.superPeerIndex = (p.superPeerIndex + 1) % len(p.Config.SuperPeers)
+	address := p.Config.SuperPeers[p.superPeerIndex]
+	p.superPeerMutex.Unlock()
+
+	log.Printf("🔀 Failing over to super-peer %s", address)
+	return true
+}
@@ -0,0 +1,847 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"sp/fileid"
+	"sp/merkle"
+	"sp/pagination"
+)
+
+// Swarm download settings
+const (
+	defaultPieceSize  int64 = 1024 * 1024 // 1MB
+	maxSwarmWorkers         = 8
+	maxSourceStrikes        = 3
+	pieceFetchTimeout       = 60 * time.Second
+	progressInterval        = 500 * time.Millisecond
+	maxBusyRetries          = 12               // rounds of waiting for busy sources per piece
+	maxBusyWait             = 30 * time.Second // longest Retry-After honoured
+)
+
+// busyError is returned for a source whose upload slots are all taken
+type busyError struct {
+	source     string
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("%s is busy, retry in %s", e.source, e.retryAfter)
+}
+
+// RemoteFile is a file record as returned by the super-peer
+type RemoteFile struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"hash"`
+	MerkleRoot  string `json:"merkle_root"`
+	Owner       string `json:"owner"`
+	PeerAddress string `json:"peer_address"`
+}
+
+// PieceManifest describes how a file is split into pieces
+type PieceManifest struct {
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	MerkleRoot  string   `json:"merkle_root"`
+	PieceSize   int64    `json:"piece_size"`
+	PieceHashes []string `json:"piece_hashes"`
+}
+
+// swarmDownload tracks a multi-source download in progress
+type swarmDownload struct {
+	hash       string
+	filename   string
+	size       int64
+	manifest   *PieceManifest
+	merkleRoot string
+	sources    []string
+	owners     map[string]string // source address -> peer ID
+	strikes    map[string]int    // verification failures per source
+	failures   map[string]int    // failed piece requests per source
+	delivered  map[string]int    // verified pieces per source
+	served     map[string]int64  // verified bytes per source
+	verified   bool              // the assembled file matched the content hash
+	completed  []bool            // pieces already written to the .part file
+	downloaded int64             // bytes, updated atomically
+	resumed    int64             // bytes already on disk when the download started
+	startedAt  time.Time
+	progress   DownloadProgress
+	ctx        context.Context // cancelled when the peer shuts down
+	mutex      sync.Mutex
+}
+
+// HTTP Handlers
+
+// Start (or resume) a swarm download of the content with the given hash
+func (p *Peer) startDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Hash     string `json:"hash"`
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !isContentHash(req.Hash) {
+		http.Error(w, "Hash required", http.StatusBadRequest)
+		return
+	}
+
+	if existing := p.findFileByHash(req.Hash); existing != nil {
+		http.Error(w, "File already shared", http.StatusConflict)
+		return
+	}
+
+	if p.ctx.Err() != nil {
+		http.Error(w, "Peer is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !p.startDownload(req.Hash, req.Filename) {
+		http.Error(w, "Download already in progress", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"file_id": req.Hash,
+		"message": "Download started",
+	})
+}
+
+func (p *Peer) getDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	p.downloadsMutex.RLock()
+	downloads := make([]DownloadProgress, 0, len(p.downloads))
+	for _, download := range p.downloads {
+		downloads = append(downloads, download.snapshot())
+	}
+	p.downloadsMutex.RUnlock()
+
+	pagination.WriteList(w, r, downloads,
+		func(a, b DownloadProgress) bool { return a.FileID < b.FileID },
+		func(d DownloadProgress) DownloadProgress { return DownloadProgress{FileID: d.FileID} })
+}
+
+// Cancel a download and discard its partial data
+func (p *Peer) cancelDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !isContentHash(hash) {
+		http.Error(w, "Invalid hash", http.StatusBadRequest)
+		return
+	}
+
+	p.downloadsMutex.RLock()
+	_, active := p.downloads[hash]
+	p.downloadsMutex.RUnlock()
+	if active {
+		http.Error(w, "Download in progress", http.StatusConflict)
+		return
+	}
+
+	if err := p.removePartialDownload(hash); err != nil {
+		http.Error(w, "Download not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "success",
+		"message": "Download cancelled",
+	})
+}
+
+// Serve the full content of a shared file by hash, with Range support
+func (p *Peer) getContentHandler(w http.ResponseWriter, r *http.Request) {
+	file := p.findFileByHash(mux.Vars(r)["hash"])
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	p.serveSharedFile(w, r, file)
+}
+
+// Serve the piece manifest of a shared file
+func (p *Peer) getPieceManifestHandler(w http.ResponseWriter, r *http.Request) {
+	file := p.findFileByHash(mux.Vars(r)["hash"])
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	p.mutex.RLock()
+	manifest := PieceManifest{
+		Hash:        file.Hash,
+		Size:        file.Size,
+		MerkleRoot:  file.MerkleRoot,
+		PieceSize:   file.PieceSize,
+		PieceHashes: file.PieceHashes,
+	}
+	p.mutex.RUnlock()
+
+	if manifest.PieceSize <= 0 {
+		http.Error(w, "Piece hashes not available", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(manifest)
+}
+
+// Serve the Merkle inclusion proof of a single piece
+func (p *Peer) getPieceProofHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	file := p.findFileByHash(vars["hash"])
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	index, err := strconv.Atoi(vars["index"])
+	if err != nil || index < 0 || index >= len(file.PieceHashes) {
+		http.Error(w, "Invalid piece index", http.StatusBadRequest)
+		return
+	}
+
+	proof, err := merkle.Proof(file.PieceHashes, index)
+	if err != nil {
+		http.Error(w, "Failed to build proof", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hash":        file.Hash,
+		"index":       index,
+		"piece_hash":  file.PieceHashes[index],
+		"merkle_root": file.MerkleRoot,
+		"proof":       proof,
+	})
+}
+
+// Download engine
+
+// Register a download and run it in the background. Returns false if a
+// download of the same content is already running.
+func (p *Peer) startDownload(hash, filename string) bool {
+	// Keep the name chosen when an interrupted download was started
+	if filename == "" {
+		_, statePath := p.partialPaths(hash)
+		if state, err := loadDownloadState(statePath); err == nil {
+			filename = state.Filename
+		}
+	}
+
+	download := &swarmDownload{
+		hash:      hash,
+		filename:  filepath.Base(filename),
+		startedAt: time.Now(),
+		ctx:       p.ctx,
+	}
+	download.progress = DownloadProgress{
+		FileID:   hash,
+		Filename: download.filename,
+		Status:   "pending",
+	}
+
+	p.downloadsMutex.Lock()
+	if _, active := p.downloads[hash]; active || p.ctx.Err() != nil {
+		p.downloadsMutex.Unlock()
+		return false
+	}
+	p.downloads[hash] = download
+	p.transfers.Add(1)
+	p.downloadsMutex.Unlock()
+
+	go p.runSwarmDownload(download)
+	return true
+}
+
+func (p *Peer) runSwarmDownload(d *swarmDownload) {
+	p.mutex.Lock()
+	p.DownloadStats.ActiveDownloads++
+	p.mutex.Unlock()
+
+	defer func() {
+		p.mutex.Lock()
+		p.DownloadStats.ActiveDownloads--
+		p.mutex.Unlock()
+
+		p.downloadsMutex.Lock()
+		delete(p.downloads, d.hash)
+		p.downloadsMutex.Unlock()
+		p.transfers.Done()
+	}()
+
+	sharedFile, err := p.downloadFromSwarm(d)
+	if errors.Is(err, context.Canceled) {
+		log.Printf("⏸️ Swarm download of %s paused for shutdown, it will resume on restart", d.hash)
+		d.setStatus("paused")
+		p.broadcastUpdate("download_progress", d.snapshot())
+		return
+	}
+	go p.reportDownload(d, err)
+	if err != nil {
+		log.Printf("❌ Swarm download of %s failed, partial data kept for resume: %v", d.hash, err)
+		d.setStatus("failed")
+		p.broadcastUpdate("download_progress", d.snapshot())
+		return
+	}
+
+	p.addSharedFile(sharedFile)
+	p.mutex.Lock()
+	p.DownloadStats.TotalDownloads++
+	p.DownloadStats.TotalBytes += sharedFile.Size
+	p.mutex.Unlock()
+
+	// Become a source for the content ourselves
+	go p.registerFileWithSuperPeer(sharedFile)
+
+	d.setStatus("completed")
+	p.broadcastUpdate("download_progress", d.snapshot())
+	p.broadcastUpdate("file_added", sharedFile)
+
+	log.Printf("📥 Swarm download completed: %s (%d bytes from %d peers)", sharedFile.Filename, sharedFile.Size, len(d.sources))
+}
+
+func (p *Peer) downloadFromSwarm(d *swarmDownload) (*SharedFile, error) {
+	sources, err := p.findSources(d.hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no peers are sharing this file")
+	}
+
+	// Trust the Merkle root most sources agree on, and drop the sources
+	// that registered a different one, or none, for the same content
+	root := majorityMerkleRoot(sources)
+	if root == "" {
+		return nil, fmt.Errorf("no source registered a merkle root for %s, pieces cannot be verified", d.hash)
+	}
+
+	d.mutex.Lock()
+	if d.filename == "" || d.filename == "." {
+		d.filename = filepath.Base(sources[0].Filename)
+		d.progress.Filename = d.filename
+	}
+	d.merkleRoot = root
+	d.owners = make(map[string]string)
+	d.strikes = make(map[string]int)
+	d.failures = make(map[string]int)
+	d.delivered = make(map[string]int)
+	d.served = make(map[string]int64)
+	for _, source := range sources {
+		if source.MerkleRoot == root {
+			d.sources = append(d.sources, source.PeerAddress)
+			d.owners[source.PeerAddress] = source.Owner
+		}
+	}
+	d.mutex.Unlock()
+
+	// The manifest comes from a single source, so its size must match the
+	// one registered with the content before space is allocated for it
+	size := registeredSize(sources, root)
+	if size > p.Config.MaxFileSize {
+		return nil, fmt.Errorf("%s is %d bytes, larger than the %d byte limit", d.hash, size, p.Config.MaxFileSize)
+	}
+
+	partPath, statePath := p.partialPaths(d.hash)
+
+	// Resume from the sidecar state if it matches the trusted root, otherwise
+	// start over with a fresh manifest
+	manifest, completed := resumeState(statePath, d.hash, root, size)
+	if manifest == nil {
+		manifest, err = fetchManifest(d.sources, d.hash, root, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(partPath), 0755); err != nil {
+		return nil, err
+	}
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := part.Truncate(manifest.Size); err != nil {
+		part.Close()
+		return nil, err
+	}
+
+	d.mutex.Lock()
+	d.manifest = manifest
+	d.size = manifest.Size
+	d.completed = make([]bool, len(manifest.PieceHashes))
+	d.progress.Status = "downloading"
+	d.mutex.Unlock()
+
+	// Pieces recorded as complete are re-checked, since the state file may
+	// have been written before a crash tore the last writes
+	if resumed := d.verifyCompleted(part, completed); resumed > 0 {
+		log.Printf("⏯️ Resuming download of %s with %d bytes already on disk", d.filename, resumed)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		p.reportProgress(d, part, statePath, done)
+		close(stopped)
+	}()
+	err = d.fetchPieces(part)
+	close(done)
+	<-stopped
+
+	if checkpointErr := d.checkpoint(part, statePath); err == nil {
+		err = checkpointErr
+	}
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify the assembled file against the content hash
+	d.setStatus("verifying")
+	digest, err := calculateFileDigest(partPath)
+	if err != nil {
+		return nil, err
+	}
+	if digest.Hash != d.hash {
+		p.removePartialDownload(d.hash)
+		return nil, fmt.Errorf("assembled file hash mismatch: got %s", digest.Hash)
+	}
+	d.mutex.Lock()
+	d.verified = true
+	d.mutex.Unlock()
+
+	filePath := uniqueFilePath(p.Config.SharedDirectory, d.filename)
+	if err := moveFile(partPath, filePath); err != nil {
+		return nil, err
+	}
+	os.Remove(statePath)
+
+	filename := filepath.Base(filePath)
+	rel := p.relativePath(filePath)
+	if info, err := os.Stat(filePath); err == nil {
+		p.hashes.store(rel, info, digest) // Spare the file watcher hashing it again
+	}
+	return &SharedFile{
+		ID:          fileid.Derive(digest.Hash, p.ID, rel),
+		Filename:    filename,
+		Path:        rel,
+		Folder:      folderOf(rel),
+		FilePath:    filePath,
+		Size:        manifest.Size,
+		Hash:        digest.Hash,
+		MerkleRoot:  digest.MerkleRoot,
+		PieceSize:   manifest.PieceSize,
+		PieceHashes: digest.PieceHashes,
+		Category:    categorizeFile(filename),
+		Tags:        extractTags(filename),
+		SharedAt:    time.Now(),
+		IsAvailable: true,
+	}, nil
+}
+
+// Fetch all pieces in parallel, spreading them across the sources. A piece
+// that fails or does not match its Merkle-verified hash is rejected and only
+// that piece is retried from the next source.
+func (d *swarmDownload) fetchPieces(dst *os.File) error {
+	d.mutex.Lock()
+	missing := []int{}
+	for index, done := range d.completed {
+		if !done {
+			missing = append(missing, index)
+		}
+	}
+	d.mutex.Unlock()
+
+	numPieces := len(missing)
+	pieces := make(chan int, numPieces)
+	for _, index := range missing {
+		pieces <- index
+	}
+	close(pieces)
+
+	workers := len(d.sources) * 2
+	if workers > maxSwarmWorkers {
+		workers = maxSwarmWorkers
+	}
+	if workers > numPieces {
+		workers = numPieces
+	}
+
+	client := &http.Client{Timeout: pieceFetchTimeout}
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for index := range pieces {
+				if err := d.ctx.Err(); err != nil {
+					errs <- err
+					return
+				}
+				if err := d.fetchPiece(client, dst, index, worker); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Sources that are busy are not held against them; if no source could
+// serve the piece and some were busy, the piece is tried again once the
+// soonest of them is expected to have a slot.
+func (d *swarmDownload) fetchPiece(client *http.Client, dst *os.File, index, worker int) error {
+	var lastErr error
+	for round := 0; round <= maxBusyRetries; round++ {
+		var busy *busyError
+		for attempt := 0; attempt < len(d.sources); attempt++ {
+			if err := d.ctx.Err(); err != nil {
+				return err
+			}
+			source := d.sources[(index+worker+attempt)%len(d.sources)]
+			if d.isBadSource(source) {
+				lastErr = fmt.Errorf("source %s failed verification too often", source)
+				continue
+			}
+
+			data, err := downloadPiece(d.ctx, client, source, d.hash, index, d.manifest.PieceSize)
+			var sourceBusy *busyError
+			if errors.As(err, &sourceBusy) {
+				if busy == nil || sourceBusy.retryAfter < busy.retryAfter {
+					busy = sourceBusy
+				}
+			} else if err != nil && d.ctx.Err() == nil {
+				d.countFailure(source)
+			}
+			if err == nil && merkle.HashPiece(data) != d.manifest.PieceHashes[index] {
+				d.strike(source)
+				err = fmt.Errorf("piece %d from %s failed verification", index, source)
+			}
+			if err != nil {
+				log.Printf("⚠️ %v, retrying", err)
+				lastErr = err
+				continue
+			}
+
+			if _, err := dst.WriteAt(data, int64(index)*d.manifest.PieceSize); err != nil {
+				return err
+			}
+			atomic.AddInt64(&d.downloaded, int64(len(data)))
+
+			d.mutex.Lock()
+			d.completed[index] = true
+			d.delivered[source]++
+			d.served[source] += int64(len(data))
+			d.mutex.Unlock()
+			return nil
+		}
+		if busy == nil {
+			break
+		}
+
+		timer := time.NewTimer(busy.retryAfter)
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return d.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return fmt.Errorf("piece %d could not be fetched from any peer: %w", index, lastErr)
+}
+
+func (d *swarmDownload) strike(source string) {
+	d.mutex.Lock()
+	d.strikes[source]++
+	d.mutex.Unlock()
+}
+
+func (d *swarmDownload) countFailure(source string) {
+	d.mutex.Lock()
+	d.failures[source]++
+	d.mutex.Unlock()
+}
+
+func (d *swarmDownload) isBadSource(source string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.strikes[source] >= maxSourceStrikes
+}
+
+// Broadcast progress and checkpoint the partial state until done is closed
+func (p *Peer) reportProgress(d *swarmDownload, part *os.File, statePath string, done <-chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := d.checkpoint(part, statePath); err != nil {
+				log.Printf("⚠️ Failed to save download state for %s: %v", d.hash, err)
+			}
+			p.broadcastUpdate("download_progress", d.snapshot())
+		}
+	}
+}
+
+func (d *swarmDownload) setStatus(status string) {
+	d.mutex.Lock()
+	d.progress.Status = status
+	d.mutex.Unlock()
+}
+
+// Current progress with speed and ETA derived from bytes fetched so far
+func (d *swarmDownload) snapshot() DownloadProgress {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	downloaded := atomic.LoadInt64(&d.downloaded)
+	progress := d.progress
+
+	if d.size > 0 {
+		progress.Progress = float64(downloaded) / float64(d.size) * 100
+	}
+	if elapsed := time.Since(d.startedAt).Seconds(); elapsed > 0 {
+		progress.Speed = int64(float64(downloaded-d.resumed) / elapsed)
+	}
+	if progress.Speed > 0 {
+		progress.ETA = (d.size - downloaded) / progress.Speed
+	}
+	return progress
+}
+
+// Super-peer and remote peer helpers
+
+// Ask the DHT in DHT mode, then the super-peer for every peer holding the
+// content, or the neighbors if the super-peer is unreachable
+func (p *Peer) findSources(hash string) ([]RemoteFile, error) {
+	if p.dht != nil {
+		if sources := p.dhtSources(hash); len(sources) > 0 {
+			return sources, nil
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/api/v1/files/sources/%s", p.superPeerAddress(), hash))
+	if err != nil {
+		log.Printf("🕸️ Super-peer unreachable, asking neighbors for %s", hash)
+		return p.networkSources(hash), nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("super-peer returned %s", resp.Status)
+	}
+
+	var result struct {
+		Sources []RemoteFile `json:"sources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	self := p.selfAddress()
+	sources := make([]RemoteFile, 0, len(result.Sources))
+	seen := make(map[string]bool)
+	for _, source := range result.Sources {
+		if source.Owner == p.ID || source.PeerAddress == self || seen[source.PeerAddress] {
+			continue
+		}
+		seen[source.PeerAddress] = true
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// Fetch the piece manifest from the first source whose piece hashes match the
+// trusted Merkle root and whose size matches the registered one
+func fetchManifest(sources []string, hash, root string, size int64) (*PieceManifest, error) {
+	if root == "" {
+		return nil, fmt.Errorf("no merkle root to verify the piece manifest against")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var lastErr error
+	for _, source := range sources {
+		resp, err := client.Get(fmt.Sprintf("http://%s/api/v1/content/%s/pieces", source, hash))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var manifest PieceManifest
+		err = json.NewDecoder(resp.Body).Decode(&manifest)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("invalid manifest from %s", source)
+			continue
+		}
+
+		if manifest.PieceSize <= 0 || int64(len(manifest.PieceHashes)) != pieceCount(manifest.Size, manifest.PieceSize) {
+			lastErr = fmt.Errorf("inconsistent manifest from %s", source)
+			continue
+		}
+		if manifest.Size != size {
+			lastErr = fmt.Errorf("manifest from %s does not match the registered size", source)
+			continue
+		}
+		if computed, err := merkle.Root(manifest.PieceHashes); err != nil || computed != root {
+			lastErr = fmt.Errorf("manifest from %s does not match merkle root", source)
+			continue
+		}
+		return &manifest, nil
+	}
+	return nil, fmt.Errorf("no piece manifest available: %v", lastErr)
+}
+
+// Fetch a piece with a byte-range request. If-Range makes a source whose
+// content changed reply with the full file instead, which is rejected.
+func downloadPiece(ctx context.Context, client *http.Client, source, hash string, index int, pieceSize int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/api/v1/content/%s", source, hash), nil)
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(index) * pieceSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+pieceSize-1))
+	req.Header.Set("If-Range", contentETag(hash))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, &busyError{source: source, retryAfter: retryAfter(resp)}
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("piece %d from %s: %s", index, source, resp.Status)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, io.LimitReader(resp.Body, pieceSize+1)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// How long a busy source asked to be left alone, within reason
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		return time.Second
+	}
+	return min(time.Duration(seconds)*time.Second, maxBusyWait)
+}
+
+// Local helpers
+
+// Strong ETag of a shared file, tied to its content hash
+func contentETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+func isContentHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, c := range hash {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Peer) findFileByHash(hash string) *SharedFile {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	for _, file := range p.SharedFiles {
+		if file.Hash == hash && file.IsAvailable {
+			return file
+		}
+	}
+	return nil
+}
+
+// The Merkle root claimed by most sources of the same content. Sources that
+// registered no root do not vote; if none did, the result is empty.
+func majorityMerkleRoot(sources []RemoteFile) string {
+	votes := make(map[string]int)
+	best := ""
+	for _, source := range sources {
+		if source.MerkleRoot == "" {
+			continue
+		}
+		votes[source.MerkleRoot]++
+		if votes[source.MerkleRoot] > votes[best] || (votes[source.MerkleRoot] == votes[best] && source.MerkleRoot < best) {
+			best = source.MerkleRoot
+		}
+	}
+	return best
+}
+
+// The size most sources sharing the trusted root registered, the smallest
+// on a tie
+func registeredSize(sources []RemoteFile, root string) int64 {
+	votes := make(map[int64]int)
+	var best int64 = -1
+	for _, source := range sources {
+		if source.MerkleRoot != root {
+			continue
+		}
+		votes[source.Size]++
+		if best < 0 || votes[source.Size] > votes[best] || (votes[source.Size] == votes[best] && source.Size < best) {
+			best = source.Size
+		}
+	}
+	return best
+}
+
+func pieceCount(size, pieceSize int64) int64 {
+	return (size + pieceSize - 1) / pieceSize
+}
+
+// Pick a path in dir for filename that does not clash with an existing file
+func uniqueFilePath(dir, filename string) string {
+	path := filepath.Join(dir, filename)
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
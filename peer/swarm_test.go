@@ -0,0 +1,279 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"sp/merkle"
+)
+
+func TestPieceCount(t *testing.T) {
+	tests := []struct {
+		size, pieceSize, want int64
+	}{
+		{0, 4, 0},
+		{1, 4, 1},
+		{4, 4, 1},
+		{5, 4, 2},
+		{12, 4, 3},
+	}
+	for _, tt := range tests {
+		if got := pieceCount(tt.size, tt.pieceSize); got != tt.want {
+			t.Errorf("pieceCount(%d, %d) = %d, want %d", tt.size, tt.pieceSize, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueFilePath(t *testing.T) {
+	dir := t.TempDir()
+	if got := uniqueFilePath(dir, "a.txt"); got != filepath.Join(dir, "a.txt") {
+		t.Fatalf("got %s for a free name", got)
+	}
+
+	for _, name := range []string{"a.txt", "a (1).txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := uniqueFilePath(dir, "a.txt"); got != filepath.Join(dir, "a (2).txt") {
+		t.Fatalf("got %s, want a (2).txt", got)
+	}
+}
+
+// A source serving data as the content with the given ETag, with Range
+// support
+func contentSource(t *testing.T, data []byte, etag string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestFetchPiecesRetriesOtherSources(t *testing.T) {
+	data := []byte("0123456789")
+	const pieceSize = 4
+	var hashes []string
+	for start := 0; start < len(data); start += pieceSize {
+		hashes = append(hashes, merkle.HashPiece(data[start:min(start+pieceSize, len(data))]))
+	}
+
+	corrupt := []byte("9876543210")
+
+	d := &swarmDownload{
+		ctx:      context.Background(),
+		hash:     "hash",
+		manifest: &PieceManifest{Hash: "hash", Size: int64(len(data)), PieceSize: pieceSize, PieceHashes: hashes},
+		sources: []string{
+			contentSource(t, corrupt, contentETag("hash")),
+			contentSource(t, data, contentETag("hash")),
+		},
+		completed: make([]bool, len(hashes)),
+		strikes:   make(map[string]int),
+		failures:  make(map[string]int),
+		delivered: make(map[string]int),
+		served:    make(map[string]int64),
+	}
+	dst, err := os.Create(filepath.Join(t.TempDir(), "part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := d.fetchPieces(dst); err != nil {
+		t.Fatalf("fetchPieces: %v", err)
+	}
+	got, _ := os.ReadFile(dst.Name())
+	if string(got) != string(data) {
+		t.Fatalf("assembled %q, want %q", got, data)
+	}
+	if d.downloaded != int64(len(data)) {
+		t.Fatalf("counted %d bytes, want %d", d.downloaded, len(data))
+	}
+	if d.strikes[d.sources[0]] == 0 || d.strikes[d.sources[1]] != 0 {
+		t.Fatalf("strikes %v, want only the corrupt source", d.strikes)
+	}
+	if d.delivered[d.sources[0]] != 0 || d.delivered[d.sources[1]] != len(hashes) {
+		t.Fatalf("delivered %v, want every piece from the good source", d.delivered)
+	}
+	if d.served[d.sources[1]] != int64(len(data)) {
+		t.Fatalf("served %v, want %d bytes from the good source", d.served, len(data))
+	}
+
+	// Without a good source the download fails, and the corrupt source is
+	// dropped after maxSourceStrikes failures
+	d.sources = d.sources[:1]
+	d.completed = make([]bool, len(hashes))
+	if err := d.fetchPieces(dst); err == nil {
+		t.Fatal("accepted pieces that fail verification")
+	}
+	if !d.isBadSource(d.sources[0]) {
+		t.Fatalf("corrupt source has %d strikes", d.strikes[d.sources[0]])
+	}
+}
+
+func TestFetchPiecesSkipsCompletedPieces(t *testing.T) {
+	data := []byte("0123456789")
+	const pieceSize = 4
+	var hashes []string
+	for start := 0; start < len(data); start += pieceSize {
+		hashes = append(hashes, merkle.HashPiece(data[start:min(start+pieceSize, len(data))]))
+	}
+
+	d := &swarmDownload{
+		ctx:       context.Background(),
+		hash:      "hash",
+		manifest:  &PieceManifest{Hash: "hash", Size: int64(len(data)), PieceSize: pieceSize, PieceHashes: hashes},
+		sources:   []string{contentSource(t, data, contentETag("hash"))},
+		completed: []bool{true, false, true},
+		strikes:   make(map[string]int),
+		failures:  make(map[string]int),
+		delivered: make(map[string]int),
+		served:    make(map[string]int64),
+	}
+	dst, err := os.Create(filepath.Join(t.TempDir(), "part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.Truncate(int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.fetchPieces(dst); err != nil {
+		t.Fatalf("fetchPieces: %v", err)
+	}
+	got, _ := os.ReadFile(dst.Name())
+	if want := "\x00\x00\x00\x004567\x00\x00"; string(got) != want {
+		t.Fatalf("assembled %q, want %q", got, want)
+	}
+	if d.downloaded != pieceSize {
+		t.Fatalf("counted %d bytes, want %d", d.downloaded, pieceSize)
+	}
+}
+
+func TestFetchPiecesStopsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	d := &swarmDownload{
+		ctx:       ctx,
+		hash:      "hash",
+		manifest:  &PieceManifest{Hash: "hash", Size: 4, PieceSize: 4, PieceHashes: []string{merkle.HashPiece([]byte("0123"))}},
+		sources:   []string{contentSource(t, []byte("0123"), contentETag("hash"))},
+		completed: []bool{false},
+		strikes:   make(map[string]int),
+		failures:  make(map[string]int),
+		delivered: make(map[string]int),
+		served:    make(map[string]int64),
+	}
+	dst, err := os.Create(filepath.Join(t.TempDir(), "part"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := d.fetchPieces(dst); err == nil || d.completed[0] {
+		t.Fatalf("fetched after shutdown: %v", err)
+	}
+}
+
+func TestDownloadPieceRejectsChangedContent(t *testing.T) {
+	data := []byte("0123456789")
+	client := &http.Client{}
+
+	piece, err := downloadPiece(context.Background(), client, contentSource(t, data, contentETag("hash")), "hash", 1, 4)
+	if err != nil || string(piece) != "4567" {
+		t.Fatalf("got %q, %v", piece, err)
+	}
+
+	// A source whose content no longer matches the hash answers If-Range
+	// with the whole file, which is not taken as a piece
+	if piece, err := downloadPiece(context.Background(), client, contentSource(t, data, contentETag("other")), "hash", 1, 4); err == nil {
+		t.Fatalf("accepted %q from changed content", piece)
+	}
+}
+
+func TestMajorityMerkleRootIgnoresMissingRoots(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []RemoteFile
+		want    string
+	}{
+		{"no sources", nil, ""},
+		{"no roots", []RemoteFile{{}, {}}, ""},
+		{"empty roots outvoted", []RemoteFile{{}, {}, {MerkleRoot: "b"}}, "b"},
+		{"majority", []RemoteFile{{MerkleRoot: "b"}, {MerkleRoot: "a"}, {MerkleRoot: "b"}}, "b"},
+		{"tie picks lowest", []RemoteFile{{MerkleRoot: "b"}, {MerkleRoot: "a"}, {}}, "a"},
+	}
+	for _, tt := range tests {
+		if got := majorityMerkleRoot(tt.sources); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchManifestRequiresRoot(t *testing.T) {
+	if _, err := fetchManifest([]string{"127.0.0.1:1"}, "hash", "", 0); err == nil {
+		t.Fatal("accepted a manifest without a merkle root to check it against")
+	}
+}
+
+func TestRegisteredSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources []RemoteFile
+		want    int64
+	}{
+		{"no sources", nil, -1},
+		{"other roots ignored", []RemoteFile{{MerkleRoot: "b", Size: 5}, {MerkleRoot: "a", Size: 7}}, 7},
+		{"majority", []RemoteFile{{MerkleRoot: "a", Size: 9}, {MerkleRoot: "a", Size: 7}, {MerkleRoot: "a", Size: 9}}, 9},
+		{"tie picks smallest", []RemoteFile{{MerkleRoot: "a", Size: 9}, {MerkleRoot: "a", Size: 7}}, 7},
+	}
+	for _, tt := range tests {
+		if got := registeredSize(tt.sources, "a"); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFetchManifestChecksRegisteredSize(t *testing.T) {
+	hashes := []string{merkle.HashPiece([]byte("0123456789"))}
+	root, err := merkle.Root(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A source claiming a huge size with a single piece passes the piece
+	// count check and must be caught by the size check
+	inflated := PieceManifest{Hash: "hash", Size: 1 << 40, MerkleRoot: root, PieceSize: 1 << 40, PieceHashes: hashes}
+	honest := PieceManifest{Hash: "hash", Size: 10, MerkleRoot: root, PieceSize: 16, PieceHashes: hashes}
+	serve := func(manifest PieceManifest) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(manifest)
+		}))
+		t.Cleanup(server.Close)
+		return strings.TrimPrefix(server.URL, "http://")
+	}
+	bad, good := serve(inflated), serve(honest)
+
+	if _, err := fetchManifest([]string{bad}, "hash", root, 10); err == nil {
+		t.Fatal("accepted a manifest larger than the registered size")
+	}
+	manifest, err := fetchManifest([]string{bad, good}, "hash", root, 10)
+	if err != nil {
+		t.Fatalf("rejected the matching manifest: %v", err)
+	}
+	if manifest.Size != 10 {
+		t.Fatalf("got manifest of %d bytes, want 10", manifest.Size)
+	}
+}
@@ -0,0 +1,346 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sp/config"
+)
+
+// Upload limit settings
+const (
+	uploadQueueTimeout = 30 * time.Second // longest wait in the queue for an upload slot
+	uploadRetryAfter   = 10 * time.Second // suggested to clients turned away
+	throttleChunk      = 32 * 1024        // bytes written between rate checks
+	clientLimiterIdle  = 5 * time.Minute  // per-client rates unused this long are forgotten
+)
+
+// uploadWindow is a time of day with its own upload rate, e.g.
+// "09:00-17:00=100KB"
+type uploadWindow struct {
+	start, end int   // minutes after midnight, end excluded
+	rate       int64 // bytes per second, 0 for unlimited
+}
+
+func (w uploadWindow) contains(minute int) bool {
+	if w.start <= w.end {
+		return minute >= w.start && minute < w.end
+	}
+	// Windows like 22:00-06:00 span midnight
+	return minute >= w.start || minute < w.end
+}
+
+// Parse upload schedule entries of the form "HH:MM-HH:MM=RATE", in local time
+func parseUploadSchedule(entries []string) ([]uploadWindow, error) {
+	var windows []uploadWindow
+	for _, entry := range entries {
+		span, rate, found := strings.Cut(entry, "=")
+		from, to, ranged := strings.Cut(span, "-")
+		if !found || !ranged {
+			return nil, fmt.Errorf("upload schedule entries must look like 09:00-17:00=100KB, got %q", entry)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, fmt.Errorf("upload schedule %q: %w", entry, err)
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, fmt.Errorf("upload schedule %q: %w", entry, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("upload schedule %q: window is empty", entry)
+		}
+		bytes, err := config.ParseSize(rate)
+		if err != nil || bytes < 0 {
+			return nil, fmt.Errorf("upload schedule %q: invalid rate", entry)
+		}
+		windows = append(windows, uploadWindow{start: start, end: end, rate: bytes})
+	}
+	return windows, nil
+}
+
+// Minutes after midnight of a "HH:MM" time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// tokenBucket paces writes to a rate in bytes per second, allowing bursts of
+// one second's worth
+type tokenBucket struct {
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Wait until n more bytes may be sent at rate, or ctx is done
+func (b *tokenBucket) wait(ctx context.Context, n int, rate int64) error {
+	if rate <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(rate), float64(rate))
+	}
+	b.last = now
+	// Writers reserve their bytes up front and wait for the debt to clear,
+	// so concurrent writers share the rate in turn
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+	b.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (b *tokenBucket) idleSince(t time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.last.Before(t)
+}
+
+// uploadLimiter enforces the upload limits of PeerConfig: a global rate,
+// changing with the time-of-day schedule, a rate per client and a number of
+// upload slots with a queue in front of them
+type uploadLimiter struct {
+	rate       int64
+	clientRate int64
+	schedule   []uploadWindow
+	slots      int // 0 for unlimited
+	queueSize  int
+
+	global   tokenBucket
+	mutex    sync.Mutex
+	clients  map[string]*tokenBucket    // by client address
+	active   int                        // slots in use
+	waiting  map[string][]chan struct{} // queued requests by client, oldest first
+	turns    []string                   // clients with queued requests, in the order they are served
+	queued   int
+	rejected int64
+}
+
+func newUploadLimiter(cfg PeerConfig) *uploadLimiter {
+	schedule, _ := parseUploadSchedule(cfg.UploadSchedule) // checked by validate
+	return &uploadLimiter{
+		rate:       cfg.UploadRate,
+		clientRate: cfg.UploadRatePerClient,
+		schedule:   schedule,
+		slots:      cfg.UploadSlots,
+		queueSize:  cfg.UploadQueue,
+		clients:    make(map[string]*tokenBucket),
+		waiting:    make(map[string][]chan struct{}),
+	}
+}
+
+// The global rate in effect at a time of day
+func (l *uploadLimiter) currentRate(now time.Time) int64 {
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range l.schedule {
+		if window.contains(minute) {
+			return window.rate
+		}
+	}
+	return l.rate
+}
+
+// Whether uploads are paced at all
+func (l *uploadLimiter) throttled() bool {
+	if l.rate > 0 || l.clientRate > 0 {
+		return true
+	}
+	for _, window := range l.schedule {
+		if window.rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Take an upload slot for a client, waiting in the queue while all slots are
+// busy. Queued clients get slots in turn, one request at a time, so a client
+// sending many requests cannot crowd out the others. Returns false if the
+// queue is full or no slot frees up in time.
+func (l *uploadLimiter) acquire(ctx context.Context, client string) bool {
+	l.mutex.Lock()
+	if l.slots == 0 || (l.active < l.slots && l.queued == 0) {
+		l.active++
+		l.mutex.Unlock()
+		return true
+	}
+	if l.queued >= l.queueSize {
+		l.rejected++
+		l.mutex.Unlock()
+		return false
+	}
+	turn := make(chan struct{})
+	if len(l.waiting[client]) == 0 {
+		l.turns = append(l.turns, client)
+	}
+	l.waiting[client] = append(l.waiting[client], turn)
+	l.queued++
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(uploadQueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-turn:
+		return true
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-turn:
+		// Given a slot while giving up, pass it on
+		l.active--
+		l.handOver()
+	default:
+		l.dequeue(client, turn)
+	}
+	if ctx.Err() == nil {
+		l.rejected++
+	}
+	return false
+}
+
+// Free an upload slot taken with acquire
+func (l *uploadLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	l.handOver()
+}
+
+// Give free slots to queued clients in turn. The caller holds l.mutex.
+func (l *uploadLimiter) handOver() {
+	for len(l.turns) > 0 && l.active < l.slots {
+		client := l.turns[0]
+		l.turns = l.turns[1:]
+		queue := l.waiting[client]
+		close(queue[0])
+		if len(queue) > 1 {
+			l.waiting[client] = queue[1:]
+			l.turns = append(l.turns, client)
+		} else {
+			delete(l.waiting, client)
+		}
+		l.queued--
+		l.active++
+	}
+}
+
+// Drop a request from the queue. The caller holds l.mutex.
+func (l *uploadLimiter) dequeue(client string, turn chan struct{}) {
+	queue := slices.DeleteFunc(l.waiting[client], func(c chan struct{}) bool { return c == turn })
+	if len(queue) == 0 {
+		delete(l.waiting, client)
+		l.turns = slices.DeleteFunc(l.turns, func(c string) bool { return c == client })
+	} else {
+		l.waiting[client] = queue
+	}
+	l.queued--
+}
+
+// The rate limiter of a client, forgetting clients that went idle
+func (l *uploadLimiter) clientBucket(client string) *tokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, exists := l.clients[client]
+	if !exists {
+		cutoff := time.Now().Add(-clientLimiterIdle)
+		for address, idle := range l.clients {
+			if idle.idleSince(cutoff) {
+				delete(l.clients, address)
+			}
+		}
+		bucket = &tokenBucket{}
+		l.clients[client] = bucket
+	}
+	return bucket
+}
+
+// Wait until n more bytes may be sent to a client
+func (l *uploadLimiter) wait(ctx context.Context, client *tokenBucket, n int) error {
+	if err := l.global.wait(ctx, n, l.currentRate(time.Now())); err != nil {
+		return err
+	}
+	return client.wait(ctx, n, l.clientRate)
+}
+
+// Fill in the limits and queue of the upload stats
+func (l *uploadLimiter) stats(stats UploadStats) UploadStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats.Slots = l.slots
+	stats.QueuedUploads = l.queued
+	stats.RejectedUploads = l.rejected
+	stats.RateLimit = l.currentRate(time.Now())
+	stats.ClientRateLimit = l.clientRate
+	return stats
+}
+
+// throttledWriter paces a response to the global and per-client upload
+// rates
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *uploadLimiter
+	client  *tokenBucket
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := min(len(b), throttleChunk)
+		if err := t.limiter.wait(t.ctx, t.client, n); err != nil {
+			return written, err
+		}
+		m, err := t.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Turn away a request while all upload slots are busy
+func rejectUpload(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(uploadRetryAfter/time.Second)))
+	http.Error(w, "All upload slots are busy, retry later", http.StatusServiceUnavailable)
+}
+
+// The address uploads to a request are limited by
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,175 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Events that can change the set or content of shared files. Files are only
+// looked at once they are closed after writing, not while being written.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_DELETE | syscall.IN_CREATE | syscall.IN_DELETE_SELF
+
+// Watch a directory tree with inotify, sending the path of every file or
+// directory that changed to changed until ctx is done. An empty path means
+// events were lost and the whole tree has to be scanned.
+func watchTree(ctx context.Context, root string, changed chan<- string) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	// A non-blocking descriptor is read through the runtime poller, so
+	// closing it stops the reader
+	file := os.NewFile(uintptr(fd), "inotify")
+
+	w := &inotifyWatcher{fd: fd, dirs: make(map[int32]string)}
+	if err := w.addTree(root); err != nil {
+		file.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go w.read(ctx, file, changed)
+	return nil
+}
+
+type inotifyWatcher struct {
+	fd    int
+	mutex sync.Mutex
+	dirs  map[int32]string // watch descriptor -> directory
+}
+
+// Watch a directory and every directory below it
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			if errors.Is(err, syscall.ENOSPC) {
+				log.Printf("⚠️ Out of inotify watches at %s, raise fs.inotify.max_user_watches", path)
+			}
+			return err
+		}
+		w.mutex.Lock()
+		w.dirs[int32(wd)] = path
+		w.mutex.Unlock()
+		return nil
+	})
+}
+
+// Stop watching a directory moved out of its place and every directory
+// below it. Moved back into the tree, they are watched again under their
+// new path.
+func (w *inotifyWatcher) removeTree(root string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for wd, dir := range w.dirs {
+		if dir == root || strings.HasPrefix(dir, root+string(filepath.Separator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) read(ctx context.Context, file *os.File, changed chan<- string) {
+	defer close(changed)
+	// The receiver stops listening once ctx is done
+	send := func(path string) bool {
+		select {
+		case changed <- path:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			wd := int32(binary.NativeEndian.Uint32(buf[offset:]))
+			mask := binary.NativeEndian.Uint32(buf[offset+4:])
+			length := int(binary.NativeEndian.Uint32(buf[offset+12:]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + length
+			if offset > n {
+				break
+			}
+
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !send("") {
+					return
+				}
+				continue
+			}
+
+			w.mutex.Lock()
+			dir, known := w.dirs[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, wd)
+			}
+			w.mutex.Unlock()
+			if !known {
+				continue
+			}
+
+			path := dir
+			if name := string(trimNull(buf[nameStart:offset])); name != "" {
+				path = filepath.Join(dir, name)
+			}
+
+			// New directories have to be watched too. Files created in
+			// them before the watch was added are found by scanning them.
+			if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addTree(path)
+			} else if mask&syscall.IN_ISDIR != 0 && mask&syscall.IN_MOVED_FROM != 0 {
+				w.removeTree(path)
+			} else if mask&syscall.IN_CREATE != 0 {
+				continue // Wait until the file is closed
+			}
+			if !send(path) {
+				return
+			}
+		}
+	}
+}
+
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+// Inode of a file, part of the hash cache key
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Wait for a change notification for path
+func waitChange(t *testing.T, changed <-chan string, path string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-changed:
+			if got == path {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change notified for %s", path)
+		}
+	}
+}
+
+func TestWatchMovedOutDirectory(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "shared")
+	outside := filepath.Join(filepath.Dir(root), "outside")
+	if err := os.MkdirAll(filepath.Join(root, "music", "album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan string, 16)
+	if err := watchTree(ctx, root, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(root, "music"), outside); err != nil {
+		t.Fatal(err)
+	}
+	waitChange(t, changed, filepath.Join(root, "music"))
+
+	// Files written in the moved-out directory are no longer reported under
+	// their old path
+	os.WriteFile(filepath.Join(outside, "album", "song.mp3"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(root, "marker"), []byte("x"), 0644)
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-changed:
+			if got == filepath.Join(root, "marker") {
+				return
+			}
+			if got != "" && got != root {
+				t.Fatalf("change reported for %s after its directory moved out", got)
+			}
+		case <-timeout:
+			t.Fatal("no change notified for marker")
+		}
+	}
+}
+
+func TestWatchStopsWithFullChannel(t *testing.T) {
+	root := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan string) // never read until ctx is done
+	if err := watchTree(ctx, root, changed); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "a"), []byte("x"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	// The watcher gives up sending and closes the channel
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-changed:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("watcher did not stop")
+		}
+	}
+}
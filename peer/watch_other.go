@@ -0,0 +1,20 @@
+//go:build !linux
+
+package peer
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// Change notifications are only implemented with inotify; elsewhere the
+// shared directory is polled
+func watchTree(ctx context.Context, root string, changed chan<- string) error {
+	return errors.New("file change notifications are not supported on this platform")
+}
+
+// Inode of a file, part of the hash cache key. Not used off Linux.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
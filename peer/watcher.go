@@ -0,0 +1,167 @@
+package peer
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// File watcher settings
+const (
+	pollInterval        = 30 * time.Second // between scans without change notifications
+	watchRescanInterval = 10 * time.Minute // between full scans with them, in case events were missed
+	watchSettleDelay    = time.Second      // changes are collected this long before scanning
+)
+
+// File watcher service keeps the shared files in step with the shared
+// directory. On Linux inotify reports changes as they happen and only the
+// changed paths are scanned; elsewhere, or if inotify fails, the whole
+// directory is scanned every 30 seconds. The hash cache keeps scans from
+// hashing files again that did not change.
+func (p *Peer) fileWatcherService() {
+	defer p.services.Done()
+
+	// Watch before the first scan so that no change slips between them
+	changed := make(chan string, 256)
+	ticker := time.NewTicker(watchRescanInterval)
+	defer ticker.Stop()
+	if err := watchTree(p.ctx, p.Config.SharedDirectory, changed); err != nil {
+		log.Printf("⚠️ Not watching %s for changes, scanning every %s: %v", p.Config.SharedDirectory, pollInterval, err)
+		changed = nil
+		ticker.Reset(pollInterval)
+	} else {
+		log.Printf("👀 Watching %s for changes", p.Config.SharedDirectory)
+	}
+	p.initializePeer()
+
+	pending := make(map[string]bool)
+	var settle <-chan time.Time
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.scanPath("")
+		case filePath, ok := <-changed:
+			if !ok {
+				if p.ctx.Err() == nil {
+					log.Printf("⚠️ Stopped receiving file changes, scanning every %s", pollInterval)
+					ticker.Reset(pollInterval)
+				}
+				changed = nil
+				continue
+			}
+			// An empty path asks for a full scan
+			if filePath == "" {
+				pending[""] = true
+			} else {
+				pending[p.relativePath(filePath)] = true
+			}
+			if settle == nil {
+				settle = time.After(watchSettleDelay)
+			}
+		case <-settle:
+			settle = nil
+			if pending[""] {
+				p.scanPath("")
+			} else {
+				for rel := range pending {
+					p.scanPath(rel)
+				}
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// Bring the shared files under a folder or file ("" for the whole shared
+// directory) in line with the disk: share new files, register the new
+// content of modified files and drop removed files
+func (p *Peer) scanPath(rel string) {
+	p.scanMutex.Lock()
+	defer p.scanMutex.Unlock()
+
+	p.mutex.RLock()
+	known := make(map[string]*SharedFile)
+	for _, file := range p.SharedFiles {
+		if inFolder(file.Path, rel) {
+			known[file.Path] = file
+		}
+	}
+	p.mutex.RUnlock()
+
+	currentFiles := make(map[string]bool)
+	p.walkSharedDirectory(rel, func(filePath, fileRel string, info os.FileInfo) {
+		currentFiles[fileRel] = true
+		existing := known[fileRel]
+		if existing != nil {
+			if _, unchanged := p.hashes.lookup(fileRel, info); unchanged {
+				return
+			}
+		}
+
+		sharedFile := p.newSharedFile(filePath, info)
+		if existing != nil && existing.Hash == sharedFile.Hash {
+			return // Touched, same content
+		}
+		p.addSharedFile(sharedFile)
+
+		// Register with super-peer
+		go p.registerFileWithSuperPeer(sharedFile)
+
+		// Broadcast to WebSocket clients
+		if existing != nil {
+			p.broadcastUpdate("file_modified", sharedFile)
+			log.Printf("✏️ File modified: %s", fileRel)
+		} else {
+			p.broadcastUpdate("file_added", sharedFile)
+			log.Printf("📁 New file detected: %s", fileRel)
+		}
+	})
+
+	// Check for removed files
+	p.mutex.Lock()
+	var removed []*SharedFile
+	for fileID, file := range p.SharedFiles {
+		if inFolder(file.Path, rel) && !currentFiles[file.Path] {
+			delete(p.SharedFiles, fileID)
+			removed = append(removed, file)
+			p.broadcastUpdate("file_removed", file)
+			log.Printf("📁 File removed: %s", file.Path)
+		}
+	}
+	p.mutex.Unlock()
+
+	for _, file := range removed {
+		go p.unregisterFileWithSuperPeer(file)
+	}
+
+	p.hashes.prune(rel, currentFiles)
+	p.hashes.save()
+}
+
+// Call fn for every file under a folder or file of the shared directory that
+// is not unshared, with its path relative to the shared directory
+func (p *Peer) walkSharedDirectory(rel string, fn func(filePath, rel string, info os.FileInfo)) {
+	if rel != "" && p.isUnshared(rel) {
+		return
+	}
+	root := filepath.Join(p.Config.SharedDirectory, filepath.FromSlash(rel))
+	filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		fileRel := p.relativePath(filePath)
+		if info.IsDir() {
+			if fileRel != "" && p.isUnshared(fileRel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !p.isUnshared(fileRel) {
+			fn(filePath, fileRel, info)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// logHeader is the first line of the log file: the compaction point the
+// entries that follow it start after.
+type logHeader struct {
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotTerm  uint64 `json:"snapshot_term"`
+}
+
+// logFile keeps a node's log on disk, one JSON line per entry after a
+// header line. Appends are fsynced before they are acknowledged; truncation
+// and compaction rewrite the file and rename it into place.
+type logFile struct {
+	path string
+	file *os.File
+}
+
+// Open the log at path, creating it if needed. A torn tail left by a crash
+// is cut off.
+func openLog(path string) (*logFile, logHeader, []Entry, error) {
+	var header logHeader
+	var entries []Entry
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, header, nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	var good int64
+	first := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break // an unterminated line was cut short
+		}
+		if first {
+			if err := json.Unmarshal(line, &header); err != nil {
+				return nil, header, nil, fmt.Errorf("raft log %s: invalid header: %w", path, err)
+			}
+			first = false
+		} else {
+			var entry Entry
+			if err := json.Unmarshal(line, &entry); err != nil || entry.Index != header.SnapshotIndex+uint64(len(entries))+1 {
+				break
+			}
+			entries = append(entries, entry)
+		}
+		good += int64(len(line))
+	}
+
+	l := &logFile{path: path}
+	if first || good < int64(len(data)) {
+		if !first {
+			log.Printf("⚠️ Truncating %d bytes of corrupt raft log tail", int64(len(data))-good)
+		}
+		if err := l.rewrite(header, entries); err != nil {
+			return nil, header, nil, err
+		}
+		return l, header, entries, nil
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, header, nil, err
+	}
+	return l, header, entries, nil
+}
+
+// Append entries to the end of the log
+func (l *logFile) append(entries []Entry) error {
+	if l == nil || len(entries) == 0 {
+		return nil
+	}
+	if l.file == nil {
+		return errors.New("raft log is closed")
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Replace the whole log, after a truncation, a compaction or a snapshot
+func (l *logFile) rewrite(header logHeader, entries []Entry) error {
+	if l == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	line, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	if err := writeFileSync(l.path, buf.Bytes()); err != nil {
+		return err
+	}
+	l.file, err = os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+func (l *logFile) close() {
+	if l != nil && l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// Write a file through a synced temporary file renamed into place, so a
+// crash leaves either the old or the new content
+func writeFileSync(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,760 @@
+// Package raft replicates a log of mutations between a small group of
+// super-peers so that one of them can take over when another goes down.
+//
+// It follows the Raft consensus algorithm: nodes elect a leader for a term,
+// the leader appends proposals to its log and replicates them to the
+// followers, and an entry is committed once a majority holds it. Every node
+// applies committed entries, and only committed entries, to its state. The
+// log, the current term and the vote are kept on disk and survive restarts;
+// the log is compacted once applied, and a follower that falls behind the
+// compacted part receives a full snapshot of the leader's state instead.
+//
+// The leader's caller applies its own entries to its in-memory state
+// itself, before committing or once the commit returns, so the Apply
+// callback only has to make them durable. When such an entry may not commit, because
+// the leader lost its majority or was deposed, the caller rebuilds its
+// in-memory state from what was applied through the Discard callback.
+//
+// Nodes sign every RPC with a key shared by the group and reject requests
+// that are not signed with it.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"sp/identity"
+)
+
+// State is the role of a node in the current term.
+type State string
+
+// Node states
+const (
+	Follower  State = "follower"
+	Candidate State = "candidate"
+	Leader    State = "leader"
+)
+
+// Default timings
+const (
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultElectionTimeout   = time.Second
+)
+
+// Log settings
+const (
+	maxBatch      = 256  // entries per append request
+	maxLogEntries = 4096 // applied entries kept before compacting the log
+)
+
+// Errors returned by Commit
+var (
+	ErrNotLeader    = errors.New("not the raft leader")
+	ErrNotCommitted = errors.New("entry not committed in time")
+)
+
+// Entry is one record of the replicated log.
+type Entry struct {
+	Index  uint64          `json:"index"`
+	Term   uint64          `json:"term"`
+	Origin string          `json:"origin"` // node that proposed the entry
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// Config configures a node.
+type Config struct {
+	// ID is the host:port the other nodes reach this node at.
+	ID string
+	// Peers are the IDs of the other nodes of the group.
+	Peers []string
+	// Key is the secret shared by the group that RPCs are signed with.
+	Key []byte
+	// StatePath is the file the current term and vote are kept in.
+	StatePath string
+	// LogPath is the file the log is kept in. Without one the log, like the
+	// term and vote without a StatePath, is lost on restart.
+	LogPath string
+
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is the silence after which a follower stands for
+	// election. The actual timeout is randomized between one and two times
+	// this value so that nodes rarely stand at the same time.
+	ElectionTimeout time.Duration
+
+	// Apply applies a committed entry. local is set for entries this node
+	// committed whose effects its caller already holds in memory, which
+	// only need to be made durable. Entries are applied one at a time, in
+	// log order.
+	Apply func(data []byte, local bool)
+	// Snapshot returns the full state of the node.
+	Snapshot func() ([]byte, error)
+	// Restore replaces the state of the node with a snapshot.
+	Restore func(data []byte) error
+	// Discard drops in-memory effects of entries this node proposed that
+	// may not commit, by rebuilding the state from what was applied.
+	Discard func()
+}
+
+// Status describes a node, as served by the status endpoint.
+type Status struct {
+	ID          string            `json:"id"`
+	State       State             `json:"state"`
+	Term        uint64            `json:"term"`
+	Leader      string            `json:"leader,omitempty"`
+	CommitIndex uint64            `json:"commit_index"`
+	LastIndex   uint64            `json:"last_index"`
+	Peers       []string          `json:"peers"`
+	MatchIndex  map[string]uint64 `json:"match_index,omitempty"` // leader only
+}
+
+// Node is one member of a replication group. It is safe for concurrent use.
+type Node struct {
+	config Config
+	client *http.Client
+	nonces *identity.Nonces // of the RPCs received, so none is accepted twice
+
+	mutex           sync.Mutex
+	state           State
+	term            uint64
+	votedFor        string
+	leader          string
+	log             []Entry // entries after snapshotIndex
+	snapshotIndex   uint64  // last entry covered by the local state and dropped from the log
+	snapshotTerm    uint64
+	commitIndex     uint64
+	lastApplied     uint64
+	lastContact     time.Time // last time a leader was heard from or a vote granted
+	electionTimeout time.Duration
+	storage         *logFile
+	localFrom       uint64 // own entries from this index on are held in the caller's memory
+	discard         bool   // the caller's memory must be rebuilt before applying more
+	discarding      bool   // the caller's memory is being rebuilt
+
+	nextIndex   map[string]uint64      // leader only: next entry to send to each peer
+	matchIndex  map[string]uint64      // leader only: last entry known replicated on each peer
+	replicating map[string]bool        // leader only: peers with a request in flight
+	acked       map[string]time.Time   // leader only: last response from each peer
+	readyIndex  uint64                 // leader only: entry of the election, applied before writes
+	waiters     map[uint64]chan<- bool // leader only: Commit calls by entry
+
+	applyMutex sync.Mutex // serializes Apply, Restore and Discard
+	wake       chan struct{}
+	commits    chan struct{}
+}
+
+// NewNode creates a follower, restoring the term and vote from StatePath
+// and the log from LogPath.
+func NewNode(config Config) (*Node, error) {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = DefaultElectionTimeout
+	}
+
+	n := &Node{
+		config:      config,
+		client:      &http.Client{Timeout: config.ElectionTimeout},
+		nonces:      identity.NewNonces(),
+		state:       Follower,
+		lastContact: time.Now(),
+		wake:        make(chan struct{}, 1),
+		commits:     make(chan struct{}, 1),
+	}
+	n.resetElectionTimeout()
+
+	if config.StatePath != "" {
+		data, err := os.ReadFile(config.StatePath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			var saved persistentState
+			if err := json.Unmarshal(data, &saved); err != nil {
+				return nil, fmt.Errorf("raft state %s: %w", config.StatePath, err)
+			}
+			n.term, n.votedFor = saved.Term, saved.VotedFor
+		}
+	}
+
+	// Entries after the compaction point are applied again once they are
+	// known to be committed; entries are whole-record puts and deletes, so
+	// replaying them in order over a state that already holds some of them
+	// ends in the same state
+	if config.LogPath != "" {
+		storage, header, entries, err := openLog(config.LogPath)
+		if err != nil {
+			return nil, err
+		}
+		n.storage = storage
+		n.snapshotIndex, n.snapshotTerm = header.SnapshotIndex, header.SnapshotTerm
+		n.log = entries
+		n.commitIndex, n.lastApplied = n.snapshotIndex, n.snapshotIndex
+	}
+	n.localFrom = n.lastIndex() + 1
+	return n, nil
+}
+
+// Run drives elections, replication and applying until ctx is done, then
+// closes the log.
+func (n *Node) Run(ctx context.Context) {
+	applied := make(chan struct{})
+	go func() {
+		n.applyLoop(ctx)
+		close(applied)
+	}()
+	defer func() {
+		<-applied
+		n.mutex.Lock()
+		n.storage.close()
+		n.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.mutex.Lock()
+			state := n.state
+			timedOut := state != Leader && time.Since(n.lastContact) > n.electionTimeout
+			n.mutex.Unlock()
+
+			if state == Leader {
+				n.checkQuorum()
+				n.broadcastAppend()
+			} else if timedOut {
+				n.startElection()
+			}
+		case <-n.wake:
+			n.broadcastAppend()
+		}
+	}
+}
+
+// Commit appends data to the log and waits until a majority of the group
+// holds it. The caller applies data to its in-memory state itself, before
+// calling Commit or once it returns nil. If this node is not the leader, or the entry is not known to be
+// committed within two election timeouts, the caller's in-memory state is
+// rebuilt through Discard and an error is returned.
+func (n *Node) Commit(data []byte) error {
+	n.mutex.Lock()
+	if !n.ready() {
+		n.requestDiscard()
+		n.mutex.Unlock()
+		return ErrNotLeader
+	}
+	if err := n.appendLocal(data); err != nil {
+		n.requestDiscard()
+		n.mutex.Unlock()
+		return err
+	}
+	index := n.lastIndex()
+	done := make(chan bool, 1)
+	n.waiters[index] = done
+	n.advanceCommit()
+	n.mutex.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+
+	timer := time.NewTimer(2 * n.config.ElectionTimeout)
+	defer timer.Stop()
+	select {
+	case committed := <-done:
+		if committed {
+			return nil
+		}
+		return ErrNotLeader
+	case <-timer.C:
+		n.mutex.Lock()
+		delete(n.waiters, index)
+		n.requestDiscard()
+		n.mutex.Unlock()
+		return ErrNotCommitted
+	}
+}
+
+// IsLeader reports whether this node is the leader of the current term and
+// has applied every entry committed before its election, so it can take
+// writes.
+func (n *Node) IsLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.ready()
+}
+
+// Leader returns the ID of the current leader, or "" if none is known.
+func (n *Node) Leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leader
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	status := Status{
+		ID:          n.config.ID,
+		State:       n.state,
+		Term:        n.term,
+		Leader:      n.leader,
+		CommitIndex: n.commitIndex,
+		LastIndex:   n.lastIndex(),
+		Peers:       n.config.Peers,
+	}
+	if n.state == Leader {
+		status.MatchIndex = make(map[string]uint64, len(n.matchIndex))
+		for peer, index := range n.matchIndex {
+			status.MatchIndex[peer] = index
+		}
+	}
+	return status
+}
+
+// Log helpers, called with the mutex held
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapshotIndex + uint64(len(n.log))
+}
+
+func (n *Node) lastTerm() uint64 {
+	if len(n.log) == 0 {
+		return n.snapshotTerm
+	}
+	return n.log[len(n.log)-1].Term
+}
+
+// Term of the entry at index, false if it was compacted or does not exist
+func (n *Node) termAt(index uint64) (uint64, bool) {
+	if index == n.snapshotIndex {
+		return n.snapshotTerm, true
+	}
+	if index < n.snapshotIndex || index > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[index-n.snapshotIndex-1].Term, true
+}
+
+func (n *Node) appendLocal(data []byte) error {
+	entry := Entry{
+		Index:  n.lastIndex() + 1,
+		Term:   n.term,
+		Origin: n.config.ID,
+		Data:   data,
+	}
+	if err := n.storage.append([]Entry{entry}); err != nil {
+		log.Printf("❌ Failed to append to raft log: %v", err)
+		return err
+	}
+	n.log = append(n.log, entry)
+	return nil
+}
+
+func (n *Node) ready() bool {
+	return n.state == Leader && !n.discarding && n.lastApplied >= n.readyIndex
+}
+
+// Have the apply loop rebuild the caller's in-memory state before it
+// applies anything else
+func (n *Node) requestDiscard() {
+	n.discard = true
+	n.signalCommit()
+}
+
+func (n *Node) resetElectionTimeout() {
+	n.electionTimeout = n.config.ElectionTimeout + time.Duration(rand.Int63n(int64(n.config.ElectionTimeout)))
+}
+
+// Adopt a newer term as a follower. A deposed leader's uncommitted entries
+// may be dropped by the next leader, so its caller's memory is rebuilt.
+func (n *Node) stepDown(term uint64) {
+	if n.state == Leader {
+		log.Printf("👑 No longer raft leader (term %d)", term)
+		for index, done := range n.waiters {
+			done <- false
+			delete(n.waiters, index)
+		}
+		n.requestDiscard()
+	}
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		n.saveState()
+	}
+	n.state = Follower
+}
+
+// Votes needed to win an election or commit an entry
+func (n *Node) quorum() int {
+	return (len(n.config.Peers)+1)/2 + 1
+}
+
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// Persist the term and vote; a node must never vote twice in a term, even
+// across restarts
+func (n *Node) saveState() error {
+	if n.config.StatePath == "" {
+		return nil
+	}
+	data, _ := json.Marshal(persistentState{Term: n.term, VotedFor: n.votedFor})
+	err := writeFileSync(n.config.StatePath, data)
+	if err != nil {
+		log.Printf("❌ Failed to save raft state: %v", err)
+	}
+	return err
+}
+
+// Elections
+
+func (n *Node) startElection() {
+	n.mutex.Lock()
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.config.ID
+	n.leader = ""
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	if err := n.saveState(); err != nil {
+		n.state = Follower
+		n.mutex.Unlock()
+		return
+	}
+	term := n.term
+	req := voteRequest{
+		Term:         term,
+		Candidate:    n.config.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	n.mutex.Unlock()
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader(term)
+		return
+	}
+
+	var votesMutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range n.config.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			var resp voteResponse
+			if err := n.call(peer, "vote", req, &resp); err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+			}
+			n.mutex.Unlock()
+
+			if resp.Granted {
+				votesMutex.Lock()
+				votes++
+				won := votes == n.quorum()
+				votesMutex.Unlock()
+				if won {
+					n.becomeLeader(term)
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (n *Node) becomeLeader(term uint64) {
+	n.mutex.Lock()
+	if n.state != Candidate || n.term != term {
+		n.mutex.Unlock()
+		return
+	}
+	n.state = Leader
+	n.leader = n.config.ID
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.replicating = make(map[string]bool)
+	n.acked = make(map[string]time.Time)
+	n.waiters = make(map[uint64]chan<- bool)
+	for _, peer := range n.config.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.acked[peer] = time.Now()
+	}
+	// An entry of the new term lets entries of earlier terms commit; writes
+	// wait until it is applied
+	if err := n.appendLocal(nil); err != nil {
+		n.stepDown(n.term)
+		n.mutex.Unlock()
+		return
+	}
+	n.readyIndex = n.lastIndex()
+	n.advanceCommit()
+	n.mutex.Unlock()
+
+	log.Printf("👑 Elected raft leader for term %d", term)
+	n.broadcastAppend()
+}
+
+// A leader cut off from the majority steps down rather than keep accepting
+// writes the rest of the group will never see
+func (n *Node) checkQuorum() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state != Leader {
+		return
+	}
+
+	reachable := 1
+	for _, acked := range n.acked {
+		if time.Since(acked) < n.electionTimeout {
+			reachable++
+		}
+	}
+	if reachable < n.quorum() {
+		log.Printf("⚠️ Lost contact with the raft majority")
+		n.stepDown(n.term)
+		n.leader = ""
+		n.lastContact = time.Now()
+	}
+}
+
+// Replication
+
+func (n *Node) broadcastAppend() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.state != Leader {
+		return
+	}
+	for _, peer := range n.config.Peers {
+		if !n.replicating[peer] {
+			n.replicating[peer] = true
+			go n.replicate(peer)
+		}
+	}
+}
+
+// Send the next batch of entries, or a snapshot, to a peer
+func (n *Node) replicate(peer string) {
+	defer func() {
+		n.mutex.Lock()
+		n.replicating[peer] = false
+		n.mutex.Unlock()
+	}()
+
+	n.mutex.Lock()
+	if n.state != Leader {
+		n.mutex.Unlock()
+		return
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapshotIndex {
+		n.mutex.Unlock()
+		n.sendSnapshot(peer)
+		return
+	}
+
+	prevIndex := next - 1
+	prevTerm, _ := n.termAt(prevIndex)
+	end := n.lastIndex()
+	if end-prevIndex > maxBatch {
+		end = prevIndex + maxBatch
+	}
+	entries := append([]Entry{}, n.log[prevIndex-n.snapshotIndex:end-n.snapshotIndex]...)
+	req := appendRequest{
+		Term:         n.term,
+		Leader:       n.config.ID,
+		PrevLogIndex: prevIndex,
+		PrevLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+	n.mutex.Unlock()
+
+	var resp appendResponse
+	if err := n.call(peer, "append", req, &resp); err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.state != Leader || n.term != req.Term {
+		return
+	}
+	n.acked[peer] = time.Now()
+
+	switch {
+	case resp.Success:
+		n.matchIndex[peer] = resp.MatchIndex
+		n.nextIndex[peer] = resp.MatchIndex + 1
+		n.advanceCommit()
+	default:
+		n.nextIndex[peer] = max(1, min(resp.ConflictIndex, next-1))
+	}
+}
+
+// Commit the latest entry of the current term held by a majority
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if term, _ := n.termAt(index); term != n.term {
+			break
+		}
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			for waiting, done := range n.waiters {
+				if waiting <= index {
+					done <- true
+					delete(n.waiters, waiting)
+				}
+			}
+			n.signalCommit()
+			return
+		}
+	}
+}
+
+func (n *Node) sendSnapshot(peer string) {
+	// Apply and Restore are held off so the state matches lastApplied
+	n.applyMutex.Lock()
+	n.mutex.Lock()
+	lastIndex := n.lastApplied
+	lastTerm, _ := n.termAt(lastIndex)
+	term := n.term
+	n.mutex.Unlock()
+	data, err := n.config.Snapshot()
+	n.applyMutex.Unlock()
+	if err != nil {
+		log.Printf("❌ Failed to snapshot state for %s: %v", peer, err)
+		return
+	}
+
+	req := snapshotRequest{
+		Term:      term,
+		Leader:    n.config.ID,
+		LastIndex: lastIndex,
+		LastTerm:  lastTerm,
+		Data:      data,
+	}
+	var resp snapshotResponse
+	if err := n.call(peer, "snapshot", req, &resp); err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.state == Leader && n.term == term {
+		n.acked[peer] = time.Now()
+		log.Printf("📸 Sent snapshot up to entry %d to %s", lastIndex, peer)
+		n.matchIndex[peer] = max(n.matchIndex[peer], lastIndex)
+		n.nextIndex[peer] = lastIndex + 1
+		n.advanceCommit()
+	}
+}
+
+// Applying
+
+func (n *Node) signalCommit() {
+	select {
+	case n.commits <- struct{}{}:
+	default:
+	}
+}
+
+// Apply committed entries in order, then compact the log. The caller's
+// memory is rebuilt first when it may hold entries that will not commit.
+func (n *Node) applyLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.commits:
+		}
+
+		n.applyMutex.Lock()
+		n.mutex.Lock()
+		discard := n.discard
+		if discard {
+			// Own entries not yet applied are no longer in memory, and
+			// no new ones are taken until it is rebuilt
+			n.discard = false
+			n.discarding = true
+			n.localFrom = n.lastIndex() + 1
+		}
+		n.mutex.Unlock()
+
+		if discard && n.config.Discard != nil {
+			n.config.Discard()
+		}
+
+		n.mutex.Lock()
+		n.discarding = false
+		var entries []Entry
+		if end := min(n.commitIndex, n.lastIndex()); end > n.lastApplied && n.lastApplied >= n.snapshotIndex {
+			entries = append(entries, n.log[n.lastApplied-n.snapshotIndex:end-n.snapshotIndex]...)
+		}
+		localFrom := n.localFrom
+		n.mutex.Unlock()
+
+		for _, entry := range entries {
+			if len(entry.Data) > 0 {
+				n.config.Apply(entry.Data, entry.Origin == n.config.ID && entry.Index >= localFrom)
+			}
+		}
+
+		n.mutex.Lock()
+		if len(entries) > 0 {
+			n.lastApplied = entries[len(entries)-1].Index
+		}
+		if n.lastApplied-n.snapshotIndex > maxLogEntries {
+			snapshotTerm, _ := n.termAt(n.lastApplied)
+			remaining := append([]Entry{}, n.log[n.lastApplied-n.snapshotIndex:]...)
+			header := logHeader{SnapshotIndex: n.lastApplied, SnapshotTerm: snapshotTerm}
+			if err := n.storage.rewrite(header, remaining); err != nil {
+				log.Printf("❌ Failed to compact raft log: %v", err)
+			} else {
+				n.log = remaining
+				n.snapshotIndex, n.snapshotTerm = header.SnapshotIndex, header.SnapshotTerm
+			}
+		}
+		n.mutex.Unlock()
+		n.applyMutex.Unlock()
+	}
+}
@@ -0,0 +1,335 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("cluster secret")
+
+// kv is a key-value state machine fed by the log. Entries are JSON strings
+// "key=value".
+type kv struct {
+	mutex sync.Mutex
+	data  map[string]string
+}
+
+func entry(key, value string) []byte {
+	data, _ := json.Marshal(key + "=" + value)
+	return data
+}
+
+func (s *kv) apply(data []byte, local bool) {
+	var pair string
+	json.Unmarshal(data, &pair)
+	key, value, _ := strings.Cut(pair, "=")
+	s.mutex.Lock()
+	s.data[key] = value
+	s.mutex.Unlock()
+}
+
+func (s *kv) get(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data[key]
+}
+
+func (s *kv) snapshot() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return json.Marshal(s.data)
+}
+
+func (s *kv) restore(data []byte) error {
+	restored := make(map[string]string)
+	if err := json.Unmarshal(data, &restored); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.data = restored
+	s.mutex.Unlock()
+	return nil
+}
+
+// member is one node of a test cluster, served on its own localhost port
+type member struct {
+	id     string
+	dir    string
+	node   *Node
+	state  *kv
+	server *http.Server
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (m *member) start(t *testing.T, peers []string) {
+	t.Helper()
+	m.state = &kv{data: make(map[string]string)}
+	node, err := NewNode(Config{
+		ID:                m.id,
+		Peers:             peers,
+		Key:               testKey,
+		StatePath:         filepath.Join(m.dir, "raft.json"),
+		LogPath:           filepath.Join(m.dir, "raft.log"),
+		HeartbeatInterval: 20 * time.Millisecond,
+		ElectionTimeout:   150 * time.Millisecond,
+		Apply:             m.state.apply,
+		Snapshot:          m.state.snapshot,
+		Restore:           m.state.restore,
+		Discard:           func() {},
+	})
+	if err != nil {
+		t.Fatalf("%s: %v", m.id, err)
+	}
+	m.node = node
+
+	listener, err := net.Listen("tcp", m.id)
+	if err != nil {
+		t.Fatalf("%s: %v", m.id, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathPrefix+"vote", node.HandleVote)
+	mux.HandleFunc(PathPrefix+"append", node.HandleAppend)
+	mux.HandleFunc(PathPrefix+"snapshot", node.HandleSnapshot)
+	m.server = &http.Server{Handler: mux}
+	go m.server.Serve(listener)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	go func() {
+		node.Run(ctx)
+		close(m.done)
+	}()
+}
+
+func (m *member) stop() {
+	if m.server == nil {
+		return
+	}
+	m.server.Close()
+	m.cancel()
+	<-m.done
+	m.server = nil
+}
+
+type cluster struct {
+	t       *testing.T
+	members []*member
+}
+
+func newCluster(t *testing.T, size int) *cluster {
+	t.Helper()
+	c := &cluster{t: t}
+	for i := 0; i < size; i++ {
+		// Reserve a port, then release it for the member to listen on
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := listener.Addr().String()
+		listener.Close()
+		c.members = append(c.members, &member{id: id, dir: t.TempDir()})
+	}
+	for i := range c.members {
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for _, m := range c.members {
+			m.stop()
+		}
+	})
+	return c
+}
+
+func (c *cluster) start(i int) {
+	var peers []string
+	for j, m := range c.members {
+		if j != i {
+			peers = append(peers, m.id)
+		}
+	}
+	c.members[i].start(c.t, peers)
+}
+
+// Wait until exactly one running member leads and can take writes
+func (c *cluster) leader() *member {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*member
+		for _, m := range c.members {
+			if m.server != nil && m.node.IsLeader() {
+				leaders = append(leaders, m)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// Commit key=value through the leader, retrying across elections
+func (c *cluster) commit(key, value string) {
+	c.t.Helper()
+	for attempt := 0; attempt < 5; attempt++ {
+		leader := c.leader()
+		leader.state.apply(entry(key, value), true)
+		if err := leader.node.Commit(entry(key, value)); err == nil {
+			return
+		}
+	}
+	c.t.Fatalf("could not commit %s=%s", key, value)
+}
+
+// Wait until every running member has applied key=value
+func (c *cluster) waitApplied(key, value string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		applied := true
+		for _, m := range c.members {
+			if m.server != nil && m.state.get(key) != value {
+				applied = false
+			}
+		}
+		if applied {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, m := range c.members {
+		if m.server != nil {
+			c.t.Logf("%s: %s=%q", m.id, key, m.state.get(key))
+		}
+	}
+	c.t.Fatalf("%s=%s not applied everywhere", key, value)
+}
+
+func TestElectionAndFailover(t *testing.T) {
+	c := newCluster(t, 3)
+
+	first := c.leader()
+	first.stop()
+
+	second := c.leader()
+	if second == first {
+		t.Fatal("stopped node still leads")
+	}
+	if status := second.node.Status(); status.Leader != second.id || status.State != Leader {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	c := newCluster(t, 3)
+
+	for i := 0; i < 20; i++ {
+		c.commit(fmt.Sprintf("k%d", i), fmt.Sprint(i))
+	}
+	c.waitApplied("k19", "19")
+	for _, m := range c.members {
+		if got := m.state.get("k7"); got != "7" {
+			t.Fatalf("%s: k7=%q", m.id, got)
+		}
+	}
+}
+
+func TestNotLeaderCannotCommit(t *testing.T) {
+	c := newCluster(t, 3)
+
+	leader := c.leader()
+	for _, m := range c.members {
+		if m != leader {
+			if err := m.node.Commit(entry("x", "1")); err != ErrNotLeader {
+				t.Fatalf("follower Commit returned %v", err)
+			}
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	c := newCluster(t, 3)
+
+	c.commit("a", "1")
+	c.waitApplied("a", "1")
+
+	// One member misses the newer writes
+	leader := c.leader()
+	var stale int
+	for i, m := range c.members {
+		if m != leader {
+			stale = i
+			break
+		}
+	}
+	c.members[stale].stop()
+	c.commit("a", "2")
+	c.commit("b", "2")
+
+	// Restart the whole cluster from disk. The state machines start empty
+	// and are rebuilt from the durable logs; the stale member must not
+	// roll the others back.
+	for _, m := range c.members {
+		m.stop()
+	}
+	for i := range c.members {
+		c.start(i)
+	}
+	c.leader()
+	c.waitApplied("a", "2")
+	c.waitApplied("b", "2")
+
+	c.commit("c", "3")
+	c.waitApplied("c", "3")
+}
+
+func TestUnsignedRequestsRejected(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	var target *member
+	for _, m := range c.members {
+		if m != leader {
+			target = m
+			break
+		}
+	}
+
+	// A request claiming to come from the leader but not signed with the
+	// group key must not touch the log
+	body, _ := json.Marshal(appendRequest{
+		Term:    1 << 40,
+		Leader:  leader.id,
+		Entries: []Entry{{Index: 1, Term: 1 << 40, Data: json.RawMessage(`"evil"`)}},
+	})
+	resp, err := http.Post("http://"+target.id+PathPrefix+"append", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unsigned append returned %s", resp.Status)
+	}
+
+	// Signed with another key
+	outsider := &Node{config: Config{ID: leader.id, Key: []byte("wrong")}, client: http.DefaultClient}
+	var appendResp appendResponse
+	if err := outsider.call(target.id, "append", appendRequest{Term: 1 << 40, Leader: leader.id}, &appendResp); err == nil {
+		t.Fatal("append signed with the wrong key was accepted")
+	}
+	if status := target.node.Status(); status.Term >= 1<<40 {
+		t.Fatalf("forged request changed the term to %d", status.Term)
+	}
+}
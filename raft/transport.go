@@ -0,0 +1,276 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"sp/identity"
+)
+
+// PathPrefix is where the RPC handlers are mounted on every node.
+const PathPrefix = "/api/v1/raft/"
+
+// Largest RPC body accepted, which bounds snapshots
+const maxRPCSize = 1 << 30
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	MatchIndex    uint64 `json:"match_index"`
+	ConflictIndex uint64 `json:"conflict_index,omitempty"` // first index to retry from
+}
+
+type snapshotRequest struct {
+	Term      uint64          `json:"term"`
+	Leader    string          `json:"leader"`
+	LastIndex uint64          `json:"last_index"`
+	LastTerm  uint64          `json:"last_term"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Send an RPC to a peer, signed with the group key
+func (n *Node) call(peer, method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("http://%s%s%s", peer, PathPrefix, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	identity.SignShared(httpReq, body, n.config.ID, n.config.Key)
+
+	r, err := n.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", peer, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// HandleVote serves vote requests from candidates. Mount it at
+// PathPrefix + "vote".
+func (n *Node) HandleVote(w http.ResponseWriter, r *http.Request) {
+	var req voteRequest
+	if !n.decode(w, r, &req, func() string { return req.Candidate }) {
+		return
+	}
+	writeJSON(w, n.handleVote(req))
+}
+
+// HandleAppend serves append requests from the leader. Mount it at
+// PathPrefix + "append".
+func (n *Node) HandleAppend(w http.ResponseWriter, r *http.Request) {
+	var req appendRequest
+	if !n.decode(w, r, &req, func() string { return req.Leader }) {
+		return
+	}
+	writeJSON(w, n.handleAppend(req))
+}
+
+// HandleSnapshot serves snapshots sent by the leader. Mount it at
+// PathPrefix + "snapshot".
+func (n *Node) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req snapshotRequest
+	if !n.decode(w, r, &req, func() string { return req.Leader }) {
+		return
+	}
+	resp, err := n.handleSnapshot(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resp)
+}
+
+// Requests not signed with the group key by the node they claim to come
+// from are rejected
+func (n *Node) decode(w http.ResponseWriter, r *http.Request, req interface{}, sender func() string) bool {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRPCSize))
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return false
+	}
+	node, err := identity.VerifyShared(r, body, n.config.Key, n.nonces)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return false
+	}
+	if !slices.Contains(n.config.Peers, node) || sender() != node {
+		http.Error(w, "Node not in group", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// RPC handlers
+
+func (n *Node) handleVote(req voteRequest) voteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+	if req.Term < n.term {
+		return voteResponse{Term: n.term}
+	}
+
+	// Only vote for candidates whose log is at least as up to date as ours,
+	// so the leader always holds every committed entry
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor != "" && n.votedFor != req.Candidate) || !upToDate {
+		return voteResponse{Term: n.term}
+	}
+
+	n.votedFor = req.Candidate
+	if err := n.saveState(); err != nil {
+		n.votedFor = ""
+		return voteResponse{Term: n.term}
+	}
+	n.lastContact = time.Now()
+	return voteResponse{Term: n.term, Granted: true}
+}
+
+func (n *Node) handleAppend(req appendRequest) appendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term < n.term {
+		return appendResponse{Term: n.term}
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return appendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	if term, ok := n.termAt(req.PrevLogIndex); ok && term != req.PrevLogTerm {
+		// Skip back over the whole conflicting term at once
+		conflict := req.PrevLogIndex
+		for conflict > n.snapshotIndex+1 {
+			if previous, _ := n.termAt(conflict - 1); previous != term {
+				break
+			}
+			conflict--
+		}
+		return appendResponse{Term: n.term, ConflictIndex: conflict}
+	}
+
+	// Entries are on disk before the leader is told they are held. A
+	// conflicting suffix, never committed and never applied, is dropped.
+	var added []Entry
+	truncated := false
+	entries := n.log
+	for _, entry := range req.Entries {
+		if entry.Index <= n.snapshotIndex {
+			continue
+		}
+		if last := n.snapshotIndex + uint64(len(entries)); entry.Index <= last {
+			if entries[entry.Index-n.snapshotIndex-1].Term == entry.Term {
+				continue
+			}
+			entries = append([]Entry{}, entries[:entry.Index-n.snapshotIndex-1]...)
+			truncated = true
+		}
+		entries = append(entries, entry)
+		added = append(added, entry)
+	}
+	var err error
+	if truncated {
+		err = n.storage.rewrite(logHeader{SnapshotIndex: n.snapshotIndex, SnapshotTerm: n.snapshotTerm}, entries)
+	} else {
+		err = n.storage.append(added)
+	}
+	if err != nil {
+		log.Printf("❌ Failed to write raft log: %v", err)
+		return appendResponse{Term: n.term, ConflictIndex: n.lastIndex() + 1}
+	}
+	n.log = entries
+
+	matchIndex := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, matchIndex))
+		n.signalCommit()
+	}
+	return appendResponse{Term: n.term, Success: true, MatchIndex: matchIndex}
+}
+
+func (n *Node) handleSnapshot(req snapshotRequest) (snapshotResponse, error) {
+	n.mutex.Lock()
+	if req.Term < n.term {
+		defer n.mutex.Unlock()
+		return snapshotResponse{Term: n.term}, nil
+	}
+	n.stepDown(req.Term)
+	n.leader = req.Leader
+	n.lastContact = time.Now()
+	n.mutex.Unlock()
+
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	if err := n.config.Restore(req.Data); err != nil {
+		return snapshotResponse{}, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	header := logHeader{SnapshotIndex: req.LastIndex, SnapshotTerm: req.LastTerm}
+	if err := n.storage.rewrite(header, nil); err != nil {
+		return snapshotResponse{}, err
+	}
+	n.log = nil
+	n.snapshotIndex = req.LastIndex
+	n.snapshotTerm = req.LastTerm
+	n.commitIndex = req.LastIndex
+	n.lastApplied = req.LastIndex
+	n.localFrom = n.lastIndex() + 1
+	n.lastContact = time.Now()
+	return snapshotResponse{Term: n.term}, nil
+}
@@ -0,0 +1,201 @@
+// Package reputation scores peers from their observed behaviour.
+//
+// A peer's score combines its uptime ratio, the share of downloads from it
+// that other peers reported as successful, and the ratings of the files it
+// shares, minus a penalty for every piece it served that failed hash
+// verification. Observations decay exponentially with a configurable
+// half-life, so a peer recovers from past failures and cannot live off old
+// successes. Scores range from 0 to 100; a peer with no history scores 50.
+package reputation
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Scoring weights
+const (
+	uptimeWeight    = 0.3
+	downloadWeight  = 0.4
+	ratingWeight    = 0.3
+	mismatchPenalty = 15.0
+
+	// Observed time assumed at 50% uptime before a peer has any history
+	uptimePrior = float64(time.Hour / time.Second)
+	// Downloads and votes assumed at a neutral outcome
+	downloadPrior = 2.0
+	ratingPrior   = 2.0
+
+	// Longest gap between two uptime observations credited to a peer, so
+	// time the super-peer itself was down is not counted as peer downtime
+	maxObservationGap = 10 * time.Minute
+)
+
+// Stats are the decayed observations of one peer.
+type Stats struct {
+	Online       float64   `json:"online"`   // seconds seen online
+	Observed     float64   `json:"observed"` // seconds observed
+	Successes    float64   `json:"successes"`
+	Failures     float64   `json:"failures"`
+	Mismatches   float64   `json:"mismatches"`
+	Updated      time.Time `json:"updated"`       // time the counters were last decayed
+	LastObserved time.Time `json:"last_observed"` // time of the last uptime observation
+}
+
+// Engine tracks the stats of every peer. It is safe for concurrent use.
+type Engine struct {
+	mutex    sync.Mutex
+	halfLife time.Duration
+	peers    map[string]*Stats
+}
+
+// NewEngine creates an engine whose observations lose half their weight
+// every halfLife.
+func NewEngine(halfLife time.Duration) *Engine {
+	return &Engine{
+		halfLife: halfLife,
+		peers:    make(map[string]*Stats),
+	}
+}
+
+// Load restores the stats of a peer, e.g. from persistent storage.
+func (e *Engine) Load(id string, stats Stats) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.peers[id] = &stats
+}
+
+// Reset forgets the stats of every peer, before they are loaded again.
+func (e *Engine) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.peers = make(map[string]*Stats)
+}
+
+// Stats returns the stats of a peer decayed to now.
+func (e *Engine) Stats(id string, now time.Time) (Stats, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats, exists := e.peers[id]
+	if !exists {
+		return Stats{}, false
+	}
+	decayed := *stats
+	e.decay(&decayed, now)
+	return decayed, true
+}
+
+// Merge adds the stats of peer from to those of peer into and forgets from,
+// for a peer that came back under a new ID. It returns the merged stats.
+func (e *Engine) Merge(from, into string, now time.Time) Stats {
+	e.mutex.Lock()
+	old, exists := e.peers[from]
+	delete(e.peers, from)
+	e.mutex.Unlock()
+	if !exists {
+		stats, _ := e.Stats(into, now)
+		return stats
+	}
+
+	e.decay(old, now)
+	return e.update(into, now, func(stats *Stats) {
+		stats.Online += old.Online
+		stats.Observed += old.Observed
+		stats.Successes += old.Successes
+		stats.Failures += old.Failures
+		stats.Mismatches += old.Mismatches
+		if old.LastObserved.After(stats.LastObserved) {
+			stats.LastObserved = old.LastObserved
+		}
+	})
+}
+
+// RecordUptime credits the time since the previous observation of the peer
+// as online or offline time.
+func (e *Engine) RecordUptime(id string, online bool, now time.Time) Stats {
+	return e.update(id, now, func(stats *Stats) {
+		if !stats.LastObserved.IsZero() {
+			elapsed := now.Sub(stats.LastObserved)
+			if elapsed > maxObservationGap {
+				elapsed = maxObservationGap
+			}
+			if elapsed > 0 {
+				stats.Observed += elapsed.Seconds()
+				if online {
+					stats.Online += elapsed.Seconds()
+				}
+			}
+		}
+		stats.LastObserved = now
+	})
+}
+
+// RecordDownload records a download from the peer reported by another peer.
+// The weight says how much the report is trusted, 1 for a full observation.
+func (e *Engine) RecordDownload(id string, success bool, weight float64, now time.Time) Stats {
+	return e.update(id, now, func(stats *Stats) {
+		if success {
+			stats.Successes += weight
+		} else {
+			stats.Failures += weight
+		}
+	})
+}
+
+// RecordMismatch records data from the peer that failed hash verification,
+// weighted like RecordDownload.
+func (e *Engine) RecordMismatch(id string, weight float64, now time.Time) Stats {
+	return e.update(id, now, func(stats *Stats) {
+		stats.Mismatches += weight
+	})
+}
+
+// Score returns the reputation of a peer at now, given the total and number
+// of the votes its files received.
+func (e *Engine) Score(id string, ratingTotal float64, votes int, now time.Time) int {
+	stats, _ := e.Stats(id, now)
+	return Score(stats, ratingTotal, votes)
+}
+
+// Score computes a reputation from 0 to 100 from decayed stats and the
+// total and number of the votes the peer's files received (1 to 5 each).
+func Score(stats Stats, ratingTotal float64, votes int) int {
+	uptime := (stats.Online + uptimePrior/2) / (stats.Observed + uptimePrior)
+	downloads := (stats.Successes + downloadPrior/2) / (stats.Successes + stats.Failures + downloadPrior)
+	rating := (ratingTotal + 3*ratingPrior) / (float64(votes) + ratingPrior)
+	rating = (rating - 1) / 4
+
+	score := 100*(uptimeWeight*uptime+downloadWeight*downloads+ratingWeight*rating) - mismatchPenalty*stats.Mismatches
+	return int(math.Round(math.Max(0, math.Min(100, score))))
+}
+
+func (e *Engine) update(id string, now time.Time, record func(*Stats)) Stats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats, exists := e.peers[id]
+	if !exists {
+		stats = &Stats{Updated: now}
+		e.peers[id] = stats
+	}
+	e.decay(stats, now)
+	record(stats)
+	return *stats
+}
+
+// Decay the counters of stats to now
+func (e *Engine) decay(stats *Stats, now time.Time) {
+	elapsed := now.Sub(stats.Updated)
+	if elapsed <= 0 || e.halfLife <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(elapsed)/float64(e.halfLife))
+	stats.Online *= factor
+	stats.Observed *= factor
+	stats.Successes *= factor
+	stats.Failures *= factor
+	stats.Mismatches *= factor
+	stats.Updated = now
+}
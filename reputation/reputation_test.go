@@ -0,0 +1,33 @@
+package reputation
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportsAreWeighted(t *testing.T) {
+	now := time.Now()
+	e := NewEngine(time.Hour)
+
+	e.RecordMismatch("trusted", 1, now)
+	e.RecordMismatch("doubted", 0.2, now)
+
+	trusted := e.Score("trusted", 0, 0, now)
+	doubted := e.Score("doubted", 0, 0, now)
+	fresh := e.Score("fresh", 0, 0, now)
+	if !(trusted < doubted && doubted < fresh) {
+		t.Fatalf("expected trusted %d < doubted %d < fresh %d", trusted, doubted, fresh)
+	}
+}
+
+func TestZeroWeightReportIsIgnored(t *testing.T) {
+	now := time.Now()
+	e := NewEngine(time.Hour)
+
+	for i := 0; i < 100; i++ {
+		e.RecordDownload("peer", false, 0, now)
+	}
+	if got, want := e.Score("peer", 0, 0, now), e.Score("fresh", 0, 0, now); got != want {
+		t.Fatalf("zero-weight reports changed the score: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Span is a matched part [Start, End) of a text, in characters (Unicode code
+// points) so that clients can highlight it.
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// FuzzyMatch matches every word of query against the words of text allowing
+// for typos, so "vaction photos" matches "Vacation_Photos.zip". Words of up
+// to 2 characters must match exactly, up to 5 may be one edit away and longer
+// ones two. Returns the mean similarity of the matched words (0 to 1) and the
+// spans of text they matched.
+func FuzzyMatch(query, text string) (float64, []Span, bool) {
+	queryWords := Tokenize(query)
+	if len(queryWords) == 0 {
+		return 0, nil, false
+	}
+	textWords, spans := tokenizeSpans(text)
+
+	total := 0.0
+	var matched []Span
+	for _, queryWord := range queryWords {
+		best, bestIndex := 0.0, -1
+		for i, word := range textWords {
+			if similarity, ok := fuzzyWordMatch(queryWord, word); ok && similarity > best {
+				best, bestIndex = similarity, i
+			}
+		}
+		if bestIndex < 0 {
+			return 0, nil, false
+		}
+		total += best
+		matched = append(matched, spans[bestIndex])
+	}
+	return total / float64(len(queryWords)), mergeSpans(matched), true
+}
+
+// Highlight returns the spans of text holding the words of the query's terms,
+// counting words that start with a prefix term.
+func Highlight(query Query, text string) []Span {
+	words, spans := tokenizeSpans(text)
+
+	var matched []Span
+	for i, word := range words {
+		for _, term := range query.Terms {
+			for k, queryWord := range term.Words {
+				prefix := term.Prefix && k == len(term.Words)-1
+				if word == queryWord || (prefix && strings.HasPrefix(word, queryWord)) {
+					matched = append(matched, spans[i])
+				}
+			}
+		}
+	}
+	return mergeSpans(matched)
+}
+
+// FuzzyCandidates returns the documents that, for every word of the query,
+// contain a word within the FuzzyMatch edit limit.
+func (ix *Index) FuzzyCandidates(query string) []string {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+
+	var candidates map[string]bool
+	for _, queryWord := range Tokenize(query) {
+		found := make(map[string]bool)
+		for _, word := range ix.words {
+			if _, ok := fuzzyWordMatch(queryWord, word); ok {
+				for id := range ix.postings[word] {
+					found[id] = true
+				}
+			}
+		}
+
+		if candidates == nil {
+			candidates = found
+			continue
+		}
+		for id := range candidates {
+			if !found[id] {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Number of edits a query word of the given length may be away from a match
+func maxEdits(length int) int {
+	switch {
+	case length <= 2:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func fuzzyWordMatch(queryWord, word string) (float64, bool) {
+	a, b := []rune(queryWord), []rune(word)
+	limit := maxEdits(len(a))
+	if diff := len(a) - len(b); diff > limit || -diff > limit {
+		return 0, false
+	}
+
+	distance := editDistance(a, b)
+	if distance > limit {
+		return 0, false
+	}
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	return 1 - float64(distance)/float64(longest), true
+}
+
+// Damerau-Levenshtein distance (optimal string alignment), counting a swap
+// of two adjacent characters as one edit
+func editDistance(a, b []rune) int {
+	rows := make([][]int, len(a)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(b)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			rows[i][j] = min(rows[i-1][j]+1, rows[i][j-1]+1, rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				rows[i][j] = min(rows[i][j], rows[i-2][j-2]+1)
+			}
+		}
+	}
+	return rows[len(a)][len(b)]
+}
+
+// Tokenize text like Tokenize, also returning where each word is
+func tokenizeSpans(text string) ([]string, []Span) {
+	var words []string
+	var spans []Span
+	start := -1
+	runes := []rune(text)
+	for i := 0; i <= len(runes); i++ {
+		inWord := i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			words = append(words, strings.ToLower(string(runes[start:i])))
+			spans = append(spans, Span{Start: start, End: i})
+			start = -1
+		}
+	}
+	return words, spans
+}
+
+// Sort spans and merge the overlapping ones
+func mergeSpans(spans []Span) []Span {
+	if len(spans) == 0 {
+		return nil
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].Start < spans[j].Start })
+
+	merged := []Span{spans[0]}
+	for _, span := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if span.Start <= last.End {
+			if span.End > last.End {
+				last.End = span.End
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
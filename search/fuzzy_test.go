@@ -0,0 +1,169 @@
+package search
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"photo", "photo", 0},
+		{"photo", "phots", 1},  // Substitution
+		{"phto", "photo", 1},   // Insertion
+		{"photos", "photo", 1}, // Deletion
+		{"vaction", "vacation", 1},
+		{"teh", "the", 1},   // Swap of adjacent characters
+		{"hte", "the", 1},   // Swap at the start
+		{"ab", "ba", 1},     // Swap of the whole word
+		{"abcd", "badc", 2}, // Two swaps
+		{"ca", "abc", 3},    // Optimal string alignment does not edit a swapped pair again
+		{"kitten", "sitting", 3},
+		{"café", "cafe", 1}, // Counted in characters, not bytes
+	}
+	for _, tt := range tests {
+		if got := editDistance([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance([]rune(tt.b), []rune(tt.a)); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyWordMatch(t *testing.T) {
+	tests := []struct {
+		query, word string
+		want        bool
+	}{
+		{"tv", "tv", true},
+		{"tv", "tx", false}, // Up to 2 characters must match exactly
+		{"cat", "cut", true},
+		{"cat", "cuts", false}, // Up to 5 characters may be one edit away
+		{"photo", "phtoo", true},
+		{"photo", "pht", false},
+		{"vacaton", "vacation", true},
+		{"vcaton", "vacation", true}, // Longer words may be two edits away
+		{"vctn", "vacation", false},
+		{"holidays", "holiday", true},
+		{"holidays", "hol", false},
+	}
+	for _, tt := range tests {
+		if _, ok := fuzzyWordMatch(tt.query, tt.word); ok != tt.want {
+			t.Errorf("fuzzyWordMatch(%q, %q) = %v, want %v", tt.query, tt.word, ok, tt.want)
+		}
+	}
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	similarity, spans, ok := FuzzyMatch("vaction photos", "Vacation_Photos.zip")
+	if !ok {
+		t.Fatal("expected a match")
+	}
+	// "vaction" is one edit from the 8 characters of "vacation", "photos" exact
+	if want := (7.0/8 + 1) / 2; math.Abs(similarity-want) > 1e-9 {
+		t.Errorf("similarity = %v, want %v", similarity, want)
+	}
+	if want := []Span{{0, 8}, {9, 15}}; !reflect.DeepEqual(spans, want) {
+		t.Errorf("spans = %v, want %v", spans, want)
+	}
+
+	if similarity, _, ok := FuzzyMatch("photos", "photos"); !ok || similarity != 1 {
+		t.Errorf("exact match scored %v, %v", similarity, ok)
+	}
+	// Every query word must match some word
+	if _, _, ok := FuzzyMatch("vacation beach", "Vacation_Photos.zip"); ok {
+		t.Error("matched with a missing word")
+	}
+	if _, _, ok := FuzzyMatch("", "anything"); ok {
+		t.Error("empty query matched")
+	}
+}
+
+func TestFuzzyMatchPrefersCloserWords(t *testing.T) {
+	// "report" matches both words, the exact one wins
+	similarity, spans, ok := FuzzyMatch("report", "reprot report")
+	if !ok || similarity != 1 {
+		t.Fatalf("got %v, %v", similarity, ok)
+	}
+	if want := []Span{{7, 13}}; !reflect.DeepEqual(spans, want) {
+		t.Errorf("spans = %v, want %v", spans, want)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	text := "Summer Road-Trip: summer vacation"
+	tests := []struct {
+		query string
+		want  []Span
+	}{
+		{"summer", []Span{{0, 6}, {18, 24}}},
+		{"road trip", []Span{{7, 11}, {12, 16}}},
+		{`"road trip"`, []Span{{7, 11}, {12, 16}}},
+		{"vac*", []Span{{25, 33}}},
+		{"winter", nil},
+		{"tag:summer", nil}, // Filters are not highlighted
+	}
+	for _, tt := range tests {
+		if got := Highlight(mustParse(t, tt.query), text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Highlight(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// Spans are in characters, not bytes
+	if got := Highlight(mustParse(t, "photo"), "Café photo"); !reflect.DeepEqual(got, []Span{{5, 10}}) {
+		t.Errorf("got %v, want [{5 10}]", got)
+	}
+}
+
+func TestFuzzyCandidates(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("a", "vacation photos")
+	ix.Add("b", "vacation videos")
+	ix.Add("c", "work photos")
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"vaction", []string{"a", "b"}},
+		{"phtoos", []string{"a", "c"}},
+		{"vaction phtoos", []string{"a"}},
+		{"holiday", []string{}},
+		{"", []string{}},
+	}
+	for _, tt := range tests {
+		if got := ix.FuzzyCandidates(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FuzzyCandidates(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	ix.Remove("a")
+	if got := ix.FuzzyCandidates("vaction phtoos"); len(got) != 0 {
+		t.Errorf("removed document still a candidate: %v", got)
+	}
+}
+
+func TestMergeSpans(t *testing.T) {
+	tests := []struct {
+		spans, want []Span
+	}{
+		{nil, nil},
+		{[]Span{{5, 8}, {0, 3}}, []Span{{0, 3}, {5, 8}}},
+		{[]Span{{0, 4}, {2, 6}}, []Span{{0, 6}}},
+		{[]Span{{0, 6}, {1, 2}}, []Span{{0, 6}}},
+		{[]Span{{0, 3}, {3, 5}}, []Span{{0, 5}}},
+		{[]Span{{4, 6}, {0, 2}, {4, 6}}, []Span{{0, 2}, {4, 6}}},
+	}
+	for _, tt := range tests {
+		if got := mergeSpans(tt.spans); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeSpans(%v) = %v, want %v", tt.spans, got, tt.want)
+		}
+	}
+}
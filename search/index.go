@@ -0,0 +1,262 @@
+// Package search implements the super-peer's full-text file index.
+//
+// Documents are tokenized into lowercase words and kept in an inverted index
+// mapping each word to the documents and positions it occurs at. Queries are
+// ranked with BM25 and support prefix ("vac*"), phrase ("summer holiday") and
+// excluded ("-draft") terms; every other term of a query must match. Field
+// filters such as size:>10MB are parsed here but evaluated by the caller
+// against its file records.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// Result is a matching document and its relevance score.
+type Result struct {
+	ID    string
+	Score float64
+}
+
+// Index is an inverted index safe for concurrent use.
+type Index struct {
+	mutex    sync.RWMutex
+	postings map[string]map[string][]int // word -> document ID -> positions
+	docs     map[string][]string         // document ID -> distinct words
+	lengths  map[string]int              // document ID -> number of words
+	totalLen int
+	words    []string // sorted vocabulary for prefix lookups
+}
+
+// NewIndex creates an empty index.
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[string][]int),
+		docs:     make(map[string][]string),
+		lengths:  make(map[string]int),
+	}
+}
+
+// Tokenize splits text into lowercase words at every character that is not
+// a letter or digit, so "Summer_Holiday.mp4" becomes summer, holiday, mp4.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Add indexes a document, replacing any earlier version with the same ID.
+// Phrases never match across the boundary between two fields.
+func (ix *Index) Add(id string, fields ...string) {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+
+	ix.remove(id)
+
+	position := 0
+	var words []string
+	for _, field := range fields {
+		for _, word := range Tokenize(field) {
+			docs := ix.postings[word]
+			if docs == nil {
+				docs = make(map[string][]int)
+				ix.postings[word] = docs
+				ix.insertWord(word)
+			}
+			if docs[id] == nil {
+				words = append(words, word)
+			}
+			docs[id] = append(docs[id], position)
+			position++
+		}
+		position++ // Gap between fields
+	}
+
+	ix.docs[id] = words
+	ix.lengths[id] = position - len(fields)
+	ix.totalLen += ix.lengths[id]
+}
+
+// Remove drops a document from the index.
+func (ix *Index) Remove(id string) {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	ix.remove(id)
+}
+
+func (ix *Index) remove(id string) {
+	words, exists := ix.docs[id]
+	if !exists {
+		return
+	}
+
+	for _, word := range words {
+		delete(ix.postings[word], id)
+		if len(ix.postings[word]) == 0 {
+			delete(ix.postings, word)
+			ix.deleteWord(word)
+		}
+	}
+	ix.totalLen -= ix.lengths[id]
+	delete(ix.docs, id)
+	delete(ix.lengths, id)
+}
+
+// Len returns the number of indexed documents.
+func (ix *Index) Len() int {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+	return len(ix.docs)
+}
+
+// Search returns the documents matching every term of the query and none of
+// its excluded terms, best first. A query with only excluded terms matches
+// every other document with a zero score. Filters are not evaluated here.
+func (ix *Index) Search(query Query) []Result {
+	ix.mutex.RLock()
+	defer ix.mutex.RUnlock()
+
+	if !query.HasText() {
+		return nil
+	}
+
+	var scores map[string]float64
+	if len(query.Terms) == 0 {
+		scores = make(map[string]float64, len(ix.docs))
+		for id := range ix.docs {
+			scores[id] = 0
+		}
+	}
+	for i, term := range query.Terms {
+		matched := ix.match(term)
+		if i == 0 {
+			scores = matched
+			continue
+		}
+		for id := range scores {
+			if score, ok := matched[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	for _, term := range query.Excluded {
+		for id := range ix.match(term) {
+			delete(scores, id)
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+// Score every document containing the term. A term is a run of words that
+// must appear consecutively; single words are phrases of length one.
+func (ix *Index) match(term Term) map[string]float64 {
+	last := len(term.Words) - 1
+	lists := make([]map[string][]int, len(term.Words))
+	for k, word := range term.Words {
+		if k == last && term.Prefix {
+			lists[k] = ix.expand(word)
+		} else {
+			lists[k] = ix.postings[word]
+		}
+		if len(lists[k]) == 0 {
+			return nil
+		}
+	}
+
+	// Count the occurrences of the phrase in each document
+	occurrences := make(map[string]int)
+	for id, starts := range lists[0] {
+		count := 0
+		for _, start := range starts {
+			matched := true
+			for k := 1; k < len(lists); k++ {
+				if !containsPosition(lists[k][id], start+k) {
+					matched = false
+					break
+				}
+			}
+			if matched {
+				count++
+			}
+		}
+		if count > 0 {
+			occurrences[id] = count
+		}
+	}
+
+	scores := make(map[string]float64, len(occurrences))
+	for id, count := range occurrences {
+		scores[id] = ix.bm25(count, len(occurrences), ix.lengths[id])
+	}
+	return scores
+}
+
+// Merge the postings of every word starting with prefix
+func (ix *Index) expand(prefix string) map[string][]int {
+	merged := make(map[string][]int)
+	for i := sort.SearchStrings(ix.words, prefix); i < len(ix.words) && strings.HasPrefix(ix.words[i], prefix); i++ {
+		for id, positions := range ix.postings[ix.words[i]] {
+			merged[id] = append(merged[id], positions...)
+		}
+	}
+	for _, positions := range merged {
+		sort.Ints(positions)
+	}
+	return merged
+}
+
+func (ix *Index) bm25(termFrequency, documentFrequency, length int) float64 {
+	n := float64(len(ix.docs))
+	df := float64(documentFrequency)
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+	avgLength := float64(ix.totalLen) / n
+	tf := float64(termFrequency)
+	norm := 1.0
+	if avgLength > 0 {
+		norm = 1 - b + b*float64(length)/avgLength
+	}
+	return idf * tf * (k1 + 1) / (tf + k1*norm)
+}
+
+func (ix *Index) insertWord(word string) {
+	i := sort.SearchStrings(ix.words, word)
+	ix.words = append(ix.words, "")
+	copy(ix.words[i+1:], ix.words[i:])
+	ix.words[i] = word
+}
+
+func (ix *Index) deleteWord(word string) {
+	i := sort.SearchStrings(ix.words, word)
+	if i < len(ix.words) && ix.words[i] == word {
+		ix.words = append(ix.words[:i], ix.words[i+1:]...)
+	}
+}
+
+func containsPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
+}
@@ -0,0 +1,152 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func mustParse(t *testing.T, text string) Query {
+	t.Helper()
+	query, err := ParseQuery(text)
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", text, err)
+	}
+	return query
+}
+
+func resultIDs(results []Result) []string {
+	ids := make([]string, len(results))
+	for i, result := range results {
+		ids[i] = result.ID
+	}
+	return ids
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Summer_Holiday.mp4", []string{"summer", "holiday", "mp4"}},
+		{"  Hello,   World!  ", []string{"hello", "world"}},
+		{"Café-Crème 2024", []string{"café", "crème", "2024"}},
+		{"...", []string{}},
+	}
+	for _, tt := range tests {
+		if got := Tokenize(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []Term
+	}{
+		{"", nil},
+		{"summer holiday", []Term{{Words: []string{"summer"}}, {Words: []string{"holiday"}}}},
+		{`"summer holiday"`, []Term{{Words: []string{"summer", "holiday"}}}},
+		{"vac*", []Term{{Words: []string{"vac"}, Prefix: true}}},
+		{"song.mp3", []Term{{Words: []string{"song", "mp3"}}}},
+		{`"summer holiday" vac*`, []Term{{Words: []string{"summer", "holiday"}}, {Words: []string{"vac"}, Prefix: true}}},
+		{"-- !!", nil},
+	}
+	for _, tt := range tests {
+		if got := mustParse(t, tt.text).Terms; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%q) terms = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("long", "summer song with a much longer title than the others")
+	ix.Add("repeated", "summer summer song")
+	ix.Add("short", "summer song")
+	ix.Add("unrelated", "winter song")
+
+	got := resultIDs(ix.Search(mustParse(t, "summer")))
+	want := []string{"repeated", "short", "long"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// A rarer word counts for more
+	results := ix.Search(mustParse(t, "winter song"))
+	if len(results) != 1 || results[0].ID != "unrelated" {
+		t.Fatalf("got %v, want only unrelated", resultIDs(results))
+	}
+	if all := ix.Search(mustParse(t, "song")); all[len(all)-1].Score >= results[0].Score {
+		t.Fatalf("a common word scored %f, as much as a rare one with it (%f)", all[len(all)-1].Score, results[0].Score)
+	}
+}
+
+func TestSearchRequiresEveryTerm(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("a", "summer holiday")
+	ix.Add("b", "summer")
+
+	if got := resultIDs(ix.Search(mustParse(t, "summer holiday"))); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got %v, want [a]", got)
+	}
+	if got := ix.Search(mustParse(t, "summer winter")); len(got) != 0 {
+		t.Fatalf("got %v, want no results", resultIDs(got))
+	}
+	if got := ix.Search(mustParse(t, "")); got != nil {
+		t.Fatalf("empty query matched %v", resultIDs(got))
+	}
+}
+
+func TestSearchPhrasesAndPrefixes(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("phrase", "Summer_Holiday.mp4")
+	ix.Add("reversed", "holiday summer")
+	ix.Add("fields", "summer", "holiday") // Phrases do not span fields
+	ix.Add("vacation", "vacation photos")
+
+	if got := resultIDs(ix.Search(mustParse(t, `"summer holiday"`))); !reflect.DeepEqual(got, []string{"phrase"}) {
+		t.Errorf("phrase: got %v, want [phrase]", got)
+	}
+	if got := resultIDs(ix.Search(mustParse(t, "holiday.mp4"))); !reflect.DeepEqual(got, []string{"phrase"}) {
+		t.Errorf("punctuated word: got %v, want [phrase]", got)
+	}
+	if got := resultIDs(ix.Search(mustParse(t, "vac*"))); !reflect.DeepEqual(got, []string{"vacation"}) {
+		t.Errorf("prefix: got %v, want [vacation]", got)
+	}
+	if got := ix.Search(mustParse(t, "vac")); len(got) != 0 {
+		t.Errorf("a word matched only its prefix: %v", resultIDs(got))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("a", "vacation photos")
+	ix.Add("b", "vacuum manual")
+
+	ix.Remove("a")
+	ix.Remove("missing")
+	if ix.Len() != 1 {
+		t.Fatalf("Len = %d, want 1", ix.Len())
+	}
+	if got := ix.Search(mustParse(t, "photos")); len(got) != 0 {
+		t.Fatalf("removed document still matches: %v", resultIDs(got))
+	}
+	if got := resultIDs(ix.Search(mustParse(t, "vac*"))); !reflect.DeepEqual(got, []string{"b"}) {
+		t.Fatalf("prefix after removal: got %v, want [b]", got)
+	}
+	for _, word := range ix.words {
+		if word == "photos" || word == "vacation" {
+			t.Fatalf("vocabulary still holds %q", word)
+		}
+	}
+
+	// Adding a document again replaces it
+	ix.Add("b", "tractor manual")
+	if got := ix.Search(mustParse(t, "vacuum")); len(got) != 0 {
+		t.Fatalf("replaced text still matches: %v", resultIDs(got))
+	}
+	if ix.Len() != 1 || ix.totalLen != 2 {
+		t.Fatalf("Len = %d, total length %d after replacing", ix.Len(), ix.totalLen)
+	}
+}
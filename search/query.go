@@ -0,0 +1,308 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"sp/config"
+)
+
+// Query is a parsed search query such as
+//
+//	tag:music size:>10MB owner:peer_x uploaded:<7d "exact phrase" -excluded
+//
+// A file matches when it matches every term and filter and none of the
+// excluded terms.
+type Query struct {
+	Terms    []Term
+	Excluded []Term
+	Filters  []Filter
+}
+
+// Term is one or more words that must appear consecutively. With Prefix set
+// the last word matches any word starting with it.
+type Term struct {
+	Words  []string
+	Prefix bool
+}
+
+// Fields are the file attributes filters are evaluated against.
+type Fields struct {
+	Category string
+	Tags     []string
+	Owner    string
+	Size     int64
+	Uploaded time.Time
+}
+
+// Filter is a condition on the fields of a file.
+type Filter interface {
+	Match(f Fields) bool
+}
+
+// Op is a comparison operator.
+type Op string
+
+const (
+	OpEq Op = "="
+	OpLt Op = "<"
+	OpLe Op = "<="
+	OpGt Op = ">"
+	OpGe Op = ">="
+)
+
+// TagFilter matches files with the tag (case-insensitive).
+type TagFilter struct{ Tag string }
+
+// CategoryFilter matches files in the category (case-insensitive).
+type CategoryFilter struct{ Category string }
+
+// OwnerFilter matches files registered by the peer.
+type OwnerFilter struct{ Owner string }
+
+// SizeFilter compares the file size in bytes.
+type SizeFilter struct {
+	Op    Op
+	Bytes int64
+}
+
+// UploadedFilter matches files uploaded in [After, Before). A zero bound is
+// open.
+type UploadedFilter struct {
+	After  time.Time
+	Before time.Time
+}
+
+// NotFilter inverts a filter.
+type NotFilter struct{ Filter Filter }
+
+func (f TagFilter) Match(fields Fields) bool {
+	for _, tag := range fields.Tags {
+		if strings.EqualFold(tag, f.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f CategoryFilter) Match(fields Fields) bool {
+	return strings.EqualFold(fields.Category, f.Category)
+}
+
+func (f OwnerFilter) Match(fields Fields) bool {
+	return fields.Owner == f.Owner
+}
+
+func (f SizeFilter) Match(fields Fields) bool {
+	switch f.Op {
+	case OpLt:
+		return fields.Size < f.Bytes
+	case OpLe:
+		return fields.Size <= f.Bytes
+	case OpGt:
+		return fields.Size > f.Bytes
+	case OpGe:
+		return fields.Size >= f.Bytes
+	default:
+		return fields.Size == f.Bytes
+	}
+}
+
+func (f UploadedFilter) Match(fields Fields) bool {
+	if !f.After.IsZero() && fields.Uploaded.Before(f.After) {
+		return false
+	}
+	return f.Before.IsZero() || fields.Uploaded.Before(f.Before)
+}
+
+func (f NotFilter) Match(fields Fields) bool {
+	return !f.Filter.Match(fields)
+}
+
+// MatchFields reports whether the fields satisfy every filter of the query.
+func (q Query) MatchFields(fields Fields) bool {
+	for _, filter := range q.Filters {
+		if !filter.Match(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+// HasText reports whether the query has free-text terms to look up in the
+// index, including excluded ones.
+func (q Query) HasText() bool {
+	return len(q.Terms) > 0 || len(q.Excluded) > 0
+}
+
+// IsEmpty reports whether the query has no terms or filters.
+func (q Query) IsEmpty() bool {
+	return !q.HasText() && len(q.Filters) == 0
+}
+
+// ParseQuery parses a query string. Double-quoted text is a phrase, a
+// trailing * makes a prefix term, a leading - excludes a term or negates a
+// filter, and punctuation inside a word (as in "song.mp3") makes it a phrase
+// of its parts. field:value filters are recognized for tag, category, owner,
+// size (e.g. size:>10MB) and uploaded (an age such as uploaded:<7d or a date
+// such as uploaded:>=2024-01-31); other words with a colon are plain text.
+func ParseQuery(text string) (Query, error) {
+	return parseQuery(text, time.Now())
+}
+
+func parseQuery(text string, now time.Time) (Query, error) {
+	var query Query
+	for _, token := range splitTokens(text) {
+		negated := strings.HasPrefix(token, "-") && len(token) > 1
+		if negated {
+			token = token[1:]
+		}
+
+		if field, value, ok := strings.Cut(token, ":"); ok && value != "" && !strings.HasPrefix(token, `"`) {
+			filter, err := parseFilter(strings.ToLower(field), unquote(value), now)
+			if err != nil {
+				return Query{}, err
+			}
+			if filter != nil {
+				if negated {
+					filter = NotFilter{Filter: filter}
+				}
+				query.Filters = append(query.Filters, filter)
+				continue
+			}
+		}
+
+		term, ok := parseTerm(token)
+		if !ok {
+			continue
+		}
+		if negated {
+			query.Excluded = append(query.Excluded, term)
+		} else {
+			query.Terms = append(query.Terms, term)
+		}
+	}
+	return query, nil
+}
+
+// Split on whitespace outside double quotes
+func splitTokens(text string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func unquote(value string) string {
+	return strings.Trim(value, `"`)
+}
+
+func parseTerm(token string) (Term, bool) {
+	quoted := strings.HasPrefix(token, `"`)
+	words := Tokenize(token)
+	if len(words) == 0 {
+		return Term{}, false
+	}
+	return Term{
+		Words:  words,
+		Prefix: !quoted && strings.HasSuffix(token, "*"),
+	}, true
+}
+
+// Parse a field:value filter. Returns nil for fields that are not filters.
+func parseFilter(field, value string, now time.Time) (Filter, error) {
+	switch field {
+	case "tag":
+		return TagFilter{Tag: value}, nil
+	case "category":
+		return CategoryFilter{Category: value}, nil
+	case "owner":
+		return OwnerFilter{Owner: value}, nil
+	case "size":
+		op, operand := parseOp(value)
+		bytes, err := config.ParseSize(operand)
+		if err != nil {
+			return nil, fmt.Errorf("size filter: %w", err)
+		}
+		return SizeFilter{Op: op, Bytes: bytes}, nil
+	case "uploaded":
+		return parseUploaded(value, now)
+	}
+	return nil, nil
+}
+
+func parseOp(value string) (Op, string) {
+	for _, op := range []Op{OpLe, OpGe, OpLt, OpGt, OpEq} {
+		if strings.HasPrefix(value, string(op)) {
+			return op, strings.TrimPrefix(value, string(op))
+		}
+	}
+	return OpEq, value
+}
+
+// An uploaded filter compares either an age ("<7d": newer than 7 days) or a
+// calendar date in UTC ("<2024-01-31": before that day)
+func parseUploaded(value string, now time.Time) (Filter, error) {
+	op, operand := parseOp(value)
+
+	if day, err := time.Parse("2006-01-02", operand); err == nil {
+		next := day.AddDate(0, 0, 1)
+		switch op {
+		case OpLt:
+			return UploadedFilter{Before: day}, nil
+		case OpLe:
+			return UploadedFilter{Before: next}, nil
+		case OpGt:
+			return UploadedFilter{After: next}, nil
+		case OpGe:
+			return UploadedFilter{After: day}, nil
+		default:
+			return UploadedFilter{After: day, Before: next}, nil
+		}
+	}
+
+	age, err := parseAge(operand)
+	if err != nil {
+		return nil, fmt.Errorf("uploaded filter: invalid age or date %q", operand)
+	}
+	cutoff := now.Add(-age)
+	if op == OpGt || op == OpGe {
+		return UploadedFilter{Before: cutoff}, nil
+	}
+	return UploadedFilter{After: cutoff}, nil
+}
+
+// Parse an age such as "7d", "2w" or "36h"
+func parseAge(value string) (time.Duration, error) {
+	units := map[string]time.Duration{"w": 7 * 24 * time.Hour, "d": 24 * time.Hour}
+	for suffix, unit := range units {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid age %q", value)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,170 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestParseQueryLanguage(t *testing.T) {
+	day := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+	next := day.AddDate(0, 0, 1)
+
+	tests := []struct {
+		text string
+		want Query
+	}{
+		{"tag:music", Query{Filters: []Filter{TagFilter{Tag: "music"}}}},
+		{"Category:Video", Query{Filters: []Filter{CategoryFilter{Category: "Video"}}}},
+		{"owner:peer_x", Query{Filters: []Filter{OwnerFilter{Owner: "peer_x"}}}},
+		{`tag:"live music"`, Query{Filters: []Filter{TagFilter{Tag: "live music"}}}},
+
+		// Two-character operators are matched before their one-character prefixes
+		{"size:10MB", Query{Filters: []Filter{SizeFilter{Op: OpEq, Bytes: 10 << 20}}}},
+		{"size:=1KB", Query{Filters: []Filter{SizeFilter{Op: OpEq, Bytes: 1 << 10}}}},
+		{"size:<5", Query{Filters: []Filter{SizeFilter{Op: OpLt, Bytes: 5}}}},
+		{"size:<=5", Query{Filters: []Filter{SizeFilter{Op: OpLe, Bytes: 5}}}},
+		{"size:>1.5GB", Query{Filters: []Filter{SizeFilter{Op: OpGt, Bytes: 3 << 29}}}},
+		{"size:>=5", Query{Filters: []Filter{SizeFilter{Op: OpGe, Bytes: 5}}}},
+
+		{"uploaded:<7d", Query{Filters: []Filter{UploadedFilter{After: testNow.Add(-7 * 24 * time.Hour)}}}},
+		{"uploaded:>2w", Query{Filters: []Filter{UploadedFilter{Before: testNow.Add(-14 * 24 * time.Hour)}}}},
+		{"uploaded:<=36h", Query{Filters: []Filter{UploadedFilter{After: testNow.Add(-36 * time.Hour)}}}},
+		{"uploaded:2024-01-31", Query{Filters: []Filter{UploadedFilter{After: day, Before: next}}}},
+		{"uploaded:<2024-01-31", Query{Filters: []Filter{UploadedFilter{Before: day}}}},
+		{"uploaded:<=2024-01-31", Query{Filters: []Filter{UploadedFilter{Before: next}}}},
+		{"uploaded:>2024-01-31", Query{Filters: []Filter{UploadedFilter{After: next}}}},
+		{"uploaded:>=2024-01-31", Query{Filters: []Filter{UploadedFilter{After: day}}}},
+
+		// Negation applies to filters and terms alike
+		{"-tag:draft", Query{Filters: []Filter{NotFilter{Filter: TagFilter{Tag: "draft"}}}}},
+		{"-draft", Query{Excluded: []Term{{Words: []string{"draft"}}}}},
+		{`-"rough cut"`, Query{Excluded: []Term{{Words: []string{"rough", "cut"}}}}},
+		{"-", Query{}},
+
+		// Words with a colon that are not filters, and quoted ones, are text
+		{"note:taking", Query{Terms: []Term{{Words: []string{"note", "taking"}}}}},
+		{`"tag:music"`, Query{Terms: []Term{{Words: []string{"tag", "music"}}}}},
+		{"tag:", Query{Terms: []Term{{Words: []string{"tag"}}}}},
+		{`"vac*"`, Query{Terms: []Term{{Words: []string{"vac"}}}}},
+
+		{`summer tag:music "road trip" -draft size:<1GB`, Query{
+			Terms:    []Term{{Words: []string{"summer"}}, {Words: []string{"road", "trip"}}},
+			Excluded: []Term{{Words: []string{"draft"}}},
+			Filters:  []Filter{TagFilter{Tag: "music"}, SizeFilter{Op: OpLt, Bytes: 1 << 30}},
+		}},
+	}
+	for _, tt := range tests {
+		got, err := parseQuery(tt.text, testNow)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryMalformed(t *testing.T) {
+	for _, text := range []string{
+		"size:big",
+		"size:>",
+		"size:<-5",
+		"uploaded:yesterday",
+		"uploaded:<-3d",
+		"uploaded:2024-13-01x",
+		"summer size:>>5",
+	} {
+		if query, err := parseQuery(text, testNow); err == nil {
+			t.Errorf("ParseQuery(%q) accepted as %+v", text, query)
+		}
+	}
+
+	// An unterminated quote runs to the end of the query
+	query, err := parseQuery(`"summer holiday`, testNow)
+	if err != nil || !reflect.DeepEqual(query.Terms, []Term{{Words: []string{"summer", "holiday"}}}) {
+		t.Errorf("unterminated quote parsed to %+v, %v", query, err)
+	}
+}
+
+func TestMatchFields(t *testing.T) {
+	fields := Fields{
+		Category: "audio",
+		Tags:     []string{"Music", "live"},
+		Owner:    "peer_x",
+		Size:     10 << 20,
+		Uploaded: testNow.Add(-48 * time.Hour),
+	}
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"tag:music", true},
+		{"tag:jazz", false},
+		{"-tag:jazz", true},
+		{"category:AUDIO", true},
+		{"owner:peer_x", true},
+		{"owner:peer_y", false},
+		{"size:10MB", true},
+		{"size:>10MB", false},
+		{"size:>=10MB", true},
+		{"size:<=10MB size:>1MB", true},
+		{"uploaded:<7d", true},
+		{"uploaded:<1d", false},
+		{"uploaded:>1d", true},
+		{"uploaded:2024-03-08", true},
+		{"uploaded:<2024-03-08", false},
+		{"tag:music -owner:peer_x", false},
+		{"anything", true}, // Text is not a filter
+	}
+	for _, tt := range tests {
+		query, err := parseQuery(tt.text, testNow)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", tt.text, err)
+		}
+		if got := query.MatchFields(fields); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestQueryIsEmpty(t *testing.T) {
+	tests := []struct {
+		text           string
+		empty, hasText bool
+	}{
+		{"", true, false},
+		{"  ", true, false},
+		{"tag:music", false, false},
+		{"-draft", false, true},
+		{"summer", false, true},
+	}
+	for _, tt := range tests {
+		query := mustParse(t, tt.text)
+		if query.IsEmpty() != tt.empty || query.HasText() != tt.hasText {
+			t.Errorf("%q: IsEmpty %v, HasText %v", tt.text, query.IsEmpty(), query.HasText())
+		}
+	}
+}
+
+func TestSearchExcludedTerms(t *testing.T) {
+	ix := NewIndex()
+	ix.Add("final", "summer video final")
+	ix.Add("draft", "summer video draft")
+	ix.Add("other", "winter photos")
+
+	if got := resultIDs(ix.Search(mustParse(t, "summer -draft"))); !reflect.DeepEqual(got, []string{"final"}) {
+		t.Errorf("got %v, want [final]", got)
+	}
+	// With only excluded terms every other document matches
+	if got := resultIDs(ix.Search(mustParse(t, "-draft"))); !reflect.DeepEqual(got, []string{"final", "other"}) {
+		t.Errorf("got %v, want [final other]", got)
+	}
+	// Filters alone are left to the caller
+	if got := ix.Search(mustParse(t, "tag:music")); got != nil {
+		t.Errorf("filter-only query matched %v", resultIDs(got))
+	}
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+// walRecord is a single line of the write-ahead log.
+type walRecord struct {
+	Op     string          `json:"op"` // "put" or "delete"
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// DiskStore is an embedded on-disk store. Every mutation is appended to a
+// write-ahead log and fsynced before returning; Snapshot writes the full state
+// to a snapshot file and truncates the log.
+type DiskStore struct {
+	dir        string
+	buckets    map[string]map[string]json.RawMessage
+	wal        *os.File
+	walRecords int
+	mutex      sync.Mutex
+}
+
+// OpenDiskStore opens (or creates) a store in dir, loading the latest
+// snapshot and replaying the write-ahead log on top of it.
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &DiskStore{
+		dir:     dir,
+		buckets: make(map[string]map[string]json.RawMessage),
+	}
+
+	if err := d.loadSnapshot(); err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	good, err := d.replayWAL()
+	if err != nil {
+		return nil, fmt.Errorf("replay wal: %w", err)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cut off a torn tail so new records follow the last good one instead
+	// of being hidden behind it on the next replay
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+	if info.Size() > good {
+		log.Printf("⚠️ Truncating %d bytes of corrupt WAL tail", info.Size()-good)
+		if err := wal.Truncate(good); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("truncate wal: %w", err)
+		}
+		if err := wal.Sync(); err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+	d.wal = wal
+
+	return d, nil
+}
+
+func (d *DiskStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.buckets)
+}
+
+// Apply the write-ahead log on top of the snapshot. Returns the offset just
+// past the last intact record.
+func (d *DiskStore) replayWAL() (int64, error) {
+	file, err := os.Open(filepath.Join(d.dir, walFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var good int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// Every record is written with its newline, so a record
+				// without one was cut short
+				log.Printf("⚠️ Ignoring unterminated WAL record after %d entries", d.walRecords)
+			}
+			return good, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// A torn write at the tail of the log is expected after a crash;
+			// everything before it has been applied already.
+			log.Printf("⚠️ Ignoring corrupt WAL record after %d entries: %v", d.walRecords, err)
+			return good, nil
+		}
+		d.apply(record)
+		d.walRecords++
+		good += int64(len(line))
+	}
+}
+
+func (d *DiskStore) apply(record walRecord) {
+	switch record.Op {
+	case "put":
+		if d.buckets[record.Bucket] == nil {
+			d.buckets[record.Bucket] = make(map[string]json.RawMessage)
+		}
+		d.buckets[record.Bucket][record.Key] = record.Value
+	case "delete":
+		delete(d.buckets[record.Bucket], record.Key)
+	}
+}
+
+func (d *DiskStore) append(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.wal == nil {
+		return fmt.Errorf("store is closed")
+	}
+	if _, err := d.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := d.wal.Sync(); err != nil {
+		return err
+	}
+
+	d.apply(record)
+	d.walRecords++
+	return nil
+}
+
+func (d *DiskStore) Put(bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return d.append(walRecord{Op: "put", Bucket: bucket, Key: key, Value: data})
+}
+
+func (d *DiskStore) Delete(bucket, key string) error {
+	return d.append(walRecord{Op: "delete", Bucket: bucket, Key: key})
+}
+
+func (d *DiskStore) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	d.mutex.Lock()
+	records := d.buckets[bucket]
+	keys := make([]string, 0, len(records))
+	values := make(map[string]json.RawMessage, len(records))
+	for key, value := range records {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	d.mutex.Unlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the current state to disk and truncates the write-ahead
+// log. The snapshot is written to a temporary file and renamed into place, so
+// a crash leaves either the old or the new snapshot, plus a log that is safe
+// to replay on top of either.
+func (d *DiskStore) Snapshot() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.wal == nil {
+		return fmt.Errorf("store is closed")
+	}
+	if d.walRecords == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(d.buckets)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(d.dir, snapshotFile+".tmp")
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(d.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if err := d.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.wal.Seek(0, 0); err != nil {
+		return err
+	}
+	d.walRecords = 0
+
+	return nil
+}
+
+func (d *DiskStore) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.wal == nil {
+		return nil
+	}
+	err := d.wal.Close()
+	d.wal = nil
+	return err
+}
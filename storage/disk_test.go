@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readAll(t *testing.T, store Store, bucket string) map[string]string {
+	t.Helper()
+	records := make(map[string]string)
+	err := store.ForEach(bucket, func(key string, value json.RawMessage) error {
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return err
+		}
+		records[key] = s
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return records
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Put("files", "a", "1")
+	store.Put("files", "b", "2")
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	store.Put("files", "c", "3")
+	store.Delete("files", "a")
+	store.Close()
+
+	store, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	got := readAll(t, store, "files")
+	if len(got) != 2 || got["b"] != "2" || got["c"] != "3" {
+		t.Fatalf("after reopen got %v", got)
+	}
+}
+
+func TestDiskStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Put("peers", "a", "before crash")
+	store.Close()
+
+	// A crash in the middle of a write leaves half a record behind
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString(`{"op":"put","bucket":"peers","key":"b","val`)
+	wal.Close()
+
+	store, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen after crash: %v", err)
+	}
+	if err := store.Put("peers", "c", "after crash"); err != nil {
+		t.Fatalf("put after crash: %v", err)
+	}
+	store.Close()
+
+	store, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	got := readAll(t, store, "peers")
+	if len(got) != 2 || got["a"] != "before crash" || got["c"] != "after crash" {
+		t.Fatalf("writes after the crash were lost, got %v", got)
+	}
+}
+
+func TestDiskStoreCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	store.Put("peers", "a", "1")
+	store.Close()
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.WriteString("garbage\n")
+	wal.Close()
+
+	store, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	store.Put("peers", "b", "2")
+	store.Close()
+
+	store, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	got := readAll(t, store, "peers")
+	if len(got) != 2 || got["a"] != "1" || got["b"] != "2" {
+		t.Fatalf("got %v", got)
+	}
+}
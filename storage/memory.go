@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps records in memory only. It is useful for development and
+// for running a throwaway super-peer that should forget everything on exit.
+type MemoryStore struct {
+	buckets map[string]map[string]json.RawMessage
+	mutex   sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]map[string]json.RawMessage)}
+}
+
+func (m *MemoryStore) Put(bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.buckets[bucket] == nil {
+		m.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	m.buckets[bucket][key] = data
+	return nil
+}
+
+func (m *MemoryStore) Delete(bucket, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *MemoryStore) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	m.mutex.RLock()
+	records := m.buckets[bucket]
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	values := make(map[string]json.RawMessage, len(records))
+	for key, value := range records {
+		values[key] = value
+	}
+	m.mutex.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Snapshot() error { return nil }
+
+func (m *MemoryStore) Close() error { return nil }
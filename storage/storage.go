@@ -0,0 +1,26 @@
+// Package storage provides the persistence layer behind the super-peer index.
+//
+// Records are grouped into buckets ("peers", "files", ...) and stored as JSON
+// documents keyed by string. The disk-backed implementation appends every
+// mutation to a write-ahead log and periodically compacts the log into a
+// snapshot, so the index can be rebuilt after a restart.
+package storage
+
+import (
+	"encoding/json"
+)
+
+// Store is the interface the super-peer uses to persist its index.
+type Store interface {
+	// Put stores value (marshalled as JSON) under bucket/key.
+	Put(bucket, key string, value interface{}) error
+	// Delete removes bucket/key. Deleting a missing key is not an error.
+	Delete(bucket, key string) error
+	// ForEach calls fn for every record in bucket, in key order.
+	ForEach(bucket string, fn func(key string, value json.RawMessage) error) error
+	// Snapshot compacts the store so that startup does not need to replay
+	// the whole mutation history.
+	Snapshot() error
+	// Close flushes and releases the underlying resources.
+	Close() error
+}